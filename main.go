@@ -39,45 +39,163 @@ func main() {
 		SilenceUsage: true,
 	}
 
-	root.Flags().StringVar(&upgradeConfig.ManagementCluster.Kubeconfig, "kubeconfig",
-		"", "The kubeconfig path for the management cluster (required)")
-	root.MarkFlagRequired("kubeconfig")
+	root.PersistentFlags().StringVar(&upgradeConfig.ManagementCluster.Kubeconfig, "kubeconfig",
+		"", "The kubeconfig path for the management cluster (optional, defaults to $KUBECONFIG, then $HOME/.kube/config, then the in-cluster config when running in a pod)")
 
-	root.Flags().StringVar(&upgradeConfig.TargetCluster.Namespace,
+	root.PersistentFlags().StringVar(&upgradeConfig.ManagementCluster.Context, "context",
+		"", "The kubeconfig context of the management cluster (optional, defaults to the current context)")
+
+	root.PersistentFlags().StringVar(&upgradeConfig.TargetCluster.Namespace,
 		"cluster-namespace", "", "The namespace of target cluster (required)")
-	root.MarkFlagRequired("cluster-namespace")
+	root.MarkPersistentFlagRequired("cluster-namespace")
 
-	root.Flags().StringVar(&upgradeConfig.TargetCluster.Name, "cluster-name", "",
+	root.PersistentFlags().StringVar(&upgradeConfig.TargetCluster.Name, "cluster-name", "",
 		"The name of target cluster (required)")
-	root.MarkFlagRequired("cluster-name")
+	root.MarkPersistentFlagRequired("cluster-name")
 
 	root.Flags().StringVar(&upgradeConfig.TargetCluster.CAKeyPair.SecretRef, "ca-secret", "", "TODO")
 
 	root.Flags().StringVar(&upgradeConfig.TargetCluster.CAKeyPair.ClusterField, "ca-field",
-		"", "The CA field in provider manifests, 'spec.providerSpec.value.caKeyPair' for the AWS provider (optional)")
+		"", "The CA key pair field in the cluster's provider manifests, e.g. 'spec.providerSpec.value.caKeyPair' (optional)")
 
 	root.Flags().StringVar(&upgradeConfig.TargetCluster.CAKeyPair.KubeconfigSecretRef, "kubeconfig-secret", "",
-		"The name of the secret the kubeconfig is stored in. Assumed to be in the same namespace as the cluster object.")
+		"The name of the secret the kubeconfig is stored in. Assumed to be in the same namespace as the cluster object. "+
+			"Without any other credential flag the <cluster-name>-kubeconfig secret, the <cluster-name>-ca secret "+
+			"and the CA key pair field of the infrastructure cluster are tried in that order.")
+
+	root.Flags().StringVar(&upgradeConfig.TargetCluster.CAKeyPair.Kubeconfig, "target-kubeconfig", "",
+		"Path to a kubeconfig of the target cluster (optional)")
+
+	root.Flags().StringVar(&upgradeConfig.TargetCluster.CAKeyPair.CACertFile, "ca-cert-file", "",
+		"Path to the PEM encoded CA certificate of the target cluster, used with --ca-key-file (optional)")
+
+	root.Flags().StringVar(&upgradeConfig.TargetCluster.CAKeyPair.CAKeyFile, "ca-key-file", "",
+		"Path to the PEM encoded CA private key of the target cluster, used with --ca-cert-file (optional)")
 
 	root.Flags().StringVar(&upgradeConfig.KubernetesVersion, "kubernetes-version", "",
 		"Desired kubernetes version to upgrade to (required)")
 	root.MarkFlagRequired("kubernetes-version")
 
 	root.Flags().StringVar(&upgradeConfig.TargetCluster.UpgradeScope, "scope", "",
-		"Scope of upgrade - [control-plane | machine-deployment] (required)")
+		"Scope of upgrade - [control-plane | machine-deployment | worker-machine] (required)")
 	root.MarkFlagRequired("scope")
 
 	root.Flags().StringVar(&upgradeConfig.TargetCluster.CAKeyPair.APIEndpoint, "api-endpoint",
-		"", "Target cluster's API endpoint and port. For example: https://example.com:6443. Required with --ca-secret OR --ca-field. Ignored with --kubeconfig-secret-ref.")
+		"", "Target cluster's API endpoint and port, e.g. https://example.com:6443. Used with a CA key pair to override the endpoint in the status of the Cluster or its infrastructure cluster. Ignored with a kubeconfig.")
+
+	root.Flags().DurationVar(&upgradeConfig.TargetCluster.CAKeyPair.ClientCertificateTTL, "client-certificate-ttl", upgrade.DefaultClientCertificateTTL,
+		"How long each client certificate issued from the target cluster's CA is valid; a new one is issued before it expires")
+
+	root.Flags().StringSliceVar(&upgradeConfig.TargetCluster.CAKeyPair.ClientCertificateGroups, "client-certificate-groups", upgrade.DefaultClientCertificateGroups,
+		"Comma separated groups of the client certificate issued from the target cluster's CA, whose user is "+upgrade.ClientCertificateUserPrefix+"<upgrade-id>. "+
+			"The default group has no permissions until it is bound to a ClusterRole in the target cluster; system:masters bypasses RBAC entirely. "+
+			"Only used with a CA key pair: without explicit credentials the <cluster>-kubeconfig secret is preferred over the <cluster>-ca secret, and its credentials are used as they are")
 
 	root.Flags().StringVar(&upgradeConfig.MachineUpdates.Image.ID, "image-id",
-		"", "The provider-specific image identifier to use when booting a machine (optional)")
+		"", "The provider-specific image identifier to use when booting a machine (optional, looked up in --image-catalog if unset)")
 
 	root.Flags().StringVar(&upgradeConfig.MachineUpdates.Image.Field, "image-field",
 		"", "The image identifier field in provider manifests (optional)")
 
-	root.Flags().StringVar(&upgradeConfig.UpgradeID, "upgrade-id", "",
-		"Unique identifier used to resume a partial upgrade (optional)")
+	root.Flags().StringVar(&upgradeConfig.MachineUpdates.Image.InfrastructureField, "infrastructure-image-field",
+		"", "The image identifier field in infrastructure machines; machine deployments get a new infrastructure template with it set (optional, defaults to the provider's field, e.g. spec.ami.id for AWSMachines)")
+
+	root.Flags().StringVar(&upgradeConfig.MachineUpdates.Image.Catalog, "image-catalog", "",
+		"Path to a YAML image catalog to look up the image id and fields by provider, region, flavor and Kubernetes version (optional)")
+
+	root.Flags().StringVar(&upgradeConfig.MachineUpdates.Image.Provider, "image-provider", "",
+		"The provider to look up in the image catalog, e.g. aws (required with --image-catalog unless --image-id is set)")
+
+	root.Flags().StringVar(&upgradeConfig.MachineUpdates.Image.Region, "image-region", "",
+		"The region to look up in the image catalog (optional)")
+
+	root.Flags().StringVar(&upgradeConfig.MachineUpdates.Image.Flavor, "image-flavor", "",
+		"The image flavor to look up in the image catalog, e.g. ubuntu-18.04 (optional)")
+
+	root.Flags().StringVar(&upgradeConfig.MachineUpdates.MachineClass, "machine-class", "",
+		"The instance type of new machines, e.g. m5.xlarge; set in the provider's instance type field, like spec.instanceType for AWSMachines (optional)")
+
+	root.Flags().StringArrayVar(&upgradeConfig.MachineUpdates.Set, "set", nil,
+		"Set a field of new machines, as [machine|infrastructure:]path=value, e.g. infrastructure:spec.rootDeviceSize=100 or \"infrastructure:spec.additionalTags['example.com/team']=infra\"; the value is YAML and the path a JSONPath-style path or a JSON pointer (repeatable, optional)")
+
+	root.Flags().StringVar(&upgradeConfig.MachineUpdates.FieldUpdatesFile, "field-updates-file", "",
+		"Path to a YAML list of field updates with target, path, op and value; paths starting with / are JSON Patch operations (optional)")
+
+	root.Flags().StringVar(&upgradeConfig.MachineUpdates.BootstrapConfigPatchFile, "bootstrap-config-patch", "",
+		"Path to a JSON merge patch (YAML or JSON) applied to a copy of each machine deployment's bootstrap config template, e.g. a KubeadmConfigTemplate (optional)")
+
+	root.Flags().StringVar(&upgradeConfig.MachineUpdates.NameTemplate, "machine-name-template", "",
+		"Go template for the names of replacement machines. Fields: .Prefix, .Name, .UpgradeID, .Hash (optional, default \""+upgrade.DefaultMachineNameTemplate+"\")")
+
+	root.PersistentFlags().StringVar(&upgradeConfig.UpgradeID, "upgrade-id", "",
+		"Unique identifier used to resume a partial upgrade (optional), or to clean up after one (required by cleanup)")
+
+	root.Flags().DurationVar(&upgradeConfig.Timeouts.MachineDeletion, "machine-deletion-timeout", upgrade.DefaultMachineDeletionTimeout,
+		"How long to wait for a replaced machine to be deleted")
+
+	root.Flags().DurationVar(&upgradeConfig.Timeouts.MachineDeploymentRollout, "machine-deployment-rollout-timeout", upgrade.DefaultMachineDeploymentRolloutTimeout,
+		"How long to wait for each machine deployment to roll out")
+
+	root.Flags().DurationVar(&upgradeConfig.Timeouts.NodeDrain, "node-drain-timeout", upgrade.DefaultNodeDrainTimeout,
+		"How long to wait for the pods of a worker node to be evicted when --drain is set")
+
+	root.Flags().IntVar(&upgradeConfig.MachineDeployments.MaxConcurrent, "max-concurrent-machine-deployments", upgrade.DefaultMaxConcurrentMachineDeployments,
+		"The maximum number of machine deployments to roll out at the same time")
+
+	root.Flags().StringVar(&upgradeConfig.MachineDeployments.Selector, "machine-deployment-selector", "",
+		"Label selector limiting which machine deployments are upgraded, in addition to the cluster name label (optional)")
+
+	root.Flags().StringSliceVar(&upgradeConfig.MachineDeployments.Names, "machine-deployments", nil,
+		"Comma separated names of the machine deployments to upgrade (optional, default all)")
+
+	root.Flags().StringVar(&upgradeConfig.MachineDeployments.Canary.MachineDeployment, "canary-machine-deployment", "",
+		"Name of a machine deployment to upgrade first; the others are only upgraded if it passes its health gates (optional)")
+
+	root.Flags().StringVar(&upgradeConfig.MachineDeployments.Canary.WorkloadSelector, "canary-workload-selector", "",
+		"Label selector for Deployments in the target cluster that must be available, without pod restarts, after the canary upgrade (optional)")
+
+	root.Flags().BoolVar(&upgradeConfig.MachineDeployments.Canary.Rollback, "canary-rollback", false,
+		"Restore the canary machine deployment's original machine template if it fails its health gates, draining the upgraded nodes when --drain is set")
+
+	root.Flags().BoolVar(&upgradeConfig.MachineDeployments.Drain, "drain", false,
+		"Replace machine deployment machines one at a time, cordoning and draining each old node (respecting PodDisruptionBudgets) before its machine is deleted")
+
+	root.Flags().StringVar(&upgradeConfig.MachineDeployments.MaxSurge, "max-surge", "",
+		"Temporary rolling update maxSurge for each machine deployment during the upgrade, e.g. 2 or 50% (optional)")
+
+	root.Flags().StringVar(&upgradeConfig.MachineDeployments.MaxUnavailable, "max-unavailable", "",
+		"Temporary rolling update maxUnavailable for each machine deployment during the upgrade, e.g. 0 or 10% (optional)")
+
+	root.Flags().BoolVar(&upgradeConfig.CleanupOnFailure, "cleanup-on-failure", true,
+		"Delete the machines, infrastructure and bootstrap objects a failed upgrade created but never finished with")
+
+	root.Flags().BoolVar(&upgradeConfig.CleanupKubeletConfig, "cleanup-kubelet-config", false,
+		"After the upgrade, delete the kubelet-config configmap, role and rolebinding of the previous minor version once no node runs it")
+
+	root.Flags().BoolVar(&upgradeConfig.IgnoreVersionSkew, "ignore-version-skew", false,
+		"Upgrade workers even if the new kubelet version is newer than the control plane or more than two minor versions older")
+
+	root.Flags().BoolVar(&upgradeConfig.SkipRBACPreflight, "skip-rbac-preflight", false,
+		"Start the upgrade without first checking, with SelfSubjectAccessReviews, that both clusters grant every permission it needs")
+
+	cleanup := &cobra.Command{
+		Use:   "cleanup",
+		Short: "Deletes the objects a failed upgrade created but never finished with.",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			cleaner, err := upgrade.NewCleaner(newLogger(), upgradeConfig)
+			if err != nil {
+				return err
+			}
+
+			return cleaner.Cleanup()
+		},
+		SilenceUsage: true,
+	}
+
+	cleanup.Flags().BoolVar(&upgradeConfig.DryRun, "dry-run", false,
+		"Only show what would be deleted")
+
+	root.AddCommand(cleanup)
 
 	if err := root.Execute(); err != nil {
 		// Print a stack trace, if possible. We may end up with the error message printed twice,
@@ -103,6 +221,8 @@ func upgradeCluster(config upgrade.Config) error {
 		upgrader, err = upgrade.NewControlPlaneUpgrader(log, config)
 	case upgrade.MachineDeploymentScope:
 		upgrader, err = upgrade.NewMachineDeploymentUpgrader(log, config)
+	case upgrade.WorkerMachineScope:
+		upgrader, err = upgrade.NewWorkerMachineUpgrader(log, config)
 	default:
 		return errors.Errorf("invalid scope %q", config.TargetCluster.UpgradeScope)
 	}
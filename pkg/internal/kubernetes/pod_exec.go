@@ -6,9 +6,12 @@ package kubernetes
 import (
 	"bytes"
 	"context"
+	"net/http"
+	"net/url"
 
 	"github.com/pkg/errors"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream/spdy"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
@@ -37,7 +40,7 @@ func PodExec(ctx context.Context, input PodExecInput) (string, string, error) {
 		Stderr:    true,
 	}, scheme.ParameterCodec)
 
-	executor, err := remotecommand.NewSPDYExecutor(input.RestConfig, "POST", req.URL())
+	executor, err := newSPDYExecutor(input.RestConfig, req.URL())
 	if err != nil {
 		return "", "", errors.Wrap(err, "error creating executor for pod exec")
 	}
@@ -62,3 +65,19 @@ func PodExec(ctx context.Context, input PodExecInput) (string, string, error) {
 
 	return stdout.String(), stderr.String(), errors.WithStack(err)
 }
+
+// newSPDYExecutor returns an executor for a POST to url. A config with a custom HTTP transport, like one that renews
+// its client certificate, has no TLS options of its own, so the upgraded connection uses the transport's TLS config.
+func newSPDYExecutor(config *rest.Config, url *url.URL) (remotecommand.Executor, error) {
+	transport, ok := config.Transport.(*http.Transport)
+	if !ok || transport.TLSClientConfig == nil {
+		return remotecommand.NewSPDYExecutor(config, "POST", url)
+	}
+
+	upgrader := spdy.NewRoundTripper(transport.TLSClientConfig, true, false)
+	wrapper, err := rest.HTTPWrappersForConfig(config, upgrader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return remotecommand.NewSPDYExecutorForTransports(wrapper, upgrader, "POST", url)
+}
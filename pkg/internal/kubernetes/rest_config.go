@@ -13,7 +13,8 @@ import (
 // NewRestConfig creates a *rest.Config using the following priorities:
 // 1) kubeconfig file,
 // 2) $KUBECONFIG environment variable,
-// 3) $HOME/.kube/config file
+// 3) $HOME/.kube/config file,
+// 4) the in-cluster config of the pod's service account
 // Context is used if it is supplied.
 func NewRestConfig(kubeconfig string, context string) (*rest.Config, error) {
 	// The default loading rules will take $KUBECONFIG into account, if applicable.
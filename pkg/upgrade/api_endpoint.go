@@ -0,0 +1,101 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	"sigs.k8s.io/cluster-api/controllers/external"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// discoverAPIEndpoint returns the URL of the target cluster's API server: the configured override, else the first
+// endpoint in the Cluster's status, else the first one in the status of its infrastructure cluster.
+func discoverAPIEndpoint(c ctrlclient.Client, cluster *clusterapiv1alpha2.Cluster, override string) (string, error) {
+	if override != "" {
+		return override, nil
+	}
+
+	if endpoint := apiEndpointURL(cluster.Status.APIEndpoints); endpoint != "" {
+		return endpoint, nil
+	}
+
+	ref := cluster.Spec.InfrastructureRef
+	if ref == nil {
+		return "", errors.Errorf("cluster %s/%s has no API endpoint in its status and no infrastructure cluster, set the API endpoint", cluster.Namespace, cluster.Name)
+	}
+
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = cluster.Namespace
+	}
+	infraCluster, err := external.Get(c, ref, namespace)
+	if err != nil {
+		return "", errors.Wrapf(err, "error getting %s %s/%s", ref.Kind, namespace, ref.Name)
+	}
+
+	endpoints, err := infrastructureAPIEndpoints(infraCluster)
+	if err != nil {
+		return "", err
+	}
+	if endpoint := apiEndpointURL(endpoints); endpoint != "" {
+		return endpoint, nil
+	}
+
+	return "", errors.Errorf("neither cluster %s/%s nor %s %s have an API endpoint in their status yet, set the API endpoint", cluster.Namespace, cluster.Name, ref.Kind, ref.Name)
+}
+
+// apiEndpointURL returns the https URL of the first endpoint, or "" if there is none.
+func apiEndpointURL(endpoints []clusterapiv1alpha2.APIEndpoint) string {
+	for _, endpoint := range endpoints {
+		if endpoint.Host == "" {
+			continue
+		}
+		port := endpoint.Port
+		if port == 0 {
+			port = 6443
+		}
+		return "https://" + net.JoinHostPort(endpoint.Host, strconv.Itoa(port))
+	}
+	return ""
+}
+
+// infrastructureAPIEndpoints reads status.apiEndpoints of an infrastructure cluster, which v1alpha2 providers
+// such as AWSCluster and DockerCluster report in the same format as the Cluster.
+func infrastructureAPIEndpoints(infraCluster *unstructured.Unstructured) ([]clusterapiv1alpha2.APIEndpoint, error) {
+	list, _, err := unstructured.NestedSlice(infraCluster.Object, "status", "apiEndpoints")
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading the API endpoints of %s %s", infraCluster.GetKind(), infraCluster.GetName())
+	}
+
+	var endpoints []clusterapiv1alpha2.APIEndpoint
+	for _, item := range list {
+		fields, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		host, _, _ := unstructured.NestedString(fields, "host")
+		port, _, _ := unstructured.NestedInt64(fields, "port")
+		endpoints = append(endpoints, clusterapiv1alpha2.APIEndpoint{Host: host, Port: int(port)})
+	}
+	return endpoints, nil
+}
+
+// probeHealthz checks that the target cluster's API server answers /healthz with ok.
+func probeHealthz(client kubernetes.Interface, endpoint string) error {
+	body, err := client.Discovery().RESTClient().Get().AbsPath("/healthz").Do().Raw()
+	if err != nil {
+		return errors.Wrapf(err, "the target cluster API endpoint %s is not reachable", endpoint)
+	}
+	if string(body) != "ok" {
+		return fmt.Errorf("the target cluster API endpoint %s is not healthy: %s", endpoint, body)
+	}
+	return nil
+}
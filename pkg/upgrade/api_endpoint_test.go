@@ -0,0 +1,58 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestAPIEndpointURL(t *testing.T) {
+	assert.Equal(t, "", apiEndpointURL(nil))
+	assert.Equal(t, "https://10.0.0.1:6443", apiEndpointURL([]clusterapiv1alpha2.APIEndpoint{{Host: "10.0.0.1"}}))
+	assert.Equal(t, "https://[fd00::1]:443", apiEndpointURL([]clusterapiv1alpha2.APIEndpoint{{Host: "fd00::1", Port: 443}}))
+	assert.Equal(t, "https://lb.example.com:6443", apiEndpointURL([]clusterapiv1alpha2.APIEndpoint{{}, {Host: "lb.example.com", Port: 6443}}))
+}
+
+func TestInfrastructureAPIEndpoints(t *testing.T) {
+	awsCluster := &unstructured.Unstructured{Object: map[string]interface{}{
+		"kind": "AWSCluster",
+		"status": map[string]interface{}{
+			"apiEndpoints": []interface{}{
+				map[string]interface{}{"host": "my-cluster-apiserver.elb.amazonaws.com", "port": int64(6443)},
+			},
+		},
+	}}
+
+	endpoints, err := infrastructureAPIEndpoints(awsCluster)
+	require.NoError(t, err)
+	assert.Equal(t, []clusterapiv1alpha2.APIEndpoint{{Host: "my-cluster-apiserver.elb.amazonaws.com", Port: 6443}}, endpoints)
+
+	endpoints, err = infrastructureAPIEndpoints(&unstructured.Unstructured{Object: map[string]interface{}{}})
+	require.NoError(t, err)
+	assert.Empty(t, endpoints)
+}
+
+func TestDiscoverAPIEndpoint(t *testing.T) {
+	cluster := &clusterapiv1alpha2.Cluster{
+		Status: clusterapiv1alpha2.ClusterStatus{
+			APIEndpoints: []clusterapiv1alpha2.APIEndpoint{{Host: "10.0.0.1", Port: 6443}},
+		},
+	}
+
+	endpoint, err := discoverAPIEndpoint(nil, cluster, "https://override:6443")
+	require.NoError(t, err)
+	assert.Equal(t, "https://override:6443", endpoint)
+
+	endpoint, err = discoverAPIEndpoint(nil, cluster, "")
+	require.NoError(t, err)
+	assert.Equal(t, "https://10.0.0.1:6443", endpoint)
+
+	_, err = discoverAPIEndpoint(nil, &clusterapiv1alpha2.Cluster{}, "")
+	assert.Error(t, err)
+}
@@ -4,8 +4,8 @@
 package upgrade
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"time"
 
 	"github.com/blang/semver"
@@ -14,27 +14,47 @@ import (
 	kubernetes2 "github.com/vmware/cluster-api-upgrade-tool/pkg/internal/kubernetes"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
-	clusterapiv1alpha2client "sigs.k8s.io/cluster-api/cmd/clusterctl/clusterdeployer/clusterclient"
-	"sigs.k8s.io/cluster-api/controllers/noderefutil"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
 	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type base struct {
-	log                        logr.Logger
-	userVersion                semver.Version
-	desiredVersion             semver.Version
-	clusterNamespace           string
-	clusterName                string
-	managementClusterAPIClient clusterapiv1alpha2client.Client
-	ctrlClient                 ctrlclient.Client
-	targetRestConfig           *rest.Config
-	targetKubernetesClient     kubernetes.Interface
-	providerIDsToNodes         map[string]*v1.Node
-	imageField, imageID        string
-	upgradeID                  string
-	machineGetter              machineGetter
+	log                             logr.Logger
+	userVersion                     semver.Version
+	desiredVersion                  semver.Version
+	clusterNamespace                string
+	clusterName                     string
+	ctrlClient                      ctrlclient.Client
+	managementKubernetesClient      kubernetes.Interface
+	targetRestConfig                *rest.Config
+	targetKubernetesClient          kubernetes.Interface
+	clientCertificate               ClientCertificate
+	providerIDsToNodes              map[string]*v1.Node
+	imageField, imageID             string
+	infrastructureImageField        string
+	machineClass                    string
+	bootstrapConfigPatch            []byte
+	fieldUpdates                    []FieldUpdate
+	upgradeID                       string
+	machineGetter                   machineGetter
+	machineNamer                    MachineNamer
+	cleanupOnFailure                bool
+	machineDeletionTimeout          time.Duration
+	machineDeploymentRolloutTimeout time.Duration
+	nodeDrainTimeout                time.Duration
+	maxConcurrentMachineDeployments int
+	rollingUpdate                   *clusterapiv1alpha2.MachineRollingUpdateDeployment
+	machineDeploymentSelector       string
+	machineDeploymentNames          []string
+	canary                          CanaryConfig
+	drain                           bool
+	cleanupKubeletConfig            bool
+	ignoreVersionSkew               bool
+	skipRBACPreflight               bool
 }
 
 func newBase(log logr.Logger, config Config) (*base, error) {
@@ -56,26 +76,20 @@ func newBase(log logr.Logger, config Config) (*base, error) {
 	}
 
 	log.Info("Creating controller runtime client")
-	ctrlRuntimeClient, err := ctrlclient.New(managementRestConfig, ctrlclient.Options{}) // @TODO use NewCached() from cluster-api?
+	scheme, err := newManagementScheme()
 	if err != nil {
-		return nil, errors.Wrap(err, "error creating controller runtime client")
-	}
-
-	log.Info("Creating management cluster api client")
-	kubeconfig, err := ioutil.ReadFile(config.ManagementCluster.Kubeconfig)
-	if err != nil {
-		return nil, errors.Wrap(err, "error creating management cluster api client")
+		return nil, err
 	}
-	managementClusterAPIClient, err := clusterapiv1alpha2client.New(string(kubeconfig))
+	ctrlRuntimeClient, err := ctrlclient.New(managementRestConfig, ctrlclient.Options{Scheme: scheme}) // @TODO use NewCached() from cluster-api?
 	if err != nil {
-		log.Info("HIT HIT HIT", "KUBECONFIG", config.ManagementCluster.Kubeconfig)
-		return nil, errors.Wrap(err, "error creating management cluster api client")
+		return nil, errors.Wrap(err, "error creating controller runtime client")
 	}
 
 	log.Info("Retrieving cluster from management cluster", "cluster-namespace", config.TargetCluster.Namespace, "cluster-name", config.TargetCluster.Name)
-	cluster, err := managementClusterAPIClient.GetCluster(config.TargetCluster.Name, config.TargetCluster.Namespace)
-	if err != nil {
-		return nil, errors.WithStack(err)
+	cluster := &clusterapiv1alpha2.Cluster{}
+	clusterKey := ctrlclient.ObjectKey{Namespace: config.TargetCluster.Namespace, Name: config.TargetCluster.Name}
+	if err := ctrlRuntimeClient.Get(context.TODO(), clusterKey, cluster); err != nil {
+		return nil, errors.Wrapf(err, "error getting cluster %s/%s", config.TargetCluster.Namespace, config.TargetCluster.Name)
 	}
 
 	log.Info("Creating management kubernetes client")
@@ -84,23 +98,28 @@ func newBase(log logr.Logger, config Config) (*base, error) {
 		return nil, errors.Wrap(err, "error creating management kubernetes client")
 	}
 
-	var targetRestConfig *rest.Config
-	secretClient := managementKubernetesClient.CoreV1().Secrets(cluster.GetNamespace())
-	// CAKeyPair should have been validated, but if not this is defining an order for us
-	if config.TargetCluster.CAKeyPair.KubeconfigSecretRef != "" {
-		targetRestConfig, err = NewRestConfigFromKubeconfigSecretRef(secretClient, config.TargetCluster.CAKeyPair.KubeconfigSecretRef)
-	} else if config.TargetCluster.CAKeyPair.SecretRef != "" {
-		targetRestConfig, err = NewRestConfigFromCASecretRef(secretClient, config.TargetCluster.CAKeyPair.SecretRef, cluster.GetName(), config.TargetCluster.CAKeyPair.APIEndpoint)
-	} else if config.TargetCluster.CAKeyPair.ClusterField != "" {
-		targetRestConfig, err = NewRestConfigFromCAClusterField(cluster, config.TargetCluster.CAKeyPair.ClusterField, config.TargetCluster.CAKeyPair.APIEndpoint)
+	if config.UpgradeID == "" {
+		config.UpgradeID = fmt.Sprintf("%d", time.Now().Unix())
 	}
 
-	if err != nil {
-		return nil, err
+	if config.TargetCluster.CAKeyPair.ClientCertificateTTL == 0 {
+		config.TargetCluster.CAKeyPair.ClientCertificateTTL = DefaultClientCertificateTTL
+	}
+
+	if len(config.TargetCluster.CAKeyPair.ClientCertificateGroups) == 0 {
+		config.TargetCluster.CAKeyPair.ClientCertificateGroups = DefaultClientCertificateGroups
+	}
+
+	clientCertificate := ClientCertificate{
+		User:   ClientCertificateUserPrefix + config.UpgradeID,
+		Groups: config.TargetCluster.CAKeyPair.ClientCertificateGroups,
+		TTL:    config.TargetCluster.CAKeyPair.ClientCertificateTTL,
 	}
 
-	if targetRestConfig == nil {
-		return nil, errors.New("could not get a kubeconfig for your target cluster")
+	secretClient := managementKubernetesClient.CoreV1().Secrets(cluster.GetNamespace())
+	targetRestConfig, err := newTargetRestConfig(log, ctrlRuntimeClient, secretClient, cluster, config.TargetCluster.CAKeyPair, clientCertificate)
+	if err != nil {
+		return nil, err
 	}
 
 	log.Info("Creating target kubernetes client")
@@ -109,30 +128,105 @@ func newBase(log logr.Logger, config Config) (*base, error) {
 		return nil, errors.Wrap(err, "error creating target cluster client")
 	}
 
-	if config.UpgradeID == "" {
-		config.UpgradeID = fmt.Sprintf("%d", time.Now().Unix())
+	if err := probeHealthz(targetKubernetesClient, targetRestConfig.Host); err != nil {
+		return nil, err
+	}
+
+	if config.Timeouts.MachineDeletion == 0 {
+		config.Timeouts.MachineDeletion = DefaultMachineDeletionTimeout
+	}
+
+	if config.Timeouts.MachineDeploymentRollout == 0 {
+		config.Timeouts.MachineDeploymentRollout = DefaultMachineDeploymentRolloutTimeout
+	}
+
+	if config.Timeouts.NodeDrain == 0 {
+		config.Timeouts.NodeDrain = DefaultNodeDrainTimeout
+	}
+
+	if config.MachineDeployments.MaxConcurrent == 0 {
+		config.MachineDeployments.MaxConcurrent = DefaultMaxConcurrentMachineDeployments
+	}
+
+	rollingUpdate, err := parseRollingUpdate(config.MachineDeployments.MaxSurge, config.MachineDeployments.MaxUnavailable)
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := resolveImage(config)
+	if err != nil {
+		return nil, err
+	}
+	if image.ID != "" && image.ID != config.MachineUpdates.Image.ID {
+		log.Info("Using image from the catalog", "id", image.ID, "field", image.Field, "infrastructureField", image.InfrastructureField)
+	}
+
+	bootstrapConfigPatch, err := loadBootstrapConfigPatch(config.MachineUpdates.BootstrapConfigPatchFile)
+	if err != nil {
+		return nil, err
+	}
+
+	fieldUpdates, err := loadFieldUpdates(config.MachineUpdates)
+	if err != nil {
+		return nil, err
+	}
+
+	machineNamer, err := NewMachineNamer(config.MachineUpdates.NameTemplate, config.UpgradeID)
+	if err != nil {
+		return nil, err
 	}
 
 	infoMessage := fmt.Sprintf("Rerun with `--upgrade-id=%s` if this upgrade fails midway and you want to retry", config.UpgradeID)
 	log.Info(infoMessage)
 
 	return &base{
-		log:                        log,
-		userVersion:                userVersion,
-		desiredVersion:             desiredVersion,
-		clusterNamespace:           config.TargetCluster.Namespace,
-		clusterName:                config.TargetCluster.Name,
-		managementClusterAPIClient: managementClusterAPIClient,
-		ctrlClient:                 ctrlRuntimeClient,
-		targetRestConfig:           targetRestConfig,
-		targetKubernetesClient:     targetKubernetesClient,
-		imageField:                 config.MachineUpdates.Image.Field,
-		imageID:                    config.MachineUpdates.Image.ID,
-		upgradeID:                  config.UpgradeID,
-		machineGetter:              &GetMachine{ctrlRuntimeClient},
+		log:                             log,
+		userVersion:                     userVersion,
+		desiredVersion:                  desiredVersion,
+		clusterNamespace:                config.TargetCluster.Namespace,
+		clusterName:                     config.TargetCluster.Name,
+		ctrlClient:                      ctrlRuntimeClient,
+		managementKubernetesClient:      managementKubernetesClient,
+		targetRestConfig:                targetRestConfig,
+		targetKubernetesClient:          targetKubernetesClient,
+		clientCertificate:               clientCertificate,
+		imageField:                      image.Field,
+		imageID:                         image.ID,
+		infrastructureImageField:        image.InfrastructureField,
+		machineClass:                    config.MachineUpdates.MachineClass,
+		bootstrapConfigPatch:            bootstrapConfigPatch,
+		fieldUpdates:                    fieldUpdates,
+		upgradeID:                       config.UpgradeID,
+		machineGetter:                   &GetMachine{ctrlRuntimeClient},
+		machineNamer:                    machineNamer,
+		cleanupOnFailure:                config.CleanupOnFailure,
+		machineDeletionTimeout:          config.Timeouts.MachineDeletion,
+		machineDeploymentRolloutTimeout: config.Timeouts.MachineDeploymentRollout,
+		nodeDrainTimeout:                config.Timeouts.NodeDrain,
+		maxConcurrentMachineDeployments: config.MachineDeployments.MaxConcurrent,
+		rollingUpdate:                   rollingUpdate,
+		machineDeploymentSelector:       config.MachineDeployments.Selector,
+		machineDeploymentNames:          config.MachineDeployments.Names,
+		canary:                          config.MachineDeployments.Canary,
+		drain:                           config.MachineDeployments.Drain,
+		cleanupKubeletConfig:            config.CleanupKubeletConfig,
+		ignoreVersionSkew:               config.IgnoreVersionSkew,
+		skipRBACPreflight:               config.SkipRBACPreflight,
 	}, nil
 }
 
+// newManagementScheme returns a scheme with the Kubernetes and Cluster API types the management cluster clients use.
+func newManagementScheme() (*runtime.Scheme, error) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return nil, errors.Wrap(err, "error adding kubernetes types to the scheme")
+	}
+	if err := clusterapiv1alpha2.AddToScheme(scheme); err != nil {
+		return nil, errors.Wrap(err, "error adding cluster api types to the scheme")
+	}
+	return scheme, nil
+}
+
 func (u *base) GetNodeFromProviderID(providerID string) *v1.Node {
 	node, ok := u.providerIDsToNodes[providerID]
 	if ok {
@@ -141,6 +235,21 @@ func (u *base) GetNodeFromProviderID(providerID string) *v1.Node {
 	return nil
 }
 
+// nodeForMachine returns the node of machine, matched on the instance ID of its provider ID.
+func (u *base) nodeForMachine(machine *clusterapiv1alpha2.Machine) (*v1.Node, error) {
+	instanceID, err := providerForKind(machine.Spec.InfrastructureRef.Kind).InstanceID(*machine.Spec.ProviderID)
+	if err != nil {
+		return nil, err
+	}
+
+	node := u.GetNodeFromProviderID(instanceID)
+	if node == nil {
+		u.log.Info("Couldn't retrieve oldNode", "namespace", machine.Namespace, "name", machine.Name, "id", *machine.Spec.ProviderID)
+		return nil, fmt.Errorf("unknown previous node %q", *machine.Spec.ProviderID)
+	}
+	return node, nil
+}
+
 // UpdateProviderIDsToNodes retrieves a map that pairs a providerID to the node by listing all Nodes
 // providerID : Node
 func (u *base) UpdateProviderIDsToNodes() error {
@@ -153,11 +262,9 @@ func (u *base) UpdateProviderIDsToNodes() error {
 	pairs := make(map[string]*v1.Node)
 	for i := range nodes.Items {
 		node := nodes.Items[i]
-		id := ""
-		providerID, err := noderefutil.NewProviderID(node.Spec.ProviderID)
-		if err == nil {
-			id = providerID.ID()
-		} else {
+		// Nodes don't say which infrastructure kind they run on, so their provider IDs are parsed generically
+		id, err := genericProvider{}.InstanceID(node.Spec.ProviderID)
+		if err != nil {
 			u.log.Error(err, "failed to parse provider id", "id", node.Spec.ProviderID)
 			// unable to parse provider ID with whitelist of provider ID formats. Use original provider ID
 			id = node.Spec.ProviderID
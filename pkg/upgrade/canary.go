@@ -0,0 +1,256 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+// upgradeCanary upgrades the canary machine deployment and checks that its nodes and the selected workloads are
+// healthy. If they aren't, the canary is optionally rolled back and an error is returned.
+func (u *MachineDeploymentUpgrader) upgradeCanary(canary *clusterapiv1alpha2.MachineDeployment) error {
+	log := u.log.WithValues("namespace", canary.Namespace, "name", canary.Name)
+	log.Info("Upgrading canary MachineDeployment")
+
+	original := canary.DeepCopy()
+
+	before, err := u.listCanaryWorkloadPods()
+	if err != nil {
+		return err
+	}
+	baseline := restartCounts(before)
+
+	if err := u.upgradeMachineDeployment(canary); err != nil {
+		return u.failCanary(original, err)
+	}
+
+	if err := u.waitForCanaryHealth(canary, baseline, u.machineDeploymentRolloutTimeout); err != nil {
+		return u.failCanary(original, err)
+	}
+
+	log.Info("Canary MachineDeployment passed its health gates")
+	return nil
+}
+
+// waitForCanaryHealth waits for the canary to pass its health gates. A restart fails the canary right away, nodes and
+// workloads get until timeout to become healthy.
+func (u *MachineDeploymentUpgrader) waitForCanaryHealth(canary *clusterapiv1alpha2.MachineDeployment, baseline map[string]int32, timeout time.Duration) error {
+	log := u.log.WithValues("namespace", canary.Namespace, "name", canary.Name)
+
+	var pending []string
+	err := wait.PollImmediate(10*time.Second, timeout, func() (bool, error) {
+		restarted, err := u.canaryRestarts(canary, baseline)
+		if err != nil {
+			return false, err
+		}
+		if len(restarted) > 0 {
+			return false, errors.Errorf("health gates failed: pods restarted: %s", strings.Join(restarted, ", "))
+		}
+
+		pending, err = u.canaryPending(canary)
+		if err != nil {
+			return false, err
+		}
+		if len(pending) == 0 {
+			return true, nil
+		}
+		log.Info("Canary health gates not passed yet", "pending", strings.Join(pending, "; "))
+		return false, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		err = errors.Errorf("health gates failed: %s", strings.Join(pending, "; "))
+	}
+	return err
+}
+
+// failCanary rolls the canary back to its original template, if configured to, and returns the canary's error. With
+// --drain the rollback replaces the upgraded machines the same way the upgrade did. If the rollback doesn't roll out
+// either, its error is returned along with the canary's.
+func (u *MachineDeploymentUpgrader) failCanary(original *clusterapiv1alpha2.MachineDeployment, canaryErr error) error {
+	canaryErr = errors.Wrapf(canaryErr, "canary machinedeployment %s/%s failed, not upgrading the other machine deployments", original.Namespace, original.Name)
+	if !u.canary.Rollback {
+		return canaryErr
+	}
+
+	u.log.Info("Rolling back canary MachineDeployment", "namespace", original.Namespace, "name", original.Name)
+
+	if err := u.rollBackCanary(original); err != nil {
+		return kerrors.NewAggregate([]error{canaryErr, errors.Wrap(err, "error rolling back canary")})
+	}
+
+	return canaryErr
+}
+
+func (u *MachineDeploymentUpgrader) rollBackCanary(original *clusterapiv1alpha2.MachineDeployment) error {
+	err := u.patchMachineDeployment(original, func(current *clusterapiv1alpha2.MachineDeployment) error {
+		current.Spec.Template = original.Spec.Template
+		if !u.drain {
+			current.Spec.Paused = false
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if u.drain {
+		if err := u.drainMachineDeployment(original, u.upgradedMachine); err != nil {
+			return err
+		}
+		if err := u.restoreMachineDeploymentStrategy(original); err != nil {
+			return err
+		}
+	}
+
+	if original.Spec.Template.Spec.Version == nil {
+		return nil
+	}
+	version, err := semver.ParseTolerant(*original.Spec.Template.Spec.Version)
+	if err != nil {
+		return errors.Wrapf(err, "invalid version %q of canary", *original.Spec.Template.Spec.Version)
+	}
+	return u.waitForRollout(original, version, u.machineDeploymentRolloutTimeout)
+}
+
+// canaryPending returns the health gates the canary hasn't passed yet: nodes that aren't Ready and selected workloads
+// that aren't available.
+func (u *MachineDeploymentUpgrader) canaryPending(canary *clusterapiv1alpha2.MachineDeployment) ([]string, error) {
+	var pending []string
+
+	nodes, err := u.machineDeploymentNodes(canary)
+	if err != nil {
+		return nil, err
+	}
+	if notReady := notReadyNodes(nodes); len(notReady) > 0 {
+		pending = append(pending, fmt.Sprintf("nodes not ready: %s", strings.Join(notReady, ", ")))
+	}
+
+	if u.canary.WorkloadSelector != "" {
+		deployments, err := u.targetKubernetesClient.AppsV1().Deployments(metav1.NamespaceAll).List(metav1.ListOptions{LabelSelector: u.canary.WorkloadSelector})
+		if err != nil {
+			return nil, errors.Wrap(err, "error listing canary workloads")
+		}
+		if unavailable := unavailableDeployments(deployments.Items); len(unavailable) > 0 {
+			pending = append(pending, fmt.Sprintf("workloads not available: %s", strings.Join(unavailable, ", ")))
+		}
+	}
+
+	return pending, nil
+}
+
+// canaryRestarts returns the selected workload pods and the pods on the canary's nodes that restarted more often than
+// in baseline.
+func (u *MachineDeploymentUpgrader) canaryRestarts(canary *clusterapiv1alpha2.MachineDeployment, baseline map[string]int32) ([]string, error) {
+	nodes, err := u.machineDeploymentNodes(canary)
+	if err != nil {
+		return nil, err
+	}
+
+	pods, err := u.listCanaryWorkloadPods()
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range nodes {
+		list, err := u.targetKubernetesClient.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{
+			FieldSelector: fields.OneTermEqualSelector("spec.nodeName", node.Name).String(),
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "error listing pods on node %s", node.Name)
+		}
+		// DaemonSet pods come up with the node and may restart until it has settled
+		for _, pod := range list.Items {
+			if !ownedByDaemonSet(&pod) {
+				pods = append(pods, pod)
+			}
+		}
+	}
+
+	return increasedRestarts(baseline, pods), nil
+}
+
+// listCanaryWorkloadPods returns the pods of the workloads selected to gate the canary.
+func (u *MachineDeploymentUpgrader) listCanaryWorkloadPods() ([]v1.Pod, error) {
+	if u.canary.WorkloadSelector == "" {
+		return nil, nil
+	}
+
+	pods, err := u.targetKubernetesClient.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{LabelSelector: u.canary.WorkloadSelector})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing canary workload pods")
+	}
+	return pods.Items, nil
+}
+
+// restartCounts returns the total container restarts of each pod, keyed by namespace/name.
+func restartCounts(pods []v1.Pod) map[string]int32 {
+	counts := make(map[string]int32, len(pods))
+	for _, pod := range pods {
+		var restarts int32
+		for _, status := range pod.Status.ContainerStatuses {
+			restarts += status.RestartCount
+		}
+		counts[pod.Namespace+"/"+pod.Name] = restarts
+	}
+	return counts
+}
+
+// increasedRestarts returns the pods that restarted more often than in baseline. Pods missing from baseline are
+// expected not to have restarted at all.
+func increasedRestarts(baseline map[string]int32, pods []v1.Pod) []string {
+	var restarted []string
+	for key, restarts := range restartCounts(pods) {
+		if restarts > baseline[key] {
+			restarted = append(restarted, fmt.Sprintf("%s (%d restarts)", key, restarts))
+		}
+	}
+	sort.Strings(restarted)
+	return restarted
+}
+
+// notReadyNodes returns the names of the nodes whose Ready condition isn't true.
+func notReadyNodes(nodes []v1.Node) []string {
+	var notReady []string
+	for _, node := range nodes {
+		ready := false
+		for _, condition := range node.Status.Conditions {
+			if condition.Type == v1.NodeReady && condition.Status == v1.ConditionTrue {
+				ready = true
+				break
+			}
+		}
+		if !ready {
+			notReady = append(notReady, node.Name)
+		}
+	}
+	return notReady
+}
+
+// unavailableDeployments returns the deployments that haven't rolled out or don't have all replicas available.
+func unavailableDeployments(deployments []appsv1.Deployment) []string {
+	var unavailable []string
+	for _, deployment := range deployments {
+		replicas := int32(1)
+		if deployment.Spec.Replicas != nil {
+			replicas = *deployment.Spec.Replicas
+		}
+		if deployment.Status.ObservedGeneration < deployment.Generation || deployment.Status.AvailableReplicas < replicas {
+			unavailable = append(unavailable, fmt.Sprintf("%s/%s (%d/%d available)",
+				deployment.Namespace, deployment.Name, deployment.Status.AvailableReplicas, replicas))
+		}
+	}
+	return unavailable
+}
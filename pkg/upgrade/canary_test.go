@@ -0,0 +1,285 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func pod(namespace, name string, restarts ...int32) v1.Pod {
+	p := v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+	for _, r := range restarts {
+		p.Status.ContainerStatuses = append(p.Status.ContainerStatuses, v1.ContainerStatus{RestartCount: r})
+	}
+	return p
+}
+
+func TestIncreasedRestarts(t *testing.T) {
+	baseline := restartCounts([]v1.Pod{
+		pod("default", "stable", 2, 1),
+		pod("default", "flaky", 0),
+	})
+
+	pods := []v1.Pod{
+		pod("default", "stable", 2, 1),
+		pod("default", "flaky", 1),
+		pod("default", "new-healthy", 0),
+		pod("default", "new-crashing", 0, 3),
+	}
+
+	assert.Equal(t, []string{"default/flaky (1 restarts)", "default/new-crashing (3 restarts)"}, increasedRestarts(baseline, pods))
+}
+
+func TestNotReadyNodes(t *testing.T) {
+	ready := *node("ready", "v1.15.3")
+	ready.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	notReady := *node("not-ready", "v1.15.3")
+	notReady.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionFalse}}
+	unknown := *node("unknown", "v1.15.3")
+
+	assert.Equal(t, []string{"not-ready", "unknown"}, notReadyNodes([]v1.Node{ready, notReady, unknown}))
+}
+
+func TestUnavailableDeployments(t *testing.T) {
+	three := int32(3)
+	deployment := func(name string, generation, observedGeneration int64, available int32) appsv1.Deployment {
+		return appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: name, Generation: generation},
+			Spec:       appsv1.DeploymentSpec{Replicas: &three},
+			Status:     appsv1.DeploymentStatus{ObservedGeneration: observedGeneration, AvailableReplicas: available},
+		}
+	}
+
+	deployments := []appsv1.Deployment{
+		deployment("available", 2, 2, 3),
+		deployment("degraded", 2, 2, 2),
+		deployment("not-observed", 3, 2, 3),
+	}
+
+	assert.Equal(t, []string{"apps/degraded (2/3 available)", "apps/not-observed (3/3 available)"}, unavailableDeployments(deployments))
+}
+
+// patchRecorder records the patches sent through it. The fake client can't apply a merge patch that removes a field.
+type patchRecorder struct {
+	ctrlclient.Client
+	patches []string
+}
+
+func (c *patchRecorder) Patch(ctx context.Context, obj runtime.Object, patch ctrlclient.Patch, opts ...ctrlclient.PatchOption) error {
+	data, err := patch.Data(obj)
+	if err != nil {
+		return err
+	}
+	c.patches = append(c.patches, string(data))
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func TestFailCanaryRollback(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clusterapiv1alpha2.AddToScheme(scheme))
+
+	oldVersion, newVersion := "v1.14.6", "v1.15.3"
+	original := machineDeployment(1, clusterapiv1alpha2.MachineDeploymentStatus{ObservedGeneration: 2, Replicas: 1, UpdatedReplicas: 1, ReadyReplicas: 1})
+	original.Spec.Template.Spec.Version = &oldVersion
+	upgraded := original.DeepCopy()
+	upgraded.Spec.Paused = true
+	upgraded.Spec.Template.Spec.Version = &newVersion
+	machine := &clusterapiv1alpha2.Machine{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "md-machine", Labels: map[string]string{"pool": "md"}},
+		Status:     clusterapiv1alpha2.MachineStatus{NodeRef: &v1.ObjectReference{Name: "md-node"}},
+	}
+
+	testcases := []struct {
+		name           string
+		kubeletVersion string
+		expectedErrors []string
+	}{
+		{
+			name:           "rolled back",
+			kubeletVersion: oldVersion,
+			expectedErrors: []string{"canary machinedeployment default/md failed, not upgrading the other machine deployments: health gates failed"},
+		},
+		{
+			name:           "rollback doesn't roll out",
+			kubeletVersion: newVersion,
+			expectedErrors: []string{"health gates failed", "error rolling back canary: timed out"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &patchRecorder{Client: fake.NewFakeClientWithScheme(scheme, upgraded.DeepCopy(), machine.DeepCopy())}
+			u := &MachineDeploymentUpgrader{
+				base: &base{
+					log:                             testLogger(),
+					canary:                          CanaryConfig{Rollback: true},
+					machineDeploymentRolloutTimeout: time.Millisecond,
+					ctrlClient:                      client,
+					targetKubernetesClient:          kubefake.NewSimpleClientset(node("md-node", tc.kubeletVersion)),
+				},
+			}
+
+			err := u.failCanary(original, errors.New("health gates failed"))
+			require.Error(t, err)
+			for _, expected := range tc.expectedErrors {
+				assert.Contains(t, err.Error(), expected)
+			}
+
+			// the template and the pause are rolled back in the same patch
+			require.Len(t, client.patches, 1)
+			assert.Contains(t, client.patches[0], `"paused":null`)
+			assert.Contains(t, client.patches[0], `"version":"v1.14.6"`)
+		})
+	}
+}
+
+func TestCanaryRestartsIgnoresDaemonSetPods(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clusterapiv1alpha2.AddToScheme(scheme))
+
+	canary := machineDeployment(1, clusterapiv1alpha2.MachineDeploymentStatus{})
+	machine := &clusterapiv1alpha2.Machine{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "md-machine", Labels: map[string]string{"pool": "md"}},
+		Status:     clusterapiv1alpha2.MachineStatus{NodeRef: &v1.ObjectReference{Name: "md-node"}},
+	}
+	ready := node("md-node", "v1.15.3")
+	ready.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+
+	controller := true
+	daemonSetPod := pod("kube-system", "calico-node", 2)
+	daemonSetPod.OwnerReferences = []metav1.OwnerReference{{Kind: "DaemonSet", Name: "calico-node", Controller: &controller}}
+	daemonSetPod.Spec.NodeName = "md-node"
+	crashingPod := pod("default", "web", 1)
+	crashingPod.Spec.NodeName = "md-node"
+
+	u := &MachineDeploymentUpgrader{
+		base: &base{
+			log:                    testLogger(),
+			ctrlClient:             fake.NewFakeClientWithScheme(scheme, canary, machine),
+			targetKubernetesClient: kubefake.NewSimpleClientset(ready, &daemonSetPod, &crashingPod),
+		},
+	}
+
+	restarted, err := u.canaryRestarts(canary, map[string]int32{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"default/web (1 restarts)"}, restarted)
+}
+
+func TestWaitForCanaryHealth(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clusterapiv1alpha2.AddToScheme(scheme))
+
+	canary := machineDeployment(1, clusterapiv1alpha2.MachineDeploymentStatus{})
+	machine := &clusterapiv1alpha2.Machine{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "md-machine", Labels: map[string]string{"pool": "md"}},
+		Status:     clusterapiv1alpha2.MachineStatus{NodeRef: &v1.ObjectReference{Name: "md-node"}},
+	}
+	crashingPod := pod("default", "web", 1)
+	crashingPod.Spec.NodeName = "md-node"
+
+	testcases := []struct {
+		name          string
+		objects       []runtime.Object
+		timeout       time.Duration
+		expectedError string
+	}{
+		{
+			name:          "restarts fail the canary before the timeout",
+			objects:       []runtime.Object{node("md-node", "v1.15.3"), &crashingPod},
+			timeout:       time.Hour,
+			expectedError: "health gates failed: pods restarted: default/web (1 restarts)",
+		},
+		{
+			name:          "nodes get until the timeout to become ready",
+			objects:       []runtime.Object{node("md-node", "v1.15.3")},
+			timeout:       time.Millisecond,
+			expectedError: "health gates failed: nodes not ready: md-node",
+		},
+		{
+			name:    "healthy",
+			objects: []runtime.Object{readyNode("md-node")},
+			timeout: time.Millisecond,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			u := &MachineDeploymentUpgrader{
+				base: &base{
+					log:                    testLogger(),
+					ctrlClient:             fake.NewFakeClientWithScheme(scheme, canary.DeepCopy(), machine.DeepCopy()),
+					targetKubernetesClient: kubefake.NewSimpleClientset(tc.objects...),
+				},
+			}
+
+			err := u.waitForCanaryHealth(canary, map[string]int32{}, tc.timeout)
+			if tc.expectedError == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Equal(t, tc.expectedError, err.Error())
+		})
+	}
+}
+
+func TestFailCanaryRollbackDrains(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clusterapiv1alpha2.AddToScheme(scheme))
+
+	oldVersion, newVersion := "v1.14.6", "v1.15.3"
+	original := machineDeployment(1, clusterapiv1alpha2.MachineDeploymentStatus{ObservedGeneration: 2, Replicas: 1, UpdatedReplicas: 1, ReadyReplicas: 1})
+	original.Spec.Template.Spec.Version = &oldVersion
+	upgraded := original.DeepCopy()
+	upgraded.Spec.Paused = true
+	upgraded.Spec.Template.Spec.Version = &newVersion
+	upgradedNode := readyNode("md-upgraded")
+	upgradedNode.Status.NodeInfo.KubeletVersion = newVersion
+
+	target := kubefake.NewSimpleClientset(upgradedNode)
+	controller := &machineDeploymentController{
+		Client:         fake.NewFakeClientWithScheme(scheme, upgraded, drainMachine("md-upgraded", "42")),
+		target:         target,
+		kubeletVersion: oldVersion,
+	}
+	controller.recordCordons(target)
+
+	u := &MachineDeploymentUpgrader{
+		base: &base{
+			log:                             testLogger(),
+			upgradeID:                       "42",
+			drain:                           true,
+			canary:                          CanaryConfig{Rollback: true},
+			machineDeletionTimeout:          time.Millisecond,
+			machineDeploymentRolloutTimeout: time.Millisecond,
+			nodeDrainTimeout:                time.Millisecond,
+			ctrlClient:                      controller,
+			targetKubernetesClient:          target,
+		},
+	}
+
+	err := u.failCanary(original, errors.New("health gates failed"))
+	require.Error(t, err)
+	assert.Equal(t, "canary machinedeployment default/md failed, not upgrading the other machine deployments: health gates failed", err.Error())
+
+	// The template is rolled back without resuming the canary, and the upgraded machine is drained only after the
+	// rolled back machine is ready, like during the upgrade. The original strategy is restored at the end.
+	assert.Equal(t, []string{
+		"patch", "resume", "pause", "cordon md-upgraded", "mark md-upgraded", "resume", "resume", "patch",
+	}, controller.operations)
+}
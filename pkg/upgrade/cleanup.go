@@ -0,0 +1,227 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	kubernetes2 "github.com/vmware/cluster-api-upgrade-tool/pkg/internal/kubernetes"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// UpgradeIDLabelKey is the label key set on every object this tool creates. Its value is the upgrade ID.
+const UpgradeIDLabelKey = "cluster-api-upgrade-tool/upgrade-id"
+
+// Cleaner deletes the objects an upgrade created but never finished with, such as infrastructure and bootstrap
+// clones whose Machine was never created and Machines that never got a Node.
+type Cleaner struct {
+	log              logr.Logger
+	ctrlClient       ctrlclient.Client
+	clusterNamespace string
+	clusterName      string
+	upgradeID        string
+	dryRun           bool
+}
+
+// NewCleaner returns a Cleaner for the upgrade identified by config.UpgradeID.
+func NewCleaner(log logr.Logger, config Config) (*Cleaner, error) {
+	if config.UpgradeID == "" {
+		return nil, errors.New("an upgrade ID is required to clean up after an upgrade")
+	}
+	if err := validateUpgradeID(config.UpgradeID); err != nil {
+		return nil, err
+	}
+
+	managementRestConfig, err := kubernetes2.NewRestConfig(config.ManagementCluster.Kubeconfig, config.ManagementCluster.Context)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme, err := newManagementScheme()
+	if err != nil {
+		return nil, err
+	}
+
+	ctrlRuntimeClient, err := ctrlclient.New(managementRestConfig, ctrlclient.Options{Scheme: scheme})
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating controller runtime client")
+	}
+
+	return &Cleaner{
+		log:              log,
+		ctrlClient:       ctrlRuntimeClient,
+		clusterNamespace: config.TargetCluster.Namespace,
+		clusterName:      config.TargetCluster.Name,
+		upgradeID:        config.UpgradeID,
+		dryRun:           config.DryRun,
+	}, nil
+}
+
+// cleaner returns a Cleaner that shares this upgrader's clients.
+func (u *base) cleaner() *Cleaner {
+	return &Cleaner{
+		log:              u.log.WithName("cleanup"),
+		ctrlClient:       u.ctrlClient,
+		clusterNamespace: u.clusterNamespace,
+		clusterName:      u.clusterName,
+		upgradeID:        u.upgradeID,
+	}
+}
+
+// Cleanup logs every object it is going to remove and then deletes them, unless the Cleaner is in dry run mode.
+func (c *Cleaner) Cleanup() error {
+	machines, objects, err := c.plan()
+	if err != nil {
+		return err
+	}
+
+	if len(machines) == 0 && len(objects) == 0 {
+		c.log.Info("Nothing to clean up", "upgrade-id", c.upgradeID)
+		return nil
+	}
+
+	for _, machine := range machines {
+		c.log.Info("Will delete machine", "namespace", machine.Namespace, "name", machine.Name)
+	}
+	for _, object := range objects {
+		c.log.Info("Will delete object", "kind", object.GetKind(), "namespace", object.GetNamespace(), "name", object.GetName())
+	}
+
+	if c.dryRun {
+		c.log.Info("Dry run, not deleting anything")
+		return nil
+	}
+
+	for _, machine := range machines {
+		if err := c.ctrlClient.Delete(context.TODO(), machine); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "error deleting machine %s/%s", machine.Namespace, machine.Name)
+		}
+	}
+	for _, object := range objects {
+		if err := c.ctrlClient.Delete(context.TODO(), object); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "error deleting %s %s/%s", object.GetKind(), object.GetNamespace(), object.GetName())
+		}
+	}
+
+	return nil
+}
+
+// plan returns the machines and the infrastructure and bootstrap objects created by the upgrade that were never
+// completed. Machines whose node has already joined the cluster are left alone, because removing them could break
+// the control plane; the upgrade has to be resumed instead.
+func (c *Cleaner) plan() ([]*clusterapiv1alpha2.Machine, []*unstructured.Unstructured, error) {
+	machines := &clusterapiv1alpha2.MachineList{}
+	err := c.ctrlClient.List(context.TODO(), machines,
+		ctrlclient.InNamespace(c.clusterNamespace),
+		ctrlclient.MatchingLabels{clusterapiv1alpha2.MachineClusterLabelName: c.clusterName},
+	)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error listing machines")
+	}
+
+	// Template clones of machine deployments are not referenced by any machine until they are rolled out
+	machineDeployments := &clusterapiv1alpha2.MachineDeploymentList{}
+	if err := c.ctrlClient.List(context.TODO(), machineDeployments, ctrlclient.InNamespace(c.clusterNamespace)); err != nil {
+		return nil, nil, errors.Wrap(err, "error listing machine deployments")
+	}
+	machineSets := &clusterapiv1alpha2.MachineSetList{}
+	if err := c.ctrlClient.List(context.TODO(), machineSets, ctrlclient.InNamespace(c.clusterNamespace)); err != nil {
+		return nil, nil, errors.Wrap(err, "error listing machine sets")
+	}
+
+	var templates []clusterapiv1alpha2.MachineTemplateSpec
+	for _, machineDeployment := range machineDeployments.Items {
+		templates = append(templates, machineDeployment.Spec.Template)
+	}
+	for _, machineSet := range machineSets.Items {
+		templates = append(templates, machineSet.Spec.Template)
+	}
+
+	kinds := make(map[schema.GroupVersionKind]bool)
+	for _, ref := range machineRefs(machines.Items) {
+		kinds[ref.GroupVersionKind()] = true
+	}
+	for _, template := range templates {
+		for _, ref := range templateRefs(template) {
+			kinds[ref.GroupVersionKind()] = true
+		}
+	}
+
+	var objects []unstructured.Unstructured
+	for gvk := range kinds {
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+		err := c.ctrlClient.List(context.TODO(), list,
+			ctrlclient.InNamespace(c.clusterNamespace),
+			ctrlclient.MatchingLabels{UpgradeIDLabelKey: c.upgradeID},
+		)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error listing %s objects", gvk.Kind)
+		}
+		objects = append(objects, list.Items...)
+	}
+
+	orphanMachines, orphanObjects := c.orphans(machines.Items, templates, objects)
+	return orphanMachines, orphanObjects, nil
+}
+
+// orphans returns the machines created by the upgrade that never got a node while the machine they replace is still
+// around, and the objects created by the upgrade that neither a remaining machine nor a machine template refers to.
+func (c *Cleaner) orphans(machines []clusterapiv1alpha2.Machine, templates []clusterapiv1alpha2.MachineTemplateSpec, objects []unstructured.Unstructured) ([]*clusterapiv1alpha2.Machine, []*unstructured.Unstructured) {
+	var orphanMachines []*clusterapiv1alpha2.Machine
+	inUse := sets.NewString()
+
+	names := sets.NewString()
+	for _, machine := range machines {
+		names.Insert(machine.Name)
+	}
+
+	for i := range machines {
+		machine := &machines[i]
+
+		// A replacement is finished once the machine it replaces is gone
+		if machine.Labels[UpgradeIDLabelKey] == c.upgradeID && names.Has(machine.Annotations[ReplacesAnnotationKey]) {
+			if machine.Status.NodeRef == nil {
+				orphanMachines = append(orphanMachines, machine)
+				continue
+			}
+			c.log.Info("Not deleting machine whose node has joined the cluster, rerun the upgrade with the same upgrade ID to finish it",
+				"namespace", machine.Namespace, "name", machine.Name, "node", machine.Status.NodeRef.Name)
+		}
+
+		for _, ref := range templateRefs(clusterapiv1alpha2.MachineTemplateSpec{Spec: machine.Spec}) {
+			inUse.Insert(objectKey(ref.Kind, ref.Name))
+		}
+	}
+	for _, template := range templates {
+		for _, ref := range templateRefs(template) {
+			inUse.Insert(objectKey(ref.Kind, ref.Name))
+		}
+	}
+
+	var orphanObjects []*unstructured.Unstructured
+	for i := range objects {
+		object := &objects[i]
+		if object.GetLabels()[UpgradeIDLabelKey] != c.upgradeID {
+			continue
+		}
+		if !inUse.Has(objectKey(object.GetKind(), object.GetName())) {
+			orphanObjects = append(orphanObjects, object)
+		}
+	}
+
+	return orphanMachines, orphanObjects
+}
+
+func objectKey(kind, name string) string {
+	return fmt.Sprintf("%s/%s", kind, name)
+}
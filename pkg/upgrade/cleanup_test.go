@@ -0,0 +1,124 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/cluster-api-upgrade-tool/pkg/logging"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func testLogger() logr.Logger {
+	l := logrus.New()
+	l.Out = ioutil.Discard
+	return logging.NewLogrusLoggerAdapter(l)
+}
+
+func TestCleanerOrphans(t *testing.T) {
+	infraGVK := schema.GroupVersionKind{Group: "infrastructure.cluster.x-k8s.io", Version: "v1alpha2", Kind: "DockerMachine"}
+
+	machine := func(name string, labels, annotations map[string]string, nodeRef *v1.ObjectReference) clusterapiv1alpha2.Machine {
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[clusterapiv1alpha2.MachineClusterLabelName] = "my-cluster"
+		return clusterapiv1alpha2.Machine{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Name:        name,
+				Labels:      labels,
+				Annotations: annotations,
+			},
+			Spec: clusterapiv1alpha2.MachineSpec{
+				InfrastructureRef: v1.ObjectReference{
+					APIVersion: infraGVK.GroupVersion().String(),
+					Kind:       infraGVK.Kind,
+					Name:       name,
+				},
+			},
+			Status: clusterapiv1alpha2.MachineStatus{
+				NodeRef: nodeRef,
+			},
+		}
+	}
+	infra := func(name string, labels map[string]string) unstructured.Unstructured {
+		u := unstructured.Unstructured{}
+		u.SetGroupVersionKind(infraGVK)
+		u.SetNamespace("default")
+		u.SetName(name)
+		u.SetLabels(labels)
+		return u
+	}
+	upgradeLabels := func() map[string]string {
+		return map[string]string{UpgradeIDLabelKey: "42"}
+	}
+	replacing := func(name string) map[string]string {
+		return map[string]string{UpgradeIDAnnotationKey: "42", ReplacesAnnotationKey: name}
+	}
+
+	machines := []clusterapiv1alpha2.Machine{
+		// untouched machines
+		machine("old", nil, nil, &v1.ObjectReference{Name: "old-node"}),
+		machine("old-1", nil, nil, &v1.ObjectReference{Name: "old-1-node"}),
+		machine("old-2", nil, nil, &v1.ObjectReference{Name: "old-2-node"}),
+		// completed replacement
+		machine("done", upgradeLabels(), replacing("gone"), &v1.ObjectReference{Name: "done-node"}),
+		// replacement that never got a node
+		machine("stuck", upgradeLabels(), replacing("old-1"), nil),
+		// replacement whose node joined, but was never completed
+		machine("joined", upgradeLabels(), replacing("old-2"), &v1.ObjectReference{Name: "joined-node"}),
+	}
+	objects := []unstructured.Unstructured{
+		infra("done", upgradeLabels()),
+		infra("stuck", upgradeLabels()),
+		infra("joined", upgradeLabels()),
+		// clone without a machine
+		infra("orphan", upgradeLabels()),
+		// template clone of a machine deployment
+		infra("template", upgradeLabels()),
+		// clone from another upgrade
+		infra("other", map[string]string{UpgradeIDLabelKey: "41"}),
+	}
+
+	templates := []clusterapiv1alpha2.MachineTemplateSpec{
+		{
+			Spec: clusterapiv1alpha2.MachineSpec{
+				InfrastructureRef: v1.ObjectReference{
+					APIVersion: infraGVK.GroupVersion().String(),
+					Kind:       infraGVK.Kind,
+					Name:       "template",
+				},
+			},
+		},
+	}
+
+	cleaner := &Cleaner{
+		log:              testLogger(),
+		clusterNamespace: "default",
+		clusterName:      "my-cluster",
+		upgradeID:        "42",
+	}
+
+	orphanMachines, orphanObjects := cleaner.orphans(machines, templates, objects)
+
+	var machineNames, objectNames []string
+	for _, m := range orphanMachines {
+		machineNames = append(machineNames, m.Name)
+	}
+	for _, o := range orphanObjects {
+		objectNames = append(objectNames, o.GetName())
+	}
+
+	assert.Equal(t, []string{"stuck"}, machineNames)
+	assert.ElementsMatch(t, []string{"stuck", "orphan"}, objectNames)
+}
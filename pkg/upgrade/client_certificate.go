@@ -0,0 +1,159 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/cluster-api/util/certs"
+)
+
+const (
+	// DefaultClientCertificateTTL is how long each client certificate issued from the target cluster's CA is valid if
+	// no TTL is configured. Certificates are reissued before they expire.
+	DefaultClientCertificateTTL = 4 * time.Hour
+
+	// ClientCertificateUserPrefix is followed by the upgrade ID in the user name of the client certificate, so the
+	// target cluster's audit log shows which upgrade made a request.
+	ClientCertificateUserPrefix = "cluster-api-upgrade-tool:"
+
+	// clientCertificateBackdate allows for clock skew between this machine and the target cluster's API servers.
+	clientCertificateBackdate = 5 * time.Minute
+
+	// clientCertificateRenewal is the share of its TTL a client certificate has left when it is reissued.
+	clientCertificateRenewal = 0.25
+)
+
+// DefaultClientCertificateGroups are the groups of the client certificate if none are configured. The group has no
+// permissions until it is bound to a ClusterRole in the target cluster, unlike system:masters, which bypasses RBAC.
+var DefaultClientCertificateGroups = []string{"cluster-api-upgrade-tool"}
+
+// ClientCertificate is the identity and lifetime of the client certificate issued from a target cluster's CA.
+type ClientCertificate struct {
+	// User is the common name of the certificate, which Kubernetes uses as the user name.
+	User string
+	// Groups are the organizations of the certificate, which Kubernetes uses as the user's groups.
+	Groups []string
+	// TTL is how long the certificate is valid. It never outlives the CA.
+	TTL time.Duration
+}
+
+// newClientCertificate returns a client certificate for identity, signed by the CA.
+func newClientCertificate(identity ClientCertificate, key *rsa.PrivateKey, caCert *x509.Certificate, caKey *rsa.PrivateKey) (*x509.Certificate, error) {
+	if identity.User == "" {
+		return nil, errors.New("a client certificate needs a user")
+	}
+	if identity.TTL <= 0 {
+		return nil, errors.New("a client certificate needs a positive TTL")
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).SetInt64(math.MaxInt64))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate a serial number for the client certificate")
+	}
+
+	now := time.Now()
+	notAfter := now.Add(identity.TTL)
+	if notAfter.After(caCert.NotAfter) {
+		notAfter = caCert.NotAfter
+	}
+
+	template := x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:   identity.User,
+			Organization: identity.Groups,
+		},
+		SerialNumber: serial,
+		NotBefore:    now.Add(-clientCertificateBackdate).UTC(),
+		NotAfter:     notAfter.UTC(),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, caCert, key.Public(), caKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign the client certificate")
+	}
+	return x509.ParseCertificate(der)
+}
+
+// clientCertificateIssuer issues client certificates for identity from a CA key pair, and issues a new one when the
+// current certificate nears its expiry, so upgrades that outlast the TTL keep connecting to the target cluster.
+type clientCertificateIssuer struct {
+	identity ClientCertificate
+	caCert   *x509.Certificate
+	caKey    *rsa.PrivateKey
+	now      func() time.Time
+
+	lock    sync.Mutex
+	current *tls.Certificate
+	renewAt time.Time
+}
+
+func newClientCertificateIssuer(identity ClientCertificate, caCert *x509.Certificate, caKey *rsa.PrivateKey) *clientCertificateIssuer {
+	return &clientCertificateIssuer{
+		identity: identity,
+		caCert:   caCert,
+		caKey:    caKey,
+		now:      time.Now,
+	}
+}
+
+// GetClientCertificate returns the current client certificate, issuing a new one if it's due for renewal. It is
+// called for every new TLS connection to the target cluster.
+func (i *clientCertificateIssuer) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if i.current != nil && i.now().Before(i.renewAt) {
+		return i.current, nil
+	}
+
+	key, err := certs.NewPrivateKey()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create a client private key")
+	}
+	cert, err := newClientCertificate(i.identity, key, i.caCert, i.caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	lifetime := cert.NotAfter.Sub(i.now())
+	i.renewAt = cert.NotAfter.Add(-time.Duration(float64(lifetime) * clientCertificateRenewal))
+	i.current = &tls.Certificate{
+		Certificate: [][]byte{cert.Raw},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}
+	return i.current, nil
+}
+
+// explainForbidden adds to a Forbidden error of the target cluster how to grant the issued client certificate the
+// permissions the upgrade needs. Other errors are returned as they are.
+func (u *base) explainForbidden(err error) error {
+	if err == nil || u.clientCertificate.User == "" || !apierrors.IsForbidden(errors.Cause(err)) {
+		return err
+	}
+	// The management cluster's Forbidden errors name a different user
+	if !strings.Contains(err.Error(), u.clientCertificate.User) {
+		return err
+	}
+	return errors.Wrapf(err, "the target cluster denied a request of %s in groups [%s]. "+
+		"Bind one of the groups, or another group set with --client-certificate-groups, to a ClusterRole allowing get, "+
+		"list, update and delete on nodes; get and list on pods and deployments; create on pods/eviction and pods/exec; "+
+		"and get, create, update and delete on configmaps, roles and rolebindings in kube-system. "+
+		"--client-certificate-groups system:masters bypasses RBAC instead",
+		u.clientCertificate.User, strings.Join(u.clientCertificate.Groups, ", "))
+}
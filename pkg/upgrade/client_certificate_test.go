@@ -0,0 +1,131 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/cluster-api/util/certs"
+)
+
+// testCA returns a self-signed CA that expires after lifetime.
+func testCA(t *testing.T, lifetime time.Duration) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := certs.NewPrivateKey()
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kubernetes"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(lifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+func TestNewClientCertificate(t *testing.T) {
+	caCert, caKey := testCA(t, 24*time.Hour)
+	key, err := certs.NewPrivateKey()
+	require.NoError(t, err)
+
+	identity := ClientCertificate{User: ClientCertificateUserPrefix + "1234", Groups: []string{"upgraders"}, TTL: time.Hour}
+	cert, err := newClientCertificate(identity, key, caCert, caKey)
+	require.NoError(t, err)
+
+	assert.Equal(t, "cluster-api-upgrade-tool:1234", cert.Subject.CommonName)
+	assert.Equal(t, []string{"upgraders"}, cert.Subject.Organization)
+	assert.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, cert.ExtKeyUsage)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), cert.NotAfter, time.Minute)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	assert.NoError(t, err)
+
+	// the certificate never outlives the CA
+	shortCACert, shortCAKey := testCA(t, 10*time.Minute)
+	cert, err = newClientCertificate(identity, key, shortCACert, shortCAKey)
+	require.NoError(t, err)
+	assert.Equal(t, shortCACert.NotAfter.Unix(), cert.NotAfter.Unix())
+
+	_, err = newClientCertificate(ClientCertificate{User: "user"}, key, caCert, caKey)
+	assert.Error(t, err)
+	_, err = newClientCertificate(ClientCertificate{TTL: time.Hour}, key, caCert, caKey)
+	assert.Error(t, err)
+}
+
+func TestRestConfigFromKeyPair(t *testing.T) {
+	caCert, caKey := testCA(t, 24*time.Hour)
+	kp := &keyPair{Cert: certs.EncodeCertPEM(caCert), Key: certs.EncodePrivateKeyPEM(caKey)}
+
+	config, err := restConfigFromKeyPair("https://10.0.0.1:6443", kp, ClientCertificate{User: "cluster-api-upgrade-tool:1234", TTL: time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, "https://10.0.0.1:6443", config.Host)
+
+	transport, ok := config.Transport.(*http.Transport)
+	require.True(t, ok)
+	tlsCert, err := transport.TLSClientConfig.GetClientCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "cluster-api-upgrade-tool:1234", tlsCert.Leaf.Subject.CommonName)
+	assert.Equal(t, tlsCert.PrivateKey.(*rsa.PrivateKey).Public(), tlsCert.Leaf.PublicKey)
+
+	_, err = tlsCert.Leaf.Verify(x509.VerifyOptions{Roots: transport.TLSClientConfig.RootCAs, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	assert.NoError(t, err)
+}
+
+func TestClientCertificateIssuerRenews(t *testing.T) {
+	caCert, caKey := testCA(t, 24*time.Hour)
+	issuer := newClientCertificateIssuer(ClientCertificate{User: "cluster-api-upgrade-tool:1234", TTL: time.Hour}, caCert, caKey)
+
+	now := time.Now()
+	issuer.now = func() time.Time { return now }
+
+	first, err := issuer.GetClientCertificate(nil)
+	require.NoError(t, err)
+
+	now = now.Add(30 * time.Minute)
+	second, err := issuer.GetClientCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, first, second, "the certificate should be reused while most of its TTL is left")
+
+	now = now.Add(20 * time.Minute)
+	renewed, err := issuer.GetClientCertificate(nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, first.Leaf.SerialNumber, renewed.Leaf.SerialNumber)
+}
+
+func TestExplainForbidden(t *testing.T) {
+	u := &base{clientCertificate: ClientCertificate{User: "cluster-api-upgrade-tool:1234", Groups: []string{"upgraders"}}}
+	nodes := schema.GroupResource{Resource: "nodes"}
+
+	targetForbidden := errors.Wrap(apierrors.NewForbidden(nodes, "", errors.New(`User "cluster-api-upgrade-tool:1234" cannot list resource "nodes"`)), "error listing nodes")
+	err := u.explainForbidden(targetForbidden)
+	assert.Contains(t, err.Error(), "--client-certificate-groups")
+	assert.Contains(t, err.Error(), "[upgraders]")
+
+	managementForbidden := apierrors.NewForbidden(nodes, "", errors.New(`User "admin" cannot list resource "nodes"`))
+	assert.Equal(t, managementForbidden, u.explainForbidden(managementForbidden))
+
+	other := errors.New("error listing nodes")
+	assert.Equal(t, other, u.explainForbidden(other))
+	assert.NoError(t, u.explainForbidden(nil))
+}
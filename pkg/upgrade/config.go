@@ -4,22 +4,47 @@
 package upgrade
 
 import (
+	"strings"
+	"time"
+
 	"github.com/blang/semver"
 	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 const (
 	ControlPlaneScope      = "control-plane"
 	MachineDeploymentScope = "machine-deployment"
+	WorkerMachineScope     = "worker-machine"
+
+	// DefaultMaxConcurrentMachineDeployments upgrades machine deployments one at a time.
+	DefaultMaxConcurrentMachineDeployments = 1
 )
 
 // Config contains all the configurations necessary to upgrade a Kubernetes cluster.
 type Config struct {
-	ManagementCluster ManagementClusterConfig `json:"managementCluster"`
-	TargetCluster     TargetClusterConfig     `json:"targetCluster"`
-	MachineUpdates    MachineUpdateConfig     `json:"machineUpdates"`
-	KubernetesVersion string                  `json:"kubernetesVersion"`
-	UpgradeID         string                  `json:"upgradeID"`
+	ManagementCluster  ManagementClusterConfig `json:"managementCluster"`
+	TargetCluster      TargetClusterConfig     `json:"targetCluster"`
+	MachineUpdates     MachineUpdateConfig     `json:"machineUpdates"`
+	MachineDeployments MachineDeploymentConfig `json:"machineDeployments"`
+	Timeouts           TimeoutConfig           `json:"timeouts"`
+	KubernetesVersion  string                  `json:"kubernetesVersion"`
+	UpgradeID          string                  `json:"upgradeID"`
+
+	// CleanupOnFailure deletes the objects a failed upgrade created but never finished with.
+	CleanupOnFailure bool `json:"cleanupOnFailure"`
+	// CleanupKubeletConfig deletes the kubelet configmap and RBAC rules of the previous minor version once no node
+	// runs that version anymore.
+	CleanupKubeletConfig bool `json:"cleanupKubeletConfig"`
+	// IgnoreVersionSkew upgrades workers even if their new kubelet version isn't supported with the control plane
+	// version.
+	IgnoreVersionSkew bool `json:"ignoreVersionSkew"`
+	// SkipRBACPreflight starts the upgrade without first checking that the management and target cluster
+	// credentials have every permission it needs.
+	SkipRBACPreflight bool `json:"skipRBACPreflight"`
+	// DryRun only logs what a cleanup would delete.
+	DryRun bool `json:"dryRun"`
 }
 
 // ManagementClusterConfig is the Kubeconfig and relevant information to connect to the management cluster of the worker cluster being upgraded.
@@ -38,53 +63,151 @@ type TargetClusterConfig struct {
 }
 
 func (t *TargetClusterConfig) UpgradeScopes() []string {
-	return []string{ControlPlaneScope, MachineDeploymentScope}
+	return []string{ControlPlaneScope, MachineDeploymentScope, WorkerMachineScope}
 }
 
-// KeyPairConfig is something
+// KeyPairConfig is the source of the target cluster's credentials. At most one of SecretRef, ClusterField,
+// KubeconfigSecretRef, Kubeconfig and the CA files is set. If none is, the Cluster API conventions are followed: the
+// <cluster>-kubeconfig secret, then the <cluster>-ca secret, then the CA key pair field of the provider's
+// infrastructure cluster.
 type KeyPairConfig struct {
 	SecretRef           string `json:"secretRef,omitempty"`
 	ClusterField        string `json:"clusterField,omitempty"`
 	KubeconfigSecretRef string `json:"kubeconfigSecretRef,omitempty"`
 
-	// APIEndpoint is a URL to a kube-apiserver.
-	// This entry is used only if SecretRef or ClusterField is set.
-	// APIEndpoint is ignored if KubeconfigSecretRef is set.
+	// Kubeconfig is the path to a kubeconfig of the target cluster.
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	// CACertFile and CAKeyFile are the paths to the PEM encoded CA certificate and key of the target cluster. They
+	// are set together.
+	CACertFile string `json:"caCertFile,omitempty"`
+	CAKeyFile  string `json:"caKeyFile,omitempty"`
+
+	// APIEndpoint is a URL to a kube-apiserver. It overrides the endpoint in the status of the Cluster or of its
+	// infrastructure cluster.
+	// This entry is used unless KubeconfigSecretRef or Kubeconfig is set or the <cluster>-kubeconfig secret is
+	// discovered.
 	APIEndpoint string `json:"apiEndpoint"`
+
+	// ClientCertificateTTL is how long each client certificate issued from a CA key pair is valid. Certificates are
+	// reissued before they expire.
+	ClientCertificateTTL time.Duration `json:"clientCertificateTTL,omitempty"`
+	// ClientCertificateGroups are the groups of the client certificate issued from a CA key pair. Its user is
+	// cluster-api-upgrade-tool:<upgrade ID>.
+	ClientCertificateGroups []string `json:"clientCertificateGroups,omitempty"`
 }
 
 func (k KeyPairConfig) validate() error {
-	if k.SecretRef != "" && k.ClusterField != "" {
-		return errors.New("cannot set both --ca-secret and --ca-field")
-	}
-	if k.SecretRef != "" && k.KubeconfigSecretRef != "" {
-		return errors.New("cannot set both --ca-secret and --kubeconfig-secret-ref")
+	if (k.CACertFile == "") != (k.CAKeyFile == "") {
+		return errors.New("--ca-cert-file and --ca-key-file must be set together")
 	}
-	if k.ClusterField != "" && k.KubeconfigSecretRef != "" {
-		return errors.New("cannot set both --ca-field and --kubeconfig-secret-ref")
-	}
-	if k.SecretRef == "" && k.ClusterField == "" && k.KubeconfigSecretRef == "" {
-		return errors.New("must set one of [--ca-secret, --ca-field, or --kubeconfig-secret-ref]")
+
+	var sources []string
+	for _, source := range []struct {
+		flag  string
+		value string
+	}{
+		{"--ca-secret", k.SecretRef},
+		{"--ca-field", k.ClusterField},
+		{"--kubeconfig-secret", k.KubeconfigSecretRef},
+		{"--target-kubeconfig", k.Kubeconfig},
+		{"--ca-cert-file and --ca-key-file", k.CACertFile},
+	} {
+		if source.value != "" {
+			sources = append(sources, source.flag)
+		}
 	}
-	if k.SecretRef != "" && k.APIEndpoint == "" {
-		return errors.New("must set --api-endpoint with --ca-secret")
+	if len(sources) > 1 {
+		return errors.Errorf("only one credential source can be set, got %s", strings.Join(sources, ", "))
 	}
-	if k.ClusterField != "" && k.APIEndpoint == "" {
-		return errors.New("must set --api-endpoint with --ca-field")
+
+	if k.ClientCertificateTTL < 0 {
+		return errors.New("client certificate TTL must not be negative")
 	}
 	return nil
 }
 
 // MachineUpdateConfig contains the configuration of the machine desired.
 type MachineUpdateConfig struct {
-	Image        ImageUpdateConfig `json:"image,omitempty"`
-	MachineClass string            `json:"machineClass,omitempty"`
+	Image ImageUpdateConfig `json:"image,omitempty"`
+	// MachineClass is the instance type of new machines, for example m5.xlarge. It is set in the instance type field
+	// of the infrastructure provider.
+	MachineClass string `json:"machineClass,omitempty"`
+
+	// BootstrapConfigPatchFile is the path to a JSON merge patch, in YAML or JSON, that is applied to a clone of the
+	// bootstrap config template of each MachineDeployment and MachineSet, for example a KubeadmConfigTemplate.
+	BootstrapConfigPatchFile string `json:"bootstrapConfigPatchFile,omitempty"`
+
+	// FieldUpdates are applied to the spec of new machines and machine templates, or to the infrastructure objects
+	// cloned for them, after the image is set.
+	FieldUpdates []FieldUpdate `json:"fieldUpdates,omitempty"`
+	// FieldUpdatesFile is the path to a YAML or JSON list of field updates, applied after FieldUpdates.
+	FieldUpdatesFile string `json:"fieldUpdatesFile,omitempty"`
+	// Set are field updates in the form [target:]path=value, with a YAML value, applied last.
+	Set []string `json:"set,omitempty"`
+
+	// NameTemplate is a Go template for the names of replacement machines. It is rendered with MachineNameData.
+	// DefaultMachineNameTemplate is used if it is empty.
+	NameTemplate string `json:"nameTemplate,omitempty"`
+}
+
+// MachineDeploymentConfig contains how machine deployments are upgraded.
+type MachineDeploymentConfig struct {
+	// MaxConcurrent is the maximum number of machine deployments that roll out at the same time.
+	MaxConcurrent int `json:"maxConcurrent,omitempty"`
+	// Selector is a label selector that limits which machine deployments of the cluster are upgraded.
+	Selector string `json:"selector,omitempty"`
+	// Names limits the upgrade to the machine deployments with these names.
+	Names []string `json:"names,omitempty"`
+	// MaxSurge and MaxUnavailable override the rolling update strategy of each machine deployment while it is
+	// upgraded. They are absolute numbers or percentages. The original strategy is restored afterwards.
+	MaxSurge       string `json:"maxSurge,omitempty"`
+	MaxUnavailable string `json:"maxUnavailable,omitempty"`
+	// Canary is upgraded before all other machine deployments, which are only upgraded if it passes its health gates.
+	Canary CanaryConfig `json:"canary,omitempty"`
+	// Drain makes the tool replace the machines of each machine deployment one at a time, cordoning and draining
+	// each old node through the Eviction API before its machine is deleted.
+	Drain bool `json:"drain,omitempty"`
+}
+
+// CanaryConfig contains which machine deployment to upgrade first and how to decide it is healthy.
+type CanaryConfig struct {
+	// MachineDeployment is the name of the canary machine deployment.
+	MachineDeployment string `json:"machineDeployment,omitempty"`
+	// WorkloadSelector selects the Deployments in the target cluster that have to be available after the canary is
+	// upgraded, and whose pods must not restart.
+	WorkloadSelector string `json:"workloadSelector,omitempty"`
+	// Rollback restores the original machine template of the canary if it fails its health gates.
+	Rollback bool `json:"rollback,omitempty"`
+}
+
+// TimeoutConfig contains how long to wait for the steps of an upgrade.
+type TimeoutConfig struct {
+	// MachineDeletion is how long to wait for a replaced machine to be deleted.
+	MachineDeletion time.Duration `json:"machineDeletion,omitempty"`
+	// MachineDeploymentRollout is how long to wait for each machine deployment to roll out.
+	MachineDeploymentRollout time.Duration `json:"machineDeploymentRollout,omitempty"`
+	// NodeDrain is how long to wait for the pods of a node to be evicted.
+	NodeDrain time.Duration `json:"nodeDrain,omitempty"`
 }
 
 // ImageUpdateConfig is something
 type ImageUpdateConfig struct {
 	ID    string `json:"id"`
 	Field string `json:"field"`
+
+	// InfrastructureField is the image field of infrastructure machines. It is set on the infrastructure machines
+	// cloned for control plane replacements, and under "spec.template" on the infrastructure templates cloned for
+	// MachineDeployments and MachineSets. Unless Field is set, it defaults to the image field of the provider of the
+	// infrastructure kind, for example "spec.ami.id" for an AWSMachine.
+	InfrastructureField string `json:"infrastructureField,omitempty"`
+
+	// Catalog is the path to an image catalog. If ID is empty, the image is looked up in it by Provider, Region,
+	// Flavor and the Kubernetes version. If ID is set, the catalog is used to check that the image is built for the
+	// Kubernetes version.
+	Catalog  string `json:"catalog,omitempty"`
+	Provider string `json:"provider,omitempty"`
+	Region   string `json:"region,omitempty"`
+	Flavor   string `json:"flavor,omitempty"`
 }
 
 // ValidateArgs validates the configuration passed in and returns the first validation error encountered.
@@ -108,10 +231,76 @@ func ValidateArgs(config Config) error {
 		return errors.Errorf("Invalid Kubernetes version: %q", config.KubernetesVersion)
 	}
 
-	if (config.MachineUpdates.Image.ID == "" && config.MachineUpdates.Image.Field != "") ||
-		(config.MachineUpdates.Image.ID != "" && config.MachineUpdates.Image.Field == "") {
-		return errors.New("when specifying image id, image field is required (and vice versa)")
+	image, err := resolveImage(config)
+	if err != nil {
+		return err
+	}
+	// Without a field the image goes into the field of the infrastructure provider
+	if image.ID == "" && (image.Field != "" || image.InfrastructureField != "") {
+		return errors.New("image field and infrastructure image field require an image id")
+	}
+
+	if config.Timeouts.MachineDeletion < 0 {
+		return errors.New("machine deletion timeout must not be negative")
+	}
+
+	if config.MachineDeployments.MaxConcurrent < 0 {
+		return errors.New("max concurrent machine deployments must not be negative")
+	}
+
+	if _, err := machineDeploymentSelector(config.TargetCluster.Name, config.MachineDeployments.Selector); err != nil {
+		return err
 	}
 
+	if canary := config.MachineDeployments.Canary; canary.MachineDeployment == "" && (canary.WorkloadSelector != "" || canary.Rollback) {
+		return errors.New("canary workload selector and rollback require a canary machine deployment")
+	}
+
+	if _, err := labels.Parse(config.MachineDeployments.Canary.WorkloadSelector); err != nil {
+		return errors.Wrapf(err, "invalid canary workload selector %q", config.MachineDeployments.Canary.WorkloadSelector)
+	}
+
+	if _, err := parseRollingUpdate(config.MachineDeployments.MaxSurge, config.MachineDeployments.MaxUnavailable); err != nil {
+		return err
+	}
+
+	if config.Timeouts.MachineDeploymentRollout < 0 {
+		return errors.New("machine deployment rollout timeout must not be negative")
+	}
+
+	if config.Timeouts.NodeDrain < 0 {
+		return errors.New("node drain timeout must not be negative")
+	}
+
+	if config.MachineDeployments.Drain && (config.MachineDeployments.MaxSurge != "" || config.MachineDeployments.MaxUnavailable != "") {
+		return errors.New("max surge and max unavailable can't be set when draining, nodes are replaced one at a time")
+	}
+
+	if _, err := loadBootstrapConfigPatch(config.MachineUpdates.BootstrapConfigPatchFile); err != nil {
+		return err
+	}
+
+	if _, err := loadFieldUpdates(config.MachineUpdates); err != nil {
+		return err
+	}
+
+	if config.UpgradeID != "" {
+		if err := validateUpgradeID(config.UpgradeID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := NewMachineNamer(config.MachineUpdates.NameTemplate, config.UpgradeID); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// validateUpgradeID makes sure id can be used as the value of UpgradeIDLabelKey.
+func validateUpgradeID(id string) error {
+	if errs := validation.IsValidLabelValue(id); len(errs) > 0 {
+		return errors.Errorf("invalid upgrade ID %q: %s", id, strings.Join(errs, "; "))
+	}
 	return nil
 }
@@ -4,7 +4,9 @@
 package upgrade_test
 
 import (
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/vmware/cluster-api-upgrade-tool/pkg/upgrade"
 )
@@ -84,21 +86,53 @@ func TestInvalidArgs(t *testing.T) {
 			},
 		},
 		{
-			name: "secret ref and no APIEndpoint",
+			name: "target kubeconfig and ca secret defined",
 			cfg: upgrade.Config{
+				KubernetesVersion: "v1.14.2",
 				TargetCluster: upgrade.TargetClusterConfig{
+					UpgradeScope: upgrade.ControlPlaneScope,
 					CAKeyPair: upgrade.KeyPairConfig{
-						SecretRef: "some-ref",
+						Kubeconfig: "/path/to/kubeconfig",
+						SecretRef:  "some-ref",
 					},
 				},
 			},
 		},
 		{
-			name: "ca field and no APIEndpoint",
+			name: "ca cert file without ca key file",
 			cfg: upgrade.Config{
+				KubernetesVersion: "v1.14.2",
 				TargetCluster: upgrade.TargetClusterConfig{
+					UpgradeScope: upgrade.ControlPlaneScope,
 					CAKeyPair: upgrade.KeyPairConfig{
-						ClusterField: "some.field",
+						CACertFile: "/path/to/ca.crt",
+					},
+				},
+			},
+		},
+		{
+			name: "ca files and kubeconfig secret ref defined",
+			cfg: upgrade.Config{
+				KubernetesVersion: "v1.14.2",
+				TargetCluster: upgrade.TargetClusterConfig{
+					UpgradeScope: upgrade.ControlPlaneScope,
+					CAKeyPair: upgrade.KeyPairConfig{
+						CACertFile:          "/path/to/ca.crt",
+						CAKeyFile:           "/path/to/ca.key",
+						KubeconfigSecretRef: "some-ref",
+					},
+				},
+			},
+		},
+		{
+			name: "negative client certificate ttl",
+			cfg: upgrade.Config{
+				KubernetesVersion: "v1.14.2",
+				TargetCluster: upgrade.TargetClusterConfig{
+					UpgradeScope: upgrade.ControlPlaneScope,
+					CAKeyPair: upgrade.KeyPairConfig{
+						SecretRef:            "some-ref",
+						ClientCertificateTTL: -time.Hour,
 					},
 				},
 			},
@@ -126,6 +160,110 @@ func TestInvalidArgs(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "invalid machine name template",
+			cfg: upgrade.Config{
+				KubernetesVersion: "v1.14.2",
+				TargetCluster: upgrade.TargetClusterConfig{
+					UpgradeScope: upgrade.ControlPlaneScope,
+					CAKeyPair: upgrade.KeyPairConfig{
+						KubeconfigSecretRef: "some-ref",
+					},
+				},
+				MachineUpdates: upgrade.MachineUpdateConfig{
+					NameTemplate: "{{.Prefix",
+				},
+			},
+		},
+		{
+			name: "invalid upgrade id",
+			cfg: upgrade.Config{
+				KubernetesVersion: "v1.14.2",
+				TargetCluster: upgrade.TargetClusterConfig{
+					UpgradeScope: upgrade.ControlPlaneScope,
+					CAKeyPair: upgrade.KeyPairConfig{
+						KubeconfigSecretRef: "some-ref",
+					},
+				},
+				UpgradeID: "not a label value",
+			},
+		},
+		{
+			name: "upgrade id longer than a label value",
+			cfg: upgrade.Config{
+				KubernetesVersion: "v1.14.2",
+				TargetCluster: upgrade.TargetClusterConfig{
+					UpgradeScope: upgrade.ControlPlaneScope,
+					CAKeyPair: upgrade.KeyPairConfig{
+						KubeconfigSecretRef: "some-ref",
+					},
+				},
+				UpgradeID: strings.Repeat("a", 64),
+			},
+		},
+		{
+			name: "negative max concurrent machine deployments",
+			cfg: upgrade.Config{
+				KubernetesVersion: "v1.14.2",
+				TargetCluster: upgrade.TargetClusterConfig{
+					UpgradeScope: upgrade.MachineDeploymentScope,
+					CAKeyPair: upgrade.KeyPairConfig{
+						KubeconfigSecretRef: "some-ref",
+					},
+				},
+				MachineDeployments: upgrade.MachineDeploymentConfig{
+					MaxConcurrent: -1,
+				},
+			},
+		},
+		{
+			name: "invalid machine deployment selector",
+			cfg: upgrade.Config{
+				KubernetesVersion: "v1.14.2",
+				TargetCluster: upgrade.TargetClusterConfig{
+					UpgradeScope: upgrade.MachineDeploymentScope,
+					CAKeyPair: upgrade.KeyPairConfig{
+						KubeconfigSecretRef: "some-ref",
+					},
+				},
+				MachineDeployments: upgrade.MachineDeploymentConfig{
+					Selector: "pool in (",
+				},
+			},
+		},
+		{
+			name: "canary rollback without canary machine deployment",
+			cfg: upgrade.Config{
+				KubernetesVersion: "v1.14.2",
+				TargetCluster: upgrade.TargetClusterConfig{
+					UpgradeScope: upgrade.MachineDeploymentScope,
+					CAKeyPair: upgrade.KeyPairConfig{
+						KubeconfigSecretRef: "some-ref",
+					},
+				},
+				MachineDeployments: upgrade.MachineDeploymentConfig{
+					Canary: upgrade.CanaryConfig{
+						Rollback: true,
+					},
+				},
+			},
+		},
+		{
+			name: "max surge with drain",
+			cfg: upgrade.Config{
+				KubernetesVersion: "v1.14.2",
+				TargetCluster: upgrade.TargetClusterConfig{
+					UpgradeScope: upgrade.MachineDeploymentScope,
+					CAKeyPair: upgrade.KeyPairConfig{
+						KubeconfigSecretRef: "some-ref",
+					},
+				},
+				MachineDeployments: upgrade.MachineDeploymentConfig{
+					Drain:    true,
+					MaxSurge: "2",
+				},
+			},
+		},
 	}
 
 	for _, tc := range testcases {
@@ -18,12 +18,9 @@ import (
 	"github.com/pkg/errors"
 	"github.com/vmware/cluster-api-upgrade-tool/pkg/internal/kubernetes"
 	v1 "k8s.io/api/core/v1"
-	rbacv1 "k8s.io/api/rbac/v1"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
-	"sigs.k8s.io/cluster-api/controllers/external"
-	"sigs.k8s.io/cluster-api/controllers/noderefutil"
 	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -31,10 +28,13 @@ const (
 	etcdCACertFile = "/etc/kubernetes/pki/etcd/ca.crt"
 	etcdCertFile   = "/etc/kubernetes/pki/etcd/peer.crt"
 	etcdKeyFile    = "/etc/kubernetes/pki/etcd/peer.key"
-	KindAWSMachine = "AWSMachine"
 
 	// UpgradeIDAnnotationKey is the annotation key for this tool's upgrade-id
-	UpgradeIDAnnotationKey = "upgrade-id"
+	UpgradeIDAnnotationKey = "cluster-api-upgrade-tool/upgrade-id"
+
+	// kubeadmAPIEndpointTimeout is how long to wait for a new control plane node's API endpoint to show up in the
+	// kubeadm configmap.
+	kubeadmAPIEndpointTimeout = 5 * time.Minute
 )
 
 type ControlPlaneUpgrader struct {
@@ -55,7 +55,11 @@ func NewControlPlaneUpgrader(log logr.Logger, config Config) (*ControlPlaneUpgra
 
 // Upgrade does the upgrading of the control plane.
 func (u *ControlPlaneUpgrader) Upgrade() error {
-	machines, err := u.listMachines()
+	return u.explainForbidden(u.upgrade())
+}
+
+func (u *ControlPlaneUpgrader) upgrade() error {
+	machines, err := u.listControlPlaneMachines()
 	if err != nil {
 		return err
 	}
@@ -64,6 +68,10 @@ func (u *ControlPlaneUpgrader) Upgrade() error {
 		return errors.New("Found 0 control plane machines")
 	}
 
+	if err := u.rbacPreflight(ControlPlaneScope, machineRefs(machines.Items)); err != nil {
+		return err
+	}
+
 	min, max, err := u.minMaxControlPlaneVersions(machines)
 	if err != nil {
 		return errors.Wrap(err, "error determining current control plane versions")
@@ -74,18 +82,8 @@ func (u *ControlPlaneUpgrader) Upgrade() error {
 		u.desiredVersion = max
 	}
 
-	if isMinorVersionUpgrade(min, u.desiredVersion) {
-		u.log.Info("TEST: update configmap if needed")
-		err = u.updateKubeletConfigMapIfNeeded(u.desiredVersion)
-		if err != nil {
-			return err
-		}
-
-		u.log.Info("TEST: update rbac if needed")
-		err = u.updateKubeletRbacIfNeeded(u.desiredVersion)
-		if err != nil {
-			return err
-		}
+	if err := u.updateKubeletConfigIfNeeded(min); err != nil {
+		return err
 	}
 
 	u.log.Info("TEST: etcd cluster health check")
@@ -104,14 +102,16 @@ func (u *ControlPlaneUpgrader) Upgrade() error {
 	}
 
 	u.log.Info("TEST: update CRDs")
-	return u.updateCRDs(machines)
-}
+	if err := u.updateCRDs(machines); err != nil {
+		u.cleanupAfterFailure()
+		return err
+	}
 
-func isMinorVersionUpgrade(base, update semver.Version) bool {
-	return base.Major == update.Major && base.Minor < update.Minor
+	return u.cleanupPreviousKubeletConfigIfNeeded()
 }
 
-func (u *ControlPlaneUpgrader) minMaxControlPlaneVersions(machines *clusterapiv1alpha2.MachineList) (semver.Version, semver.Version, error) {
+// minMaxControlPlaneVersions returns the lowest and highest versions of the control plane machines.
+func (u *base) minMaxControlPlaneVersions(machines *clusterapiv1alpha2.MachineList) (semver.Version, semver.Version, error) {
 	var min, max semver.Version
 
 	for _, machine := range machines.Items {
@@ -132,101 +132,6 @@ func (u *ControlPlaneUpgrader) minMaxControlPlaneVersions(machines *clusterapiv1
 	return min, max, nil
 }
 
-func (u *ControlPlaneUpgrader) updateKubeletConfigMapIfNeeded(version semver.Version) error {
-	// Check if the desired configmap already exists
-	desiredKubeletConfigMapName := fmt.Sprintf("kubelet-config-%d.%d", version.Major, version.Minor)
-	_, err := u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Get(desiredKubeletConfigMapName, metav1.GetOptions{})
-	if err == nil {
-		u.log.Info("kubelet configmap already exists", "configMapName", desiredKubeletConfigMapName)
-		return nil
-	}
-	if !apierrors.IsNotFound(err) {
-		return errors.Wrapf(err, "error determining if configmap %s exists", desiredKubeletConfigMapName)
-	}
-
-	// If we get here, we have to make the configmap
-	previousMinorVersionKubeletConfigMapName := fmt.Sprintf("kubelet-config-%d.%d", version.Major, version.Minor-1)
-	cm, err := u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Get(previousMinorVersionKubeletConfigMapName, metav1.GetOptions{})
-	if apierrors.IsNotFound(err) {
-		return errors.Errorf("unable to find current kubelet configmap %s", previousMinorVersionKubeletConfigMapName)
-	}
-	cm.Name = desiredKubeletConfigMapName
-	cm.ResourceVersion = ""
-
-	_, err = u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Create(cm)
-	if err != nil && !apierrors.IsAlreadyExists(err) {
-		return errors.Wrapf(err, "error creating configmap %s", desiredKubeletConfigMapName)
-	}
-
-	return nil
-}
-
-func (u *ControlPlaneUpgrader) updateKubeletRbacIfNeeded(version semver.Version) error {
-	majorMinor := fmt.Sprintf("%d.%d", version.Major, version.Minor)
-	roleName := fmt.Sprintf("kubeadm:kubelet-config-%s", majorMinor)
-
-	_, err := u.targetKubernetesClient.RbacV1().Roles("kube-system").Get(roleName, metav1.GetOptions{})
-	if apierrors.IsNotFound(err) {
-		newRole := &rbacv1.Role{
-			ObjectMeta: metav1.ObjectMeta{
-				Namespace: "kube-system",
-				Name:      roleName,
-			},
-			Rules: []rbacv1.PolicyRule{
-				{
-					Verbs:         []string{"get"},
-					APIGroups:     []string{""},
-					Resources:     []string{"configmaps"},
-					ResourceNames: []string{fmt.Sprintf("kubelet-config-%s", majorMinor)},
-				},
-			},
-		}
-
-		_, err := u.targetKubernetesClient.RbacV1().Roles("kube-system").Create(newRole)
-		if err != nil && !apierrors.IsAlreadyExists(err) {
-			return errors.Wrapf(err, "error creating role %s", roleName)
-		}
-	} else if err != nil {
-		return errors.Wrapf(err, "error determining if role %s exists", roleName)
-	}
-
-	_, err = u.targetKubernetesClient.RbacV1().RoleBindings("kube-system").Get(roleName, metav1.GetOptions{})
-	if apierrors.IsNotFound(err) {
-		newRoleBinding := &rbacv1.RoleBinding{
-			ObjectMeta: metav1.ObjectMeta{
-				Namespace: "kube-system",
-				Name:      roleName,
-			},
-			Subjects: []rbacv1.Subject{
-				{
-					APIGroup: "rbac.authorization.k8s.io",
-					Kind:     "Group",
-					Name:     "system:nodes",
-				},
-				{
-					APIGroup: "rbac.authorization.k8s.io",
-					Kind:     "Group",
-					Name:     "system:bootstrappers:kubeadm:default-node-token",
-				},
-			},
-			RoleRef: rbacv1.RoleRef{
-				APIGroup: "rbac.authorization.k8s.io",
-				Kind:     "Role",
-				Name:     roleName,
-			},
-		}
-
-		_, err = u.targetKubernetesClient.RbacV1().RoleBindings("kube-system").Create(newRoleBinding)
-		if err != nil && !apierrors.IsAlreadyExists(err) {
-			return errors.Wrapf(err, "error creating rolebinding %s", roleName)
-		}
-	} else if err != nil {
-		return errors.Wrapf(err, "error determining if rolebinding %s exists", roleName)
-	}
-
-	return nil
-}
-
 func (u *ControlPlaneUpgrader) etcdClusterHealthCheck(timeout time.Duration) error {
 	members, err := u.listEtcdMembers(timeout)
 	if err != nil {
@@ -249,39 +154,15 @@ func (u *ControlPlaneUpgrader) etcdClusterHealthCheck(timeout time.Duration) err
 	return err
 }
 
-func (u *ControlPlaneUpgrader) updateObjectReference(name string, ref *v1.ObjectReference) (*v1.ObjectReference, error) {
-	if ref.Namespace == "" {
-		ref.Namespace = "default"
-	}
-	object, err := external.Get(u.ctrlClient, ref, ref.Namespace)
-	if err != nil {
-		return &v1.ObjectReference{}, err
-	}
-
-	object.SetResourceVersion("")
-	object.SetName(name)
-
-	ref.ResourceVersion = ""
-	ref.Name = name
-
-	return ref, u.ctrlClient.Create(context.TODO(), object)
-}
-
 func (u *ControlPlaneUpgrader) updateMachine(name string, machine clusterapiv1alpha2.Machine, machineCreator *MachineCreator) error {
-	originalProviderID, err := noderefutil.NewProviderID(*machine.Spec.ProviderID)
+	oldNode, err := u.nodeForMachine(&machine)
 	if err != nil {
 		return err
 	}
 
-	oldNode := u.GetNodeFromProviderID(originalProviderID.ID())
-	if oldNode == nil {
-		u.log.Info("Couldn't retrieve oldNode", "id", originalProviderID.String())
-		return fmt.Errorf("unknown previous node %q", originalProviderID.String())
-	}
-
 	oldHostName := hostnameForNode(oldNode)
 
-	newMachine, node, err := machineCreator.NewMachine(name, &machine)
+	_, node, err := machineCreator.NewMachine(name, &machine)
 	if err != nil {
 		return err
 	}
@@ -302,10 +183,15 @@ func (u *ControlPlaneUpgrader) updateMachine(name string, machine clusterapiv1al
 		return err
 	}
 
-	if err := u.applyAnnotation(newMachine); err != nil {
+	if err := u.waitForMachineDeletion(&machine, u.machineDeletionTimeout); err != nil {
 		return err
 	}
-	return nil
+
+	if err := u.deleteStaleNode(oldNode); err != nil {
+		return err
+	}
+
+	return u.updateAndUploadKubeadmClusterStatus(oldNode.Name, node.Name, kubeadmAPIEndpointTimeout)
 }
 
 func (u *ControlPlaneUpgrader) updateCRDs(machines *clusterapiv1alpha2.MachineList) error {
@@ -315,23 +201,9 @@ func (u *ControlPlaneUpgrader) updateCRDs(machines *clusterapiv1alpha2.MachineLi
 		return err
 	}
 
-	mo := MachineOptions{
-		ImageID:        u.imageID,
-		ImageField:     u.imageField,
-		DesiredVersion: u.desiredVersion,
-	}
-
-	machineCreator := NewMachineCreator(
-		WithControllerRuntimeClient(u.ctrlClient),
-		WithMachineGetter(u.machineGetter),
-		WithNamespace(u.clusterNamespace),
-		WithNodeLister(u.targetKubernetesClient.CoreV1().Nodes()),
-		WithPodGetter(u.targetKubernetesClient.CoreV1().Pods("kube-system")),
-		WithMachineOptions(mo),
-		WithLogger(u.log.WithName("machine-creator")),
-	)
+	machineCreator := u.newMachineCreator()
 
-	// TODO add more error logs on failure conditions
+	var toUpgrade []clusterapiv1alpha2.Machine
 	for _, machine := range machines.Items {
 		annotations := machine.GetAnnotations()
 		// Skip any machine that already has the annotation we're looking for
@@ -344,28 +216,21 @@ func (u *ControlPlaneUpgrader) updateCRDs(machines *clusterapiv1alpha2.MachineLi
 			continue
 		}
 
-		// assume the original name is controlplane-<index> or controlplane-<index>-<timestamp>
-		// let's set the new name to controlplane-<index>-<timestamp>
-		nameParts := strings.Split(machine.Name, "-")
-		if len(nameParts) < 2 {
-			return errors.Errorf("machine name %q does not match expected format <name>-<index> or <name>-<index>-<timestamp>", machine.Name)
-		}
-		name := fmt.Sprintf("%s-%s-%d", nameParts[0], nameParts[1], time.Now().Unix())
-		// TODO: generate the name based off each respective object
+		toUpgrade = append(toUpgrade, machine)
+	}
 
-		u.log.Info("TEST: update infra ref")
-		infraMachine, err := u.updateObjectReference(name, &machine.Spec.InfrastructureRef)
-		if err != nil {
-			return err
-		}
-		machine.Spec.InfrastructureRef = *infraMachine
+	names, err := u.replacementNames(toUpgrade)
+	if err != nil {
+		return err
+	}
 
-		u.log.Info("TEST: update bootstrap ref")
-		bootstrap, err := u.updateObjectReference(name, machine.Spec.Bootstrap.ConfigRef)
-		if err != nil {
+	// TODO add more error logs on failure conditions
+	for _, machine := range toUpgrade {
+		name := names[machine.Name]
+
+		if err := u.prepareReplacement(name, &machine); err != nil {
 			return err
 		}
-		machine.Spec.Bootstrap.ConfigRef = bootstrap
 
 		u.log.Info("TEST: update machine")
 		if err := u.updateMachine(name, machine, machineCreator); err != nil {
@@ -376,20 +241,6 @@ func (u *ControlPlaneUpgrader) updateCRDs(machines *clusterapiv1alpha2.MachineLi
 	return nil
 }
 
-func (u *ControlPlaneUpgrader) applyAnnotation(m *clusterapiv1alpha2.Machine) error {
-	original := m.DeepCopy()
-	if m.Annotations == nil {
-		m.Annotations = map[string]string{}
-	}
-	m.Annotations[UpgradeIDAnnotationKey] = u.upgradeID
-	updated := m.DeepCopy()
-
-	// TODO: double check this patch strategy
-	u.ctrlClient.Patch(context.TODO(), updated, ctrlclient.MergeFrom(original))
-
-	return nil
-}
-
 // retry the given function for the given number of times with the given interval
 func (u *ControlPlaneUpgrader) retry(node *v1.Node, count int, interval time.Duration, fn func(hp *v1.Node) error) error {
 	if err := fn(node); err != nil {
@@ -404,13 +255,6 @@ func (u *ControlPlaneUpgrader) retry(node *v1.Node, count int, interval time.Dur
 	return nil
 }
 
-func (u *ControlPlaneUpgrader) deleteMachine(machine *clusterapiv1alpha2.Machine) error {
-	u.log.Info("Deleting existing machine", "namespace", machine.Namespace, "name", machine.Name)
-
-	err := u.ctrlClient.Delete(context.TODO(), machine, ctrlclient.PropagationPolicy(metav1.DeletePropagationForeground))
-	return errors.WithStack(err)
-}
-
 func hostnameForNode(node *v1.Node) string {
 	for _, address := range node.Status.Addresses {
 		if address.Type == v1.NodeHostName {
@@ -422,7 +266,7 @@ func hostnameForNode(node *v1.Node) string {
 
 // Split this into getting machines
 // Then pulling provider IDs
-func (u *ControlPlaneUpgrader) listMachines() (*clusterapiv1alpha2.MachineList, error) {
+func (u *base) listControlPlaneMachines() (*clusterapiv1alpha2.MachineList, error) {
 
 	labels := ctrlclient.MatchingLabels{
 		"cluster.x-k8s.io/cluster-name":  u.clusterName,
@@ -624,3 +468,77 @@ func updateKubeadmKubernetesVersion(original *v1.ConfigMap, version string) (*v1
 
 	return cm, nil
 }
+
+// updateAndUploadKubeadmClusterStatus removes the API endpoint of the replaced node from the ClusterStatus in the
+// kubeadm configmap, then waits for the API endpoint of its replacement to be registered there.
+func (u *ControlPlaneUpgrader) updateAndUploadKubeadmClusterStatus(oldNodeName, newNodeName string, timeout time.Duration) error {
+	original, err := u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Get("kubeadm-config", metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrap(err, "error getting kubeadm configmap from target cluster")
+	}
+
+	updated, err := updateKubeadmClusterStatus(original, oldNodeName)
+	if err != nil {
+		return err
+	}
+
+	if _, err = u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Update(updated); err != nil {
+		return errors.Wrap(err, "error updating kubeadm configmap")
+	}
+
+	// kubeadm join on the new node adds its API endpoint, which may still be in progress
+	err = wait.PollImmediate(5*time.Second, timeout, func() (bool, error) {
+		cm, err := u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Get("kubeadm-config", metav1.GetOptions{})
+		if err != nil {
+			return false, errors.Wrap(err, "error getting kubeadm configmap from target cluster")
+		}
+		return hasKubeadmAPIEndpoint(cm, newNodeName)
+	})
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("kubeadm configmap ClusterStatus has no API endpoint for new node %s after %s", newNodeName, timeout)
+	}
+	return err
+}
+
+// updateKubeadmClusterStatus removes the API endpoint of the replaced node from the ClusterStatus in the kubeadm
+// configmap.
+func updateKubeadmClusterStatus(original *v1.ConfigMap, oldNodeName string) (*v1.ConfigMap, error) {
+	cm := original.DeepCopy()
+
+	clusterStatus, err := kubeadmClusterStatus(cm)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints, _ := clusterStatus["apiEndpoints"].(map[string]interface{})
+	delete(endpoints, oldNodeName)
+
+	updated, err := yaml.Marshal(clusterStatus)
+	if err != nil {
+		return nil, errors.Wrap(err, "error encoding kubeadm configmap ClusterStatus")
+	}
+
+	cm.Data["ClusterStatus"] = string(updated)
+
+	return cm, nil
+}
+
+// hasKubeadmAPIEndpoint returns true if the ClusterStatus in the kubeadm configmap has an API endpoint for nodeName.
+func hasKubeadmAPIEndpoint(cm *v1.ConfigMap, nodeName string) (bool, error) {
+	clusterStatus, err := kubeadmClusterStatus(cm)
+	if err != nil {
+		return false, err
+	}
+
+	endpoints, _ := clusterStatus["apiEndpoints"].(map[string]interface{})
+	_, ok := endpoints[nodeName]
+	return ok, nil
+}
+
+func kubeadmClusterStatus(cm *v1.ConfigMap) (map[string]interface{}, error) {
+	clusterStatus := make(map[string]interface{})
+	if err := yaml.Unmarshal([]byte(cm.Data["ClusterStatus"]), &clusterStatus); err != nil {
+		return nil, errors.Wrap(err, "error decoding kubeadm configmap ClusterStatus")
+	}
+	return clusterStatus, nil
+}
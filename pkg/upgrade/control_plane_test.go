@@ -9,10 +9,13 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"sigs.k8s.io/yaml"
 
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/kubernetes/scheme"
 )
 
@@ -136,3 +139,83 @@ metadata:
 		t.Errorf("expected %s, got %s", expectedYaml, updatedYaml)
 	}
 }
+
+func TestUpdateKubeadmClusterStatus(t *testing.T) {
+	generate := func(endpoints string) string {
+		return fmt.Sprintf(`apiVersion: v1
+data:
+  ClusterStatus: |
+    apiEndpoints:
+%s    apiVersion: kubeadm.k8s.io/v1beta1
+    kind: ClusterStatus
+kind: ConfigMap
+metadata:
+  creationTimestamp: "2019-07-03T18:17:01Z"
+  name: kubeadm-config
+  namespace: kube-system
+`, endpoints)
+	}
+
+	oldEndpoint := `      ip-10-0-0-197.ec2.internal:
+        advertiseAddress: 10.0.0.197
+        bindPort: 6443
+`
+	otherEndpoint := `      ip-10-0-0-227.ec2.internal:
+        advertiseAddress: 10.0.0.227
+        bindPort: 6443
+`
+	newEndpoint := `      ip-10-0-0-250.ec2.internal:
+        advertiseAddress: 10.0.0.250
+        bindPort: 6443
+`
+
+	original := new(v1.ConfigMap)
+	_, _, err := scheme.Codecs.UniversalDecoder(v1.SchemeGroupVersion).Decode([]byte(generate(oldEndpoint+otherEndpoint+newEndpoint)), nil, original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updatedCM, err := updateKubeadmClusterStatus(original, "ip-10-0-0-197.ec2.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updatedYaml, err := yaml.Marshal(updatedCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedYaml := generate(otherEndpoint + newEndpoint)
+	if strings.TrimSpace(expectedYaml) != strings.TrimSpace(string(updatedYaml)) {
+		t.Errorf("expected %s, got %s", expectedYaml, updatedYaml)
+	}
+
+	if ok, err := hasKubeadmAPIEndpoint(updatedCM, "ip-10-0-0-250.ec2.internal"); err != nil || !ok {
+		t.Errorf("expected an API endpoint for the new node, got %t, %v", ok, err)
+	}
+
+	// The stale endpoint is removed even if the new node hasn't registered its own yet
+	notRegistered := new(v1.ConfigMap)
+	_, _, err = scheme.Codecs.UniversalDecoder(v1.SchemeGroupVersion).Decode([]byte(generate(oldEndpoint+otherEndpoint)), nil, notRegistered)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := &ControlPlaneUpgrader{base: &base{targetKubernetesClient: fake.NewSimpleClientset(notRegistered)}}
+	err = u.updateAndUploadKubeadmClusterStatus("ip-10-0-0-197.ec2.internal", "ip-10-0-0-250.ec2.internal", time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "no API endpoint for new node ip-10-0-0-250.ec2.internal") {
+		t.Errorf("expected an error about the missing API endpoint of the new node, got %v", err)
+	}
+
+	uploaded, err := u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Get("kubeadm-config", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadedYaml, err := yaml.Marshal(uploaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expectedYaml := generate(otherEndpoint); strings.TrimSpace(expectedYaml) != strings.TrimSpace(string(uploadedYaml)) {
+		t.Errorf("expected %s, got %s", expectedYaml, uploadedYaml)
+	}
+}
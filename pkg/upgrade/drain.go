@@ -0,0 +1,415 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	"sigs.k8s.io/cluster-api/controllers"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// DefaultNodeDrainTimeout is how long to wait for a node to be drained if no timeout is configured.
+	DefaultNodeDrainTimeout = 10 * time.Minute
+
+	// mirrorPodAnnotationKey is set on the API server's copies of static pods, which can't be evicted.
+	mirrorPodAnnotationKey = "kubernetes.io/config.mirror"
+)
+
+// drainRollingUpdate surges one machine at a time and never removes an old machine before its replacement is
+// available, so the old machine can be drained first.
+var drainRollingUpdate = &clusterapiv1alpha2.MachineRollingUpdateDeployment{
+	MaxSurge:       intOrStringPtr(intstr.FromInt(1)),
+	MaxUnavailable: intOrStringPtr(intstr.FromInt(0)),
+}
+
+func intOrStringPtr(v intstr.IntOrString) *intstr.IntOrString {
+	return &v
+}
+
+// drainMachineDeployment replaces the outdated machines of a machine deployment one at a time. For each of them the
+// machine deployment is resumed until it has surged one new machine, and paused again long before that machine can
+// become available, so the machine deployment never scales down on its own. Once the new machine's node is Ready, the
+// outdated machine's node is cordoned and drained, the machine is marked for deletion and the machine deployment is
+// resumed to scale it down. On failure the machine deployment is left paused, so it doesn't delete undrained machines.
+func (u *MachineDeploymentUpgrader) drainMachineDeployment(machineDeployment *clusterapiv1alpha2.MachineDeployment, outdated func(clusterapiv1alpha2.Machine) bool) error {
+	if err := u.replaceDrainedMachines(machineDeployment, outdated); err != nil {
+		return errors.Wrapf(err, "machinedeployment %s/%s is left paused", machineDeployment.Namespace, machineDeployment.Name)
+	}
+	return nil
+}
+
+func (u *MachineDeploymentUpgrader) replaceDrainedMachines(machineDeployment *clusterapiv1alpha2.MachineDeployment, outdated func(clusterapiv1alpha2.Machine) bool) error {
+	log := u.log.WithValues("namespace", machineDeployment.Namespace, "name", machineDeployment.Name)
+
+	for {
+		machines, err := u.machineDeploymentMachines(machineDeployment)
+		if err != nil {
+			return err
+		}
+		if len(outdatedMachines(machines, outdated)) == 0 {
+			return u.resumeForDrain(machineDeployment)
+		}
+
+		if err := u.surgeMachine(machineDeployment); err != nil {
+			return err
+		}
+
+		if err := u.waitForReplacementNodes(machineDeployment, outdated, u.machineDeploymentRolloutTimeout); err != nil {
+			return err
+		}
+
+		// The machines may have changed while the machine deployment was surging
+		machines, err = u.machineDeploymentMachines(machineDeployment)
+		if err != nil {
+			return err
+		}
+		machine := nextMachineToDrain(outdatedMachines(machines, outdated))
+		if machine == nil {
+			continue
+		}
+
+		log.Info("Replacing machine", "machine", machine.Name)
+
+		if machine.Status.NodeRef != nil {
+			if err := u.drainNode(machine.Status.NodeRef.Name, u.nodeDrainTimeout); err != nil {
+				return errors.Wrapf(err, "error draining machine %s", machine.Name)
+			}
+		}
+
+		if err := u.markMachineForDeletion(machine); err != nil {
+			return err
+		}
+
+		// The only machine the machine deployment can scale down now is the drained one, its MachineSet deletes
+		// marked machines first
+		if err := u.resumeForDrain(machineDeployment); err != nil {
+			return err
+		}
+
+		if err := u.waitForMachineDeletion(machine, u.machineDeletionTimeout); err != nil {
+			return err
+		}
+	}
+}
+
+// surgeMachine resumes the machine deployment until it has one machine more than its replicas and pauses it again.
+// If a previous run already left a surge machine behind, the machine deployment is only paused.
+func (u *MachineDeploymentUpgrader) surgeMachine(machineDeployment *clusterapiv1alpha2.MachineDeployment) error {
+	surged := func() (bool, error) {
+		current := &clusterapiv1alpha2.MachineDeployment{}
+		key := ctrlclient.ObjectKey{Namespace: machineDeployment.Namespace, Name: machineDeployment.Name}
+		if err := u.ctrlClient.Get(context.TODO(), key, current); err != nil {
+			return false, errors.Wrapf(err, "error getting machinedeployment %s", machineDeployment.Name)
+		}
+		replicas := int32(1)
+		if current.Spec.Replicas != nil {
+			replicas = *current.Spec.Replicas
+		}
+
+		machines, err := u.machineDeploymentMachines(current)
+		if err != nil {
+			return false, err
+		}
+		return int32(len(activeMachines(machines))) > replicas, nil
+	}
+
+	done, err := surged()
+	if err != nil {
+		return err
+	}
+	if !done {
+		u.log.Info("Waiting for machinedeployment to create a new machine", "namespace", machineDeployment.Namespace, "name", machineDeployment.Name)
+		if err := u.resumeForDrain(machineDeployment); err != nil {
+			return err
+		}
+		err := wait.PollImmediate(5*time.Second, u.machineDeploymentRolloutTimeout, surged)
+		if err == wait.ErrWaitTimeout {
+			return errors.Errorf("timed out waiting for machinedeployment %s to create a new machine", machineDeployment.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return u.pauseForDrain(machineDeployment)
+}
+
+// waitForReplacementNodes waits until the nodes of all machines that aren't outdated are Ready.
+func (u *MachineDeploymentUpgrader) waitForReplacementNodes(machineDeployment *clusterapiv1alpha2.MachineDeployment, outdated func(clusterapiv1alpha2.Machine) bool, timeout time.Duration) error {
+	var pending []string
+	err := wait.PollImmediate(10*time.Second, timeout, func() (bool, error) {
+		machines, err := u.machineDeploymentMachines(machineDeployment)
+		if err != nil {
+			return false, err
+		}
+
+		pending = nil
+		for _, machine := range activeMachines(machines) {
+			if outdated(machine) {
+				continue
+			}
+			if machine.Status.NodeRef == nil {
+				pending = append(pending, machine.Name)
+				continue
+			}
+			node, err := u.targetKubernetesClient.CoreV1().Nodes().Get(machine.Status.NodeRef.Name, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				pending = append(pending, machine.Name)
+				continue
+			}
+			if err != nil {
+				return false, errors.Wrapf(err, "error getting node %s", machine.Status.NodeRef.Name)
+			}
+			if len(notReadyNodes([]v1.Node{*node})) > 0 {
+				pending = append(pending, machine.Name)
+			}
+		}
+		return len(pending) == 0, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("timed out waiting for the nodes of machines %s to be Ready", strings.Join(pending, ", "))
+	}
+	return err
+}
+
+// outdatedMachines returns the outdated machines that aren't being deleted yet.
+func outdatedMachines(machines []clusterapiv1alpha2.Machine, outdated func(clusterapiv1alpha2.Machine) bool) []clusterapiv1alpha2.Machine {
+	var result []clusterapiv1alpha2.Machine
+	for _, machine := range activeMachines(machines) {
+		if outdated(machine) {
+			result = append(result, machine)
+		}
+	}
+	return result
+}
+
+// upgradedMachine tells whether machine was created for the upgrade.
+func (u *base) upgradedMachine(machine clusterapiv1alpha2.Machine) bool {
+	return machine.Annotations[UpgradeIDAnnotationKey] == u.upgradeID
+}
+
+// notUpgradedMachine tells whether machine still has to be replaced by the upgrade.
+func (u *base) notUpgradedMachine(machine clusterapiv1alpha2.Machine) bool {
+	return !u.upgradedMachine(machine)
+}
+
+// activeMachines returns the machines that aren't being deleted.
+func activeMachines(machines []clusterapiv1alpha2.Machine) []clusterapiv1alpha2.Machine {
+	var result []clusterapiv1alpha2.Machine
+	for _, machine := range machines {
+		if machine.DeletionTimestamp == nil {
+			result = append(result, machine)
+		}
+	}
+	return result
+}
+
+// nextMachineToDrain prefers a machine a previous run already marked for deletion, so no two machines are marked at
+// the same time.
+func nextMachineToDrain(machines []clusterapiv1alpha2.Machine) *clusterapiv1alpha2.Machine {
+	if len(machines) == 0 {
+		return nil
+	}
+	for i := range machines {
+		if machines[i].Annotations[controllers.DeleteNodeAnnotation] != "" {
+			return &machines[i]
+		}
+	}
+	return &machines[0]
+}
+
+// machineDeploymentMachines returns the machines selected by machineDeployment.
+func (u *base) machineDeploymentMachines(machineDeployment *clusterapiv1alpha2.MachineDeployment) ([]clusterapiv1alpha2.Machine, error) {
+	selector, err := metav1.LabelSelectorAsSelector(&machineDeployment.Spec.Selector)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid selector for machinedeployment %s", machineDeployment.Name)
+	}
+
+	machines := &clusterapiv1alpha2.MachineList{}
+	err = u.ctrlClient.List(context.TODO(), machines,
+		ctrlclient.InNamespace(machineDeployment.Namespace),
+		matchingSelector{selector},
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing machines of machinedeployment %s", machineDeployment.Name)
+	}
+
+	return machines.Items, nil
+}
+
+// pauseForDrain pauses the machine deployment and sets the drain strategy on it.
+func (u *MachineDeploymentUpgrader) pauseForDrain(machineDeployment *clusterapiv1alpha2.MachineDeployment) error {
+	return u.patchMachineDeployment(machineDeployment, func(current *clusterapiv1alpha2.MachineDeployment) error {
+		current.Spec.Paused = true
+		return overrideStrategy(current, drainRollingUpdate)
+	})
+}
+
+// resumeForDrain unpauses the machine deployment. A previous run may have restored the original strategy, so the
+// drain strategy is set again before the machine deployment can replace anything.
+func (u *MachineDeploymentUpgrader) resumeForDrain(machineDeployment *clusterapiv1alpha2.MachineDeployment) error {
+	return u.patchMachineDeployment(machineDeployment, func(current *clusterapiv1alpha2.MachineDeployment) error {
+		current.Spec.Paused = false
+		return overrideStrategy(current, drainRollingUpdate)
+	})
+}
+
+// patchMachineDeployment gets the current machine deployment, applies mutate to it and patches it.
+func (u *MachineDeploymentUpgrader) patchMachineDeployment(machineDeployment *clusterapiv1alpha2.MachineDeployment, mutate func(*clusterapiv1alpha2.MachineDeployment) error) error {
+	current := &clusterapiv1alpha2.MachineDeployment{}
+	key := ctrlclient.ObjectKey{Namespace: machineDeployment.Namespace, Name: machineDeployment.Name}
+	if err := u.ctrlClient.Get(context.TODO(), key, current); err != nil {
+		return errors.Wrapf(err, "error getting machinedeployment %s", machineDeployment.Name)
+	}
+
+	original := current.DeepCopy()
+	if err := mutate(current); err != nil {
+		return err
+	}
+	if err := u.ctrlClient.Patch(context.TODO(), current, ctrlclient.MergeFrom(original)); err != nil {
+		return errors.Wrapf(err, "error patching machinedeployment %s", machineDeployment.Name)
+	}
+	return nil
+}
+
+// markMachineForDeletion annotates machine so its MachineSet removes it first when it scales down.
+func (u *base) markMachineForDeletion(machine *clusterapiv1alpha2.Machine) error {
+	u.log.Info("Marking machine for deletion by its MachineSet", "namespace", machine.Namespace, "name", machine.Name)
+
+	original := machine.DeepCopy()
+	if machine.Annotations == nil {
+		machine.Annotations = map[string]string{}
+	}
+	machine.Annotations[controllers.DeleteNodeAnnotation] = "yes"
+
+	if err := u.ctrlClient.Patch(context.TODO(), machine.DeepCopy(), ctrlclient.MergeFrom(original)); err != nil {
+		return errors.Wrapf(err, "error marking machine %s for deletion", machine.Name)
+	}
+
+	return nil
+}
+
+// drainNode cordons the node and evicts its pods through the Eviction API, which respects PodDisruptionBudgets.
+// DaemonSet and mirror pods are left alone, like kubectl drain does.
+func (u *base) drainNode(name string, timeout time.Duration) error {
+	log := u.log.WithValues("node", name)
+
+	node, err := u.targetKubernetesClient.CoreV1().Nodes().Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error getting node %s", name)
+	}
+
+	if !node.Spec.Unschedulable {
+		log.Info("Cordoning node")
+		node.Spec.Unschedulable = true
+		if _, err := u.targetKubernetesClient.CoreV1().Nodes().Update(node); err != nil {
+			return errors.Wrapf(err, "error cordoning node %s", name)
+		}
+	}
+
+	pods, err := u.targetKubernetesClient.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", name).String(),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error listing pods on node %s", name)
+	}
+
+	toEvict := podsToEvict(pods.Items)
+	log.Info("Draining node", "pods", len(toEvict), "timeout", timeout)
+
+	deadline := time.Now().Add(timeout)
+	for i := range toEvict {
+		if err := u.evictPod(&toEvict[i], time.Until(deadline)); err != nil {
+			return err
+		}
+	}
+
+	return u.waitForPodsDeleted(toEvict, time.Until(deadline))
+}
+
+// evictPod evicts pod, retrying while a PodDisruptionBudget doesn't allow the eviction.
+func (u *base) evictPod(pod *v1.Pod, timeout time.Duration) error {
+	eviction := &policyv1beta1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{Namespace: pod.Namespace, Name: pod.Name},
+	}
+
+	err := wait.PollImmediate(5*time.Second, timeout, func() (bool, error) {
+		err := u.targetKubernetesClient.CoreV1().Pods(pod.Namespace).Evict(eviction)
+		switch {
+		case err == nil, apierrors.IsNotFound(err):
+			return true, nil
+		case apierrors.IsTooManyRequests(err):
+			u.log.Info("Eviction blocked by a PodDisruptionBudget, retrying", "namespace", pod.Namespace, "pod", pod.Name)
+			return false, nil
+		default:
+			return false, errors.Wrapf(err, "error evicting pod %s/%s", pod.Namespace, pod.Name)
+		}
+	})
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("timed out evicting pod %s/%s, check its PodDisruptionBudget", pod.Namespace, pod.Name)
+	}
+	return err
+}
+
+func (u *base) waitForPodsDeleted(pods []v1.Pod, timeout time.Duration) error {
+	var remaining []string
+	err := wait.PollImmediate(5*time.Second, timeout, func() (bool, error) {
+		remaining = nil
+		for _, pod := range pods {
+			current, err := u.targetKubernetesClient.CoreV1().Pods(pod.Namespace).Get(pod.Name, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) || (err == nil && current.UID != pod.UID) {
+				continue
+			}
+			if err != nil {
+				return false, errors.Wrapf(err, "error getting pod %s/%s", pod.Namespace, pod.Name)
+			}
+			remaining = append(remaining, pod.Namespace+"/"+pod.Name)
+		}
+		return len(remaining) == 0, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("timed out waiting for evicted pods to terminate: %s", strings.Join(remaining, ", "))
+	}
+	return err
+}
+
+// podsToEvict returns the pods a drain has to evict: everything except mirror pods, DaemonSet pods and pods that
+// have already finished.
+func podsToEvict(pods []v1.Pod) []v1.Pod {
+	var result []v1.Pod
+	for _, pod := range pods {
+		if _, ok := pod.Annotations[mirrorPodAnnotationKey]; ok {
+			continue
+		}
+		if ownedByDaemonSet(&pod) {
+			continue
+		}
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		result = append(result, pod)
+	}
+	return result
+}
+
+func ownedByDaemonSet(pod *v1.Pod) bool {
+	owner := metav1.GetControllerOf(pod)
+	return owner != nil && owner.Kind == "DaemonSet"
+}
@@ -0,0 +1,209 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	"sigs.k8s.io/cluster-api/controllers"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestPodsToEvict(t *testing.T) {
+	controller := true
+
+	mirror := pod("kube-system", "kube-proxy-static")
+	mirror.Annotations = map[string]string{mirrorPodAnnotationKey: "hash"}
+
+	daemonSet := pod("kube-system", "calico-node-abcde")
+	daemonSet.OwnerReferences = []metav1.OwnerReference{{Kind: "DaemonSet", Name: "calico-node", Controller: &controller}}
+
+	replicaSet := pod("default", "web-7d4b9c-xyz")
+	replicaSet.OwnerReferences = []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "web-7d4b9c", Controller: &controller}}
+
+	succeeded := pod("default", "job-done")
+	succeeded.Status.Phase = v1.PodSucceeded
+
+	failed := pod("default", "job-failed")
+	failed.Status.Phase = v1.PodFailed
+
+	running := pod("default", "standalone")
+	running.Status.Phase = v1.PodRunning
+
+	evicted := podsToEvict([]v1.Pod{mirror, daemonSet, replicaSet, succeeded, failed, running})
+
+	var names []string
+	for _, p := range evicted {
+		names = append(names, p.Name)
+	}
+	assert.Equal(t, []string{"web-7d4b9c-xyz", "standalone"}, names)
+}
+
+// machineDeploymentController stands in for the cluster-api controllers and records what the tool asks of them. When
+// the machine deployment is resumed, it deletes the machines marked for deletion and surges one new machine while
+// machines without the replacement's upgrade ID annotation are left.
+type machineDeploymentController struct {
+	ctrlclient.Client
+	target         kubernetes.Interface
+	replacement    string
+	kubeletVersion string
+	created        int
+	operations     []string
+}
+
+func (c *machineDeploymentController) Patch(ctx context.Context, obj runtime.Object, patch ctrlclient.Patch, opts ...ctrlclient.PatchOption) error {
+	md, ok := obj.(*clusterapiv1alpha2.MachineDeployment)
+	if !ok {
+		if err := c.Client.Patch(ctx, obj, patch, opts...); err != nil {
+			return err
+		}
+		if machine, ok := obj.(*clusterapiv1alpha2.Machine); ok && machine.Annotations[controllers.DeleteNodeAnnotation] != "" {
+			c.operations = append(c.operations, "mark "+machine.Name)
+		}
+		return nil
+	}
+
+	// The fake client doesn't remove fields on a merge patch, so look at what is patched and unpause by hand
+	data, err := patch.Data(md)
+	if err != nil {
+		return err
+	}
+	paused := strings.Contains(string(data), `"paused":true`)
+	resumed := !md.Spec.Paused && md.Spec.Strategy != nil && reflect.DeepEqual(md.Spec.Strategy.RollingUpdate, drainRollingUpdate)
+	if err := c.Client.Patch(ctx, md, patch, opts...); err != nil {
+		return err
+	}
+	switch {
+	case paused:
+		c.operations = append(c.operations, "pause")
+		return nil
+	case !resumed:
+		c.operations = append(c.operations, "patch")
+		return nil
+	}
+
+	c.operations = append(c.operations, "resume")
+	md.Spec.Paused = false
+	if err := c.Update(ctx, md); err != nil {
+		return err
+	}
+	return c.reconcile(ctx, md)
+}
+
+func (c *machineDeploymentController) reconcile(ctx context.Context, machineDeployment *clusterapiv1alpha2.MachineDeployment) error {
+	machines := &clusterapiv1alpha2.MachineList{}
+	if err := c.List(ctx, machines); err != nil {
+		return err
+	}
+
+	var active, old int
+	for i := range machines.Items {
+		machine := &machines.Items[i]
+		if machine.Annotations[controllers.DeleteNodeAnnotation] != "" {
+			if err := c.Delete(ctx, machine); err != nil {
+				return err
+			}
+			continue
+		}
+		active++
+		if machine.Annotations[UpgradeIDAnnotationKey] != c.replacement {
+			old++
+		}
+	}
+
+	if old == 0 || int32(active) > *machineDeployment.Spec.Replicas {
+		return nil
+	}
+
+	c.created++
+	name := fmt.Sprintf("md-new-%d", c.created)
+	node := readyNode(name)
+	node.Status.NodeInfo.KubeletVersion = c.kubeletVersion
+	if _, err := c.target.CoreV1().Nodes().Create(node); err != nil {
+		return err
+	}
+	return c.Create(ctx, drainMachine(name, c.replacement))
+}
+
+// recordCordons records the nodes the tool cordons in target.
+func (c *machineDeploymentController) recordCordons(target *kubefake.Clientset) {
+	target.PrependReactor("update", "nodes", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		node := action.(clienttesting.UpdateAction).GetObject().(*v1.Node)
+		if node.Spec.Unschedulable {
+			c.operations = append(c.operations, "cordon "+node.Name)
+		}
+		return false, nil, nil
+	})
+}
+
+func readyNode(name string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+		},
+	}
+}
+
+func drainMachine(name, upgradeID string) *clusterapiv1alpha2.Machine {
+	machine := &clusterapiv1alpha2.Machine{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Labels: map[string]string{"pool": "md"}},
+		Status:     clusterapiv1alpha2.MachineStatus{NodeRef: &v1.ObjectReference{Name: name}},
+	}
+	if upgradeID != "" {
+		machine.Annotations = map[string]string{UpgradeIDAnnotationKey: upgradeID}
+	}
+	return machine
+}
+
+func TestReplaceDrainedMachinesOrder(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clusterapiv1alpha2.AddToScheme(scheme))
+
+	md := machineDeployment(2, clusterapiv1alpha2.MachineDeploymentStatus{})
+	target := kubefake.NewSimpleClientset(readyNode("md-old-a"), readyNode("md-old-b"))
+	controller := &machineDeploymentController{
+		Client:      fake.NewFakeClientWithScheme(scheme, md.DeepCopy(), drainMachine("md-old-a", ""), drainMachine("md-old-b", "")),
+		target:      target,
+		replacement: "42",
+	}
+	controller.recordCordons(target)
+
+	u := &MachineDeploymentUpgrader{
+		base: &base{
+			log:                             testLogger(),
+			upgradeID:                       "42",
+			machineDeletionTimeout:          time.Millisecond,
+			machineDeploymentRolloutTimeout: time.Millisecond,
+			nodeDrainTimeout:                time.Millisecond,
+			ctrlClient:                      controller,
+			targetKubernetesClient:          target,
+		},
+	}
+
+	require.NoError(t, u.replaceDrainedMachines(md, u.notUpgradedMachine))
+
+	// Each old machine is drained only after a new machine is Ready and the machine deployment is paused, and the
+	// machine deployment is only resumed to scale down the drained machine
+	assert.Equal(t, []string{
+		"resume", "pause", "cordon md-old-a", "mark md-old-a",
+		"resume", "pause", "cordon md-old-b", "mark md-old-b",
+		"resume", "resume",
+	}, controller.operations)
+}
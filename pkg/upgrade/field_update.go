@@ -0,0 +1,403 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// FieldUpdateTargetMachine updates the spec of machines and machine templates.
+	FieldUpdateTargetMachine = "machine"
+	// FieldUpdateTargetInfrastructure updates the infrastructure machines and templates they refer to.
+	FieldUpdateTargetInfrastructure = "infrastructure"
+
+	// fieldUpdateOpSet sets the value at a JSONPath-style path, creating missing objects on the way.
+	fieldUpdateOpSet = "set"
+	// fieldUpdateOpRemove removes the value at a path.
+	fieldUpdateOpRemove = "remove"
+)
+
+// FieldUpdate changes one field of the machines or infrastructure objects an upgrade creates.
+type FieldUpdate struct {
+	// Target is what the update applies to, "machine" (the default) or "infrastructure". Machine paths are relative
+	// to the machine spec, infrastructure paths to the infrastructure machine, like "spec.ami.id". For
+	// infrastructure templates, the path is applied under spec.template.
+	Target string `json:"target,omitempty"`
+
+	// Path is either a JSON pointer, like "/spec/additionalTags/team", or a JSONPath-style path, like
+	// "spec.rootDeviceSize", "spec.additionalSecurityGroups[0].id" or "spec.additionalTags['kubernetes.io/role']".
+	Path string `json:"path"`
+
+	// Op is a JSON Patch operation for JSON pointer paths: add (the default), replace, remove or test. JSONPath-style
+	// paths support set (the default) and remove.
+	Op string `json:"op,omitempty"`
+
+	// Value is the JSON value to set, so it can be a string, number, boolean, list or object.
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+func (f FieldUpdate) String() string {
+	return f.target() + ":" + f.Path
+}
+
+func (f FieldUpdate) target() string {
+	if f.Target == "" {
+		return FieldUpdateTargetMachine
+	}
+	return f.Target
+}
+
+func (f FieldUpdate) isJSONPatch() bool {
+	return strings.HasPrefix(f.Path, "/")
+}
+
+func (f FieldUpdate) op() string {
+	switch {
+	case f.Op != "":
+		return f.Op
+	case f.isJSONPatch():
+		return "add"
+	default:
+		return fieldUpdateOpSet
+	}
+}
+
+func (f FieldUpdate) validate() error {
+	if target := f.target(); target != FieldUpdateTargetMachine && target != FieldUpdateTargetInfrastructure {
+		return errors.Errorf("field update %s: invalid target %q, must be %q or %q", f, f.Target, FieldUpdateTargetMachine, FieldUpdateTargetInfrastructure)
+	}
+
+	op := f.op()
+	if f.isJSONPatch() {
+		switch op {
+		case "add", "replace", "remove", "test":
+		default:
+			return errors.Errorf("field update %s: invalid JSON Patch operation %q", f, op)
+		}
+	} else {
+		if op != fieldUpdateOpSet && op != fieldUpdateOpRemove {
+			return errors.Errorf("field update %s: invalid operation %q, must be %q or %q", f, op, fieldUpdateOpSet, fieldUpdateOpRemove)
+		}
+		if _, err := parseFieldPath(f.Path); err != nil {
+			return errors.Wrapf(err, "field update %s", f)
+		}
+	}
+
+	if op != fieldUpdateOpRemove {
+		var value interface{}
+		if err := json.Unmarshal(f.Value, &value); err != nil {
+			return errors.Wrapf(err, "field update %s: invalid value", f)
+		}
+	}
+	return nil
+}
+
+// fieldPathSegment is a key of an object or an index of a list.
+type fieldPathSegment struct {
+	key   string
+	index int
+	isKey bool
+}
+
+// parseFieldPath parses a JSONPath-style path made of dot-separated keys, [n] list indexes and ['key'] or ["key"]
+// keys, which may contain dots. A leading "$." or "." is ignored.
+func parseFieldPath(path string) ([]fieldPathSegment, error) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if rest == "" {
+		return nil, errors.Errorf("empty path %q", path)
+	}
+
+	var segments []fieldPathSegment
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, "['") || strings.HasPrefix(rest, `["`):
+			quote := rest[1:2]
+			end := strings.Index(rest[2:], quote+"]")
+			if end < 0 {
+				return nil, errors.Errorf("unterminated key in path %q", path)
+			}
+			segments = append(segments, fieldPathSegment{key: rest[2 : 2+end], isKey: true})
+			rest = rest[2+end+2:]
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, errors.Errorf("unterminated index in path %q", path)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, errors.Errorf("invalid index %q in path %q", rest[1:end], path)
+			}
+			segments = append(segments, fieldPathSegment{index: index})
+			rest = rest[end+1:]
+		default:
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, errors.Errorf("empty key in path %q", path)
+			}
+			segments = append(segments, fieldPathSegment{key: rest[:end], isKey: true})
+			rest = rest[end:]
+		}
+
+		if strings.HasPrefix(rest, ".") {
+			rest = rest[1:]
+			if rest == "" {
+				return nil, errors.Errorf("path %q must not end with a dot", path)
+			}
+		}
+	}
+	return segments, nil
+}
+
+// applyFieldUpdates applies the updates for target to object, in order. prefix is prepended to every path, for
+// example to reach the machine spec of an infrastructure template.
+func applyFieldUpdates(object map[string]interface{}, updates []FieldUpdate, target string, prefix ...string) (map[string]interface{}, error) {
+	for _, update := range updates {
+		if update.target() != target {
+			continue
+		}
+
+		var err error
+		if update.isJSONPatch() {
+			object, err = applyJSONPatchUpdate(object, update, prefix)
+		} else {
+			err = applyFieldPathUpdate(object, update, prefix)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "error applying field update %s", update)
+		}
+	}
+	return object, nil
+}
+
+func applyJSONPatchUpdate(object map[string]interface{}, update FieldUpdate, prefix []string) (map[string]interface{}, error) {
+	path := update.Path
+	if len(prefix) > 0 {
+		path = "/" + strings.Join(prefix, "/") + path
+	}
+
+	operation := map[string]interface{}{"op": update.op(), "path": path}
+	if update.op() != fieldUpdateOpRemove {
+		operation["value"] = update.Value
+	}
+	rawPatch, err := json.Marshal([]interface{}{operation})
+	if err != nil {
+		return nil, err
+	}
+	patch, err := jsonpatch.DecodePatch(rawPatch)
+	if err != nil {
+		return nil, err
+	}
+
+	document, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	patched, err := patch.Apply(document)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]interface{}{}
+	if err := utiljson.Unmarshal(patched, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func applyFieldPathUpdate(object map[string]interface{}, update FieldUpdate, prefix []string) error {
+	segments, err := parseFieldPath(update.Path)
+	if err != nil {
+		return err
+	}
+	for i := len(prefix) - 1; i >= 0; i-- {
+		segments = append([]fieldPathSegment{{key: prefix[i], isKey: true}}, segments...)
+	}
+
+	var value interface{}
+	if update.op() != fieldUpdateOpRemove {
+		if value, err = decodeFieldValue(update.Value); err != nil {
+			return err
+		}
+	}
+
+	var current interface{} = object
+	for i, segment := range segments {
+		last := i == len(segments)-1
+
+		if segment.isKey {
+			fields, ok := current.(map[string]interface{})
+			if !ok {
+				return errors.Errorf("%q is not an object", segment.key)
+			}
+			if last {
+				if update.op() == fieldUpdateOpRemove {
+					delete(fields, segment.key)
+				} else {
+					fields[segment.key] = value
+				}
+				return nil
+			}
+			next, ok := fields[segment.key]
+			if !ok || next == nil {
+				if segments[i+1].isKey {
+					next = map[string]interface{}{}
+				} else {
+					next = []interface{}{}
+				}
+				fields[segment.key] = next
+			}
+			current = next
+			continue
+		}
+
+		list, ok := current.([]interface{})
+		if !ok || segment.index >= len(list) {
+			return errors.Errorf("index %d is out of range", segment.index)
+		}
+		if last {
+			if update.op() == fieldUpdateOpRemove {
+				return errors.New("list elements can only be removed with a JSON Patch operation")
+			}
+			list[segment.index] = value
+			return nil
+		}
+		current = list[segment.index]
+	}
+	return nil
+}
+
+// decodeFieldValue decodes raw like the rest of an unstructured object, with whole numbers as int64.
+func decodeFieldValue(raw json.RawMessage) (interface{}, error) {
+	wrapped, err := json.Marshal(map[string]json.RawMessage{"value": raw})
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid value")
+	}
+
+	decoded := map[string]interface{}{}
+	if err := utiljson.Unmarshal(wrapped, &decoded); err != nil {
+		return nil, errors.Wrap(err, "invalid value")
+	}
+	return decoded["value"], nil
+}
+
+// updateMachineSpec applies the machine field updates to spec.
+func updateMachineSpec(spec *clusterapiv1alpha2.MachineSpec, updates []FieldUpdate) error {
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(spec)
+	if err != nil {
+		return errors.Wrap(err, "error converting machine spec to unstructured")
+	}
+
+	u, err = applyFieldUpdates(u, updates, FieldUpdateTargetMachine)
+	if err != nil {
+		return err
+	}
+
+	s := clusterapiv1alpha2.MachineSpec{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u, &s); err != nil {
+		return errors.Wrap(err, "error converting unstructured to machine spec")
+	}
+
+	*spec = s
+
+	return nil
+}
+
+// parseFieldUpdateFlag parses "[target:]path=value", where the value is YAML. The value is split off at the first
+// "=" outside of brackets, so bracketed keys may contain "=".
+func parseFieldUpdateFlag(flag string) (FieldUpdate, error) {
+	update := FieldUpdate{}
+
+	rest := flag
+	for _, target := range []string{FieldUpdateTargetMachine, FieldUpdateTargetInfrastructure} {
+		if strings.HasPrefix(rest, target+":") {
+			update.Target = target
+			rest = strings.TrimPrefix(rest, target+":")
+			break
+		}
+	}
+
+	depth, split := 0, -1
+	for i, c := range rest {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case '=':
+			if depth == 0 && split < 0 {
+				split = i
+			}
+		}
+	}
+	if split <= 0 {
+		return update, errors.Errorf("invalid field update %q, must be [target:]path=value", flag)
+	}
+
+	update.Path = rest[:split]
+	value, err := yaml.YAMLToJSON([]byte(rest[split+1:]))
+	if err != nil {
+		return update, errors.Wrapf(err, "invalid value in field update %q", flag)
+	}
+	update.Value = value
+
+	return update, update.validate()
+}
+
+// loadFieldUpdates returns the configured field updates, followed by the ones in the field updates file and the
+// ones set with flags.
+func loadFieldUpdates(config MachineUpdateConfig) ([]FieldUpdate, error) {
+	updates := append([]FieldUpdate{}, config.FieldUpdates...)
+
+	if config.FieldUpdatesFile != "" {
+		raw, err := ioutil.ReadFile(config.FieldUpdatesFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading field updates")
+		}
+		var fromFile []FieldUpdate
+		if err := yaml.UnmarshalStrict(raw, &fromFile); err != nil {
+			return nil, errors.Wrapf(err, "error parsing field updates %s", config.FieldUpdatesFile)
+		}
+		updates = append(updates, fromFile...)
+	}
+
+	for _, update := range updates {
+		if err := update.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, flag := range config.Set {
+		update, err := parseFieldUpdateFlag(flag)
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, update)
+	}
+
+	return updates, nil
+}
+
+// hasFieldUpdates returns true if any of updates applies to target.
+func hasFieldUpdates(updates []FieldUpdate, target string) bool {
+	for _, update := range updates {
+		if update.target() == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestParseFieldPath(t *testing.T) {
+	testcases := []struct {
+		path          string
+		expected      []fieldPathSegment
+		expectedError bool
+	}{
+		{
+			path:     "spec.ami.id",
+			expected: []fieldPathSegment{{key: "spec", isKey: true}, {key: "ami", isKey: true}, {key: "id", isKey: true}},
+		},
+		{
+			path:     "$.spec.securityGroups[1].id",
+			expected: []fieldPathSegment{{key: "spec", isKey: true}, {key: "securityGroups", isKey: true}, {index: 1}, {key: "id", isKey: true}},
+		},
+		{
+			path:     `spec.tags['kubernetes.io/role'].value`,
+			expected: []fieldPathSegment{{key: "spec", isKey: true}, {key: "tags", isKey: true}, {key: "kubernetes.io/role", isKey: true}, {key: "value", isKey: true}},
+		},
+		{
+			path:     `.labels["a.b"]`,
+			expected: []fieldPathSegment{{key: "labels", isKey: true}, {key: "a.b", isKey: true}},
+		},
+		{path: "", expectedError: true},
+		{path: "spec..id", expectedError: true},
+		{path: "spec.", expectedError: true},
+		{path: "spec.list[-1]", expectedError: true},
+		{path: "spec.list[0", expectedError: true},
+		{path: "spec['key", expectedError: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.path, func(t *testing.T) {
+			segments, err := parseFieldPath(tc.path)
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, segments)
+		})
+	}
+}
+
+func TestApplyFieldUpdates(t *testing.T) {
+	object := func() map[string]interface{} {
+		return map[string]interface{}{
+			"spec": map[string]interface{}{
+				"template": map[string]interface{}{
+					"spec": map[string]interface{}{
+						"instanceType": "m5.large",
+						"additionalSecurityGroups": []interface{}{
+							map[string]interface{}{"id": "sg-1"},
+						},
+						"additionalTags": map[string]interface{}{"team": "infra"},
+					},
+				},
+			},
+		}
+	}
+
+	testcases := []struct {
+		name          string
+		updates       []FieldUpdate
+		expected      map[string]interface{}
+		expectedError bool
+	}{
+		{
+			name: "typed values and new objects",
+			updates: []FieldUpdate{
+				{Target: FieldUpdateTargetInfrastructure, Path: "spec.rootDeviceSize", Value: []byte(`100`)},
+				{Target: FieldUpdateTargetInfrastructure, Path: "spec.spotMarketOptions.enabled", Value: []byte(`true`)},
+				{Target: FieldUpdateTargetInfrastructure, Path: "spec.additionalSecurityGroups[0]", Value: []byte(`{"id":"sg-2"}`)},
+				{Target: FieldUpdateTargetInfrastructure, Path: "spec.additionalTags['example.com/owner']", Value: []byte(`"me"`)},
+				{Target: FieldUpdateTargetInfrastructure, Path: "spec.additionalTags.team", Op: "remove"},
+				{Path: "spec.ignored", Value: []byte(`"machine target"`)},
+			},
+			expected: map[string]interface{}{
+				"instanceType":             "m5.large",
+				"rootDeviceSize":           int64(100),
+				"spotMarketOptions":        map[string]interface{}{"enabled": true},
+				"additionalSecurityGroups": []interface{}{map[string]interface{}{"id": "sg-2"}},
+				"additionalTags":           map[string]interface{}{"example.com/owner": "me"},
+			},
+		},
+		{
+			name: "json patch",
+			updates: []FieldUpdate{
+				{Target: FieldUpdateTargetInfrastructure, Path: "/spec/additionalSecurityGroups/-", Value: []byte(`{"id":"sg-3"}`)},
+				{Target: FieldUpdateTargetInfrastructure, Path: "/spec/instanceType", Op: "replace", Value: []byte(`"m5.xlarge"`)},
+				{Target: FieldUpdateTargetInfrastructure, Path: "/spec/additionalTags", Op: "remove"},
+			},
+			expected: map[string]interface{}{
+				"instanceType": "m5.xlarge",
+				"additionalSecurityGroups": []interface{}{
+					map[string]interface{}{"id": "sg-1"},
+					map[string]interface{}{"id": "sg-3"},
+				},
+			},
+		},
+		{
+			name: "failed json patch test",
+			updates: []FieldUpdate{
+				{Target: FieldUpdateTargetInfrastructure, Path: "/spec/instanceType", Op: "test", Value: []byte(`"t3.small"`)},
+			},
+			expectedError: true,
+		},
+		{
+			name: "index out of range",
+			updates: []FieldUpdate{
+				{Target: FieldUpdateTargetInfrastructure, Path: "spec.additionalSecurityGroups[1].id", Value: []byte(`"sg-2"`)},
+			},
+			expectedError: true,
+		},
+		{
+			name: "key of a string",
+			updates: []FieldUpdate{
+				{Target: FieldUpdateTargetInfrastructure, Path: "spec.instanceType.size", Value: []byte(`"large"`)},
+			},
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			updated, err := applyFieldUpdates(object(), tc.updates, FieldUpdateTargetInfrastructure, "spec", "template")
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, updated["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"])
+		})
+	}
+}
+
+func TestUpdateMachineSpec(t *testing.T) {
+	spec := &clusterapiv1alpha2.MachineSpec{
+		InfrastructureRef: corev1.ObjectReference{Kind: "AWSMachine", Name: "foo"},
+	}
+
+	err := updateMachineSpec(spec, []FieldUpdate{
+		{Path: "infrastructureRef['name']", Value: []byte(`"bar"`)},
+		{Path: "/bootstrap/data", Value: []byte(`"Y2xvdWQtaW5pdA=="`)},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "bar", spec.InfrastructureRef.Name)
+	require.NotNil(t, spec.Bootstrap.Data)
+	assert.Equal(t, "Y2xvdWQtaW5pdA==", *spec.Bootstrap.Data)
+}
+
+func TestParseFieldUpdateFlag(t *testing.T) {
+	testcases := []struct {
+		flag          string
+		expected      FieldUpdate
+		expectedError bool
+	}{
+		{
+			flag:     "infrastructure:spec.rootDeviceSize=100",
+			expected: FieldUpdate{Target: FieldUpdateTargetInfrastructure, Path: "spec.rootDeviceSize", Value: []byte(`100`)},
+		},
+		{
+			flag:     "infrastructure:spec.additionalTags['a=b']=x=y",
+			expected: FieldUpdate{Target: FieldUpdateTargetInfrastructure, Path: "spec.additionalTags['a=b']", Value: []byte(`"x=y"`)},
+		},
+		{
+			flag:     "machine:/bootstrap/data={}",
+			expected: FieldUpdate{Target: FieldUpdateTargetMachine, Path: "/bootstrap/data", Value: []byte(`{}`)},
+		},
+		{
+			flag:     "failureDomain=us-east-1a",
+			expected: FieldUpdate{Path: "failureDomain", Value: []byte(`"us-east-1a"`)},
+		},
+		{flag: "spec.rootDeviceSize", expectedError: true},
+		{flag: "=1", expectedError: true},
+		{flag: "infra:spec..x=1", expectedError: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.flag, func(t *testing.T) {
+			update, err := parseFieldUpdateFlag(tc.flag)
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected.Target, update.Target)
+			assert.Equal(t, tc.expected.Path, update.Path)
+			assert.JSONEq(t, string(tc.expected.Value), string(update.Value))
+		})
+	}
+}
+
+func TestFieldUpdateValidate(t *testing.T) {
+	assert.NoError(t, FieldUpdate{Path: "spec.x", Value: []byte(`1`)}.validate())
+	assert.NoError(t, FieldUpdate{Path: "/spec/x", Op: "remove"}.validate())
+	assert.Error(t, FieldUpdate{Target: "bootstrap", Path: "spec.x", Value: []byte(`1`)}.validate())
+	assert.Error(t, FieldUpdate{Path: "/spec/x", Op: "set", Value: []byte(`1`)}.validate())
+	assert.Error(t, FieldUpdate{Path: "spec.x", Op: "replace", Value: []byte(`1`)}.validate())
+	assert.Error(t, FieldUpdate{Path: "spec.x"}.validate())
+}
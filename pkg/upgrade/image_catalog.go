@@ -0,0 +1,160 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+// ImageCatalog maps providers, regions, flavors and Kubernetes versions to machine images.
+type ImageCatalog struct {
+	Images []CatalogImage `json:"images"`
+}
+
+// CatalogImage is a machine image built for a Kubernetes version.
+type CatalogImage struct {
+	Provider string `json:"provider"`
+	// Region and Flavor are optional. An image without them matches any region or flavor.
+	Region            string `json:"region,omitempty"`
+	Flavor            string `json:"flavor,omitempty"`
+	KubernetesVersion string `json:"kubernetesVersion"`
+
+	// Field and InfrastructureField are optional if the provider knows the image field of its infrastructure
+	// machines.
+	ID                  string `json:"id"`
+	Field               string `json:"field,omitempty"`
+	InfrastructureField string `json:"infrastructureField,omitempty"`
+}
+
+func (i CatalogImage) String() string {
+	parts := []string{i.Provider}
+	for _, part := range []string{i.Region, i.Flavor} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(append(parts, i.KubernetesVersion, i.ID), "/")
+}
+
+// loadImageCatalog reads an image catalog in YAML or JSON and validates its images.
+func loadImageCatalog(path string) (*ImageCatalog, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading image catalog")
+	}
+
+	catalog := &ImageCatalog{}
+	if err := yaml.UnmarshalStrict(raw, catalog); err != nil {
+		return nil, errors.Wrapf(err, "error parsing image catalog %s", path)
+	}
+
+	if err := catalog.validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid image catalog %s", path)
+	}
+
+	return catalog, nil
+}
+
+func (c *ImageCatalog) validate() error {
+	for i, image := range c.Images {
+		if image.Provider == "" || image.ID == "" {
+			return errors.Errorf("image %d must have a provider and an id", i)
+		}
+		if _, err := semver.ParseTolerant(image.KubernetesVersion); err != nil {
+			return errors.Wrapf(err, "image %s has an invalid kubernetes version", image)
+		}
+	}
+	return nil
+}
+
+// resolve returns the only image of the catalog that matches provider, region, flavor and version. An empty region
+// or flavor matches any image.
+func (c *ImageCatalog) resolve(provider, region, flavor string, version semver.Version) (CatalogImage, error) {
+	var matches []CatalogImage
+	for _, image := range c.Images {
+		if image.Provider != provider ||
+			(region != "" && image.Region != "" && image.Region != region) ||
+			(flavor != "" && image.Flavor != "" && image.Flavor != flavor) {
+			continue
+		}
+		if v, _ := semver.ParseTolerant(image.KubernetesVersion); !v.EQ(version) {
+			continue
+		}
+		matches = append(matches, image)
+	}
+
+	switch len(matches) {
+	case 0:
+		return CatalogImage{}, errors.Errorf("no image in the catalog for provider %q, region %q, flavor %q and kubernetes version %s", provider, region, flavor, version)
+	case 1:
+		return matches[0], nil
+	default:
+		var names []string
+		for _, match := range matches {
+			names = append(names, match.String())
+		}
+		return CatalogImage{}, errors.Errorf("more than one image in the catalog matches, set a region or flavor: %s", strings.Join(names, ", "))
+	}
+}
+
+// checkImageVersion returns an error if the catalog lists the image id for a different Kubernetes version.
+func (c *ImageCatalog) checkImageVersion(id string, version semver.Version) error {
+	for _, image := range c.Images {
+		if image.ID != id {
+			continue
+		}
+		if v, _ := semver.ParseTolerant(image.KubernetesVersion); !v.EQ(version) {
+			return errors.Errorf("image %s is for kubernetes version %s, not %s", id, image.KubernetesVersion, version)
+		}
+	}
+	return nil
+}
+
+// resolveImage returns the image to use for the upgrade. Without a catalog that is the configured image. With a
+// catalog, an image id that is set is checked against the catalog, otherwise the id and fields are looked up in it.
+// Fields that are set in the configuration take precedence over the ones in the catalog.
+func resolveImage(config Config) (ImageUpdateConfig, error) {
+	image := config.MachineUpdates.Image
+	if image.Catalog == "" {
+		if image.Provider != "" || image.Region != "" || image.Flavor != "" {
+			return image, errors.New("image provider, region and flavor require an image catalog")
+		}
+		return image, nil
+	}
+
+	version, err := semver.ParseTolerant(config.KubernetesVersion)
+	if err != nil {
+		return image, errors.Errorf("Invalid Kubernetes version: %q", config.KubernetesVersion)
+	}
+
+	catalog, err := loadImageCatalog(image.Catalog)
+	if err != nil {
+		return image, err
+	}
+
+	if image.ID != "" {
+		return image, catalog.checkImageVersion(image.ID, version)
+	}
+
+	if image.Provider == "" {
+		return image, errors.New("image provider is required to look up an image in the catalog")
+	}
+
+	match, err := catalog.resolve(image.Provider, image.Region, image.Flavor, version)
+	if err != nil {
+		return image, err
+	}
+
+	image.ID = match.ID
+	if image.Field == "" && image.InfrastructureField == "" {
+		image.Field = match.Field
+		image.InfrastructureField = match.InfrastructureField
+	}
+	return image, nil
+}
@@ -0,0 +1,187 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testImageCatalog = `
+images:
+- provider: aws
+  region: us-east-1
+  flavor: ubuntu-18.04
+  kubernetesVersion: v1.15.3
+  id: ami-ubuntu-1153
+  infrastructureField: spec.ami.id
+- provider: aws
+  region: us-east-1
+  flavor: amazon-2
+  kubernetesVersion: v1.15.3
+  id: ami-amazon-1153
+  infrastructureField: spec.ami.id
+- provider: aws
+  region: us-east-1
+  flavor: ubuntu-18.04
+  kubernetesVersion: v1.14.6
+  id: ami-ubuntu-1146
+  infrastructureField: spec.ami.id
+- provider: docker
+  kubernetesVersion: v1.15.3
+  id: kindest/node:v1.15.3
+  infrastructureField: spec.customImage
+`
+
+func writeImageCatalog(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "image-catalog")
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, "catalog.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0600))
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestResolveImage(t *testing.T) {
+	path, cleanup := writeImageCatalog(t, testImageCatalog)
+	defer cleanup()
+
+	testcases := []struct {
+		name          string
+		version       string
+		image         ImageUpdateConfig
+		expected      ImageUpdateConfig
+		expectedError bool
+	}{
+		{
+			name:     "no catalog",
+			version:  "v1.15.3",
+			image:    ImageUpdateConfig{ID: "ami-manual", Field: "spec.providerSpec.value.ami.id"},
+			expected: ImageUpdateConfig{ID: "ami-manual", Field: "spec.providerSpec.value.ami.id"},
+		},
+		{
+			name:          "provider without catalog",
+			version:       "v1.15.3",
+			image:         ImageUpdateConfig{Provider: "aws"},
+			expectedError: true,
+		},
+		{
+			name:    "provider, region, flavor and version",
+			version: "1.15.3",
+			image:   ImageUpdateConfig{Catalog: path, Provider: "aws", Region: "us-east-1", Flavor: "ubuntu-18.04"},
+			expected: ImageUpdateConfig{Catalog: path, Provider: "aws", Region: "us-east-1", Flavor: "ubuntu-18.04",
+				ID: "ami-ubuntu-1153", InfrastructureField: "spec.ami.id"},
+		},
+		{
+			name:    "image without region and flavor matches any",
+			version: "v1.15.3",
+			image:   ImageUpdateConfig{Catalog: path, Provider: "docker", Region: "local"},
+			expected: ImageUpdateConfig{Catalog: path, Provider: "docker", Region: "local",
+				ID: "kindest/node:v1.15.3", InfrastructureField: "spec.customImage"},
+		},
+		{
+			name:    "configured field takes precedence",
+			version: "v1.14.6",
+			image:   ImageUpdateConfig{Catalog: path, Provider: "aws", Flavor: "ubuntu-18.04", Field: "spec.providerSpec.value.ami.id"},
+			expected: ImageUpdateConfig{Catalog: path, Provider: "aws", Flavor: "ubuntu-18.04",
+				ID: "ami-ubuntu-1146", Field: "spec.providerSpec.value.ami.id"},
+		},
+		{
+			name:          "ambiguous",
+			version:       "v1.15.3",
+			image:         ImageUpdateConfig{Catalog: path, Provider: "aws"},
+			expectedError: true,
+		},
+		{
+			name:          "no image for version",
+			version:       "v1.16.0",
+			image:         ImageUpdateConfig{Catalog: path, Provider: "aws", Flavor: "ubuntu-18.04"},
+			expectedError: true,
+		},
+		{
+			name:          "no provider",
+			version:       "v1.15.3",
+			image:         ImageUpdateConfig{Catalog: path},
+			expectedError: true,
+		},
+		{
+			name:     "image id matching the catalog version",
+			version:  "v1.14.6",
+			image:    ImageUpdateConfig{Catalog: path, ID: "ami-ubuntu-1146", InfrastructureField: "spec.ami.id"},
+			expected: ImageUpdateConfig{Catalog: path, ID: "ami-ubuntu-1146", InfrastructureField: "spec.ami.id"},
+		},
+		{
+			name:          "image id for another version",
+			version:       "v1.15.3",
+			image:         ImageUpdateConfig{Catalog: path, ID: "ami-ubuntu-1146", InfrastructureField: "spec.ami.id"},
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{KubernetesVersion: tc.version, MachineUpdates: MachineUpdateConfig{Image: tc.image}}
+
+			image, err := resolveImage(config)
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, image)
+		})
+	}
+}
+
+func TestLoadImageCatalogValidation(t *testing.T) {
+	testcases := []struct {
+		name    string
+		catalog string
+	}{
+		{
+			name: "missing id",
+			catalog: `
+images:
+- provider: aws
+  kubernetesVersion: v1.15.3
+  field: spec.ami.id
+`,
+		},
+		{
+			name: "invalid kubernetes version",
+			catalog: `
+images:
+- provider: aws
+  kubernetesVersion: latest
+  id: ami-123
+  field: spec.ami.id
+`,
+		},
+		{
+			name: "unknown key",
+			catalog: `
+images:
+- provider: aws
+  kubernetesVersion: v1.15.3
+  ami: ami-123
+  field: spec.ami.id
+`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			path, cleanup := writeImageCatalog(t, tc.catalog)
+			defer cleanup()
+
+			_, err := loadImageCatalog(path)
+			assert.Error(t, err)
+		})
+	}
+}
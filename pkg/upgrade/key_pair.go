@@ -4,7 +4,11 @@
 package upgrade
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"io/ioutil"
+	"net/http"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -12,11 +16,11 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
 	"sigs.k8s.io/cluster-api/util/certs"
-	"sigs.k8s.io/cluster-api/util/kubeconfig"
 )
 
 // kubeconfigSecretKey is the key where the kubeconfig is stored in the secret.
@@ -49,17 +53,44 @@ func NewRestConfigFromKubeconfigSecretRef(secrets secrets, name string) (*rest.C
 	return cfg, errors.WithStack(err)
 }
 
+// NewRestConfigFromKubeconfigFile builds a *rest.Config with the kubeconfig at path. Relative paths in the kubeconfig
+// are resolved against its directory.
+func NewRestConfigFromKubeconfigFile(path string) (*rest.Config, error) {
+	cfg, err := clientcmd.BuildConfigFromFlags("", path)
+	return cfg, errors.Wrapf(err, "error loading target cluster kubeconfig %q", path)
+}
+
+// NewRestConfigFromCAFiles reads the PEM encoded CA key pair from certFile and keyFile and builds a *rest.Config with
+// them.
+func NewRestConfigFromCAFiles(certFile, keyFile, apiEndpoint string, identity ClientCertificate) (*rest.Config, error) {
+	cert, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading CA cert file")
+	}
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading CA key file")
+	}
+
+	return restConfigFromKeyPair(apiEndpoint, &keyPair{Cert: cert, Key: key}, identity)
+}
+
 // NewRestConfigFromCAClusterField returns a rest.Config configured with the CA key pair found in the cluster's
 // object in the fieldpath specified. For example, "spec.providerSpec.value.caKeyPair" traverses the cluster
 // object going through each '.' delimited field.
-func NewRestConfigFromCAClusterField(cluster *clusterapiv1alpha2.Cluster, fieldPath, apiEndpoint string) (*rest.Config, error) {
-	pathParts := strings.Split(fieldPath, ".")
-	certPath := append(pathParts, "cert")
+func NewRestConfigFromCAClusterField(cluster *clusterapiv1alpha2.Cluster, fieldPath, apiEndpoint string, identity ClientCertificate) (*rest.Config, error) {
 	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(cluster)
 	if err != nil {
 		return nil, errors.Wrap(err, "error converting cluster to unstructured")
 	}
-	certEncoded, found, err := unstructured.NestedString(u, certPath...)
+	return restConfigFromCAField(u, fieldPath, apiEndpoint, identity)
+}
+
+// restConfigFromCAField builds a *rest.Config with the base64 encoded CA key pair found in the fieldpath of object.
+func restConfigFromCAField(object map[string]interface{}, fieldPath, apiEndpoint string, identity ClientCertificate) (*rest.Config, error) {
+	pathParts := strings.Split(fieldPath, ".")
+	certPath := append(pathParts, "cert")
+	certEncoded, found, err := unstructured.NestedString(object, certPath...)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to extract key pair cert from %q", strings.Join(certPath, "."))
 	}
@@ -72,7 +103,7 @@ func NewRestConfigFromCAClusterField(cluster *clusterapiv1alpha2.Cluster, fieldP
 	}
 
 	keyPath := append(pathParts, "key")
-	keyEncoded, found, err := unstructured.NestedString(u, keyPath...)
+	keyEncoded, found, err := unstructured.NestedString(object, keyPath...)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to extract key pair key from %q", strings.Join(keyPath, "."))
 	}
@@ -87,11 +118,11 @@ func NewRestConfigFromCAClusterField(cluster *clusterapiv1alpha2.Cluster, fieldP
 		Cert: cert,
 		Key:  key,
 	}
-	return restConfigFromKeyPair(cluster.GetName(), apiEndpoint, kp)
+	return restConfigFromKeyPair(apiEndpoint, kp, identity)
 }
 
 // NewRestConfigFromCASecretRef gets the CA key pair from the secret and builds a *rest.Config with them.
-func NewRestConfigFromCASecretRef(secretClient secrets, name, clusterName, apiEndpoint string) (*rest.Config, error) {
+func NewRestConfigFromCASecretRef(secretClient secrets, name, apiEndpoint string, identity ClientCertificate) (*rest.Config, error) {
 	secret, err := secretClient.Get(name, metav1.GetOptions{})
 	if err != nil {
 		return nil, errors.Wrap(err, "error retrieving key pair secret ref")
@@ -119,42 +150,64 @@ func NewRestConfigFromCASecretRef(secretClient secrets, name, clusterName, apiEn
 		Cert: cert,
 		Key:  key,
 	}
-	return restConfigFromKeyPair(clusterName, apiEndpoint, kp)
+	return restConfigFromKeyPair(apiEndpoint, kp, identity)
+}
+
+// NewRestConfigFromCATLSSecret gets the CA key pair from a secret of type kubernetes.io/tls, the way Cluster API stores
+// it in the <cluster>-ca secret, and builds a *rest.Config with them. The tls.crt and tls.key entries are PEM, so
+// unlike with NewRestConfigFromCASecretRef there's nothing left to decode.
+func NewRestConfigFromCATLSSecret(secretClient secrets, name, apiEndpoint string, identity ClientCertificate) (*rest.Config, error) {
+	secret, err := secretClient.Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error retrieving CA secret %q", name)
+	}
+
+	cert, ok := secret.Data[v1.TLSCertKey]
+	if !ok {
+		return nil, errors.Errorf("unable to find %s in CA secret %q", v1.TLSCertKey, name)
+	}
+	key, ok := secret.Data[v1.TLSPrivateKeyKey]
+	if !ok {
+		return nil, errors.Errorf("unable to find %s in CA secret %q", v1.TLSPrivateKeyKey, name)
+	}
+
+	return restConfigFromKeyPair(apiEndpoint, &keyPair{Cert: cert, Key: key}, identity)
 }
 
-func restConfigFromKeyPair(clusterName, url string, keyPair *keyPair) (*rest.Config, error) {
-	// Borrowed from CAPA
-	cert, err := certs.DecodeCertPEM(keyPair.Cert)
+// restConfigFromKeyPair builds a *rest.Config whose transport issues client certificates for identity from the CA key
+// pair, so the target cluster sees requests from identity rather than from a long-lived admin. The certificate is
+// reissued before it expires.
+func restConfigFromKeyPair(url string, keyPair *keyPair, identity ClientCertificate) (*rest.Config, error) {
+	caCert, err := certs.DecodeCertPEM(keyPair.Cert)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to decode CA Cert")
-	} else if cert == nil {
+	} else if caCert == nil {
 		return nil, errors.New("certificate not found in config")
 	}
 
-	key, err := certs.DecodePrivateKeyPEM(keyPair.Key)
+	caKey, err := certs.DecodePrivateKeyPEM(keyPair.Key)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to decode private key")
-	} else if key == nil {
+	} else if caKey == nil {
 		return nil, errors.New("key not found in status")
 	}
 
-	cfg, err := kubeconfig.New(clusterName, url, cert, key)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to generate a kubeconfig")
-	}
-	// End borrowed
-
-	// TODO see if we can avoid going to yaml and back
-	kubeConfigYaml, err := clientcmd.Write(*cfg)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to serialize a kubeconfig")
+	// Issue the first certificate right away so a CA key pair that can't sign fails here
+	issuer := newClientCertificateIssuer(identity, caCert, caKey)
+	if _, err := issuer.GetClientCertificate(nil); err != nil {
+		return nil, err
 	}
 
-	// targetRestConfig, err := common.NewRestConfig(config.TargetCluster.Kubeconfig, "")
-	restConfig, err := clientcmd.RESTConfigFromKubeConfig(kubeConfigYaml)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to get a rest config from kubeconfig")
-	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
 
-	return restConfig, nil
+	return &rest.Config{
+		Host: url,
+		Transport: utilnet.SetTransportDefaults(&http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:              roots,
+				GetClientCertificate: issuer.GetClientCertificate,
+			},
+		}),
+	}, nil
 }
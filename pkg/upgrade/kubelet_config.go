@@ -0,0 +1,187 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func isMinorVersionUpgrade(base, update semver.Version) bool {
+	return base.Major == update.Major && base.Minor < update.Minor
+}
+
+// updateKubeletConfigIfNeeded makes sure the kubelet configmap and RBAC rules for the desired version exist before
+// any node is upgraded from the current version to a new minor version. Both the control plane and the worker
+// upgrades need them, because kubeadm join reads the configmap of the version it installs.
+func (u *base) updateKubeletConfigIfNeeded(current semver.Version) error {
+	if !isMinorVersionUpgrade(current, u.desiredVersion) {
+		return nil
+	}
+
+	u.log.Info("Updating kubelet config ConfigMap", "version", u.desiredVersion.String())
+	if err := u.updateKubeletConfigMapIfNeeded(u.desiredVersion); err != nil {
+		return err
+	}
+
+	u.log.Info("Updating kubelet config RBAC rules", "version", u.desiredVersion.String())
+	return u.updateKubeletRbacIfNeeded(u.desiredVersion)
+}
+
+func (u *base) updateKubeletConfigMapIfNeeded(version semver.Version) error {
+	// Check if the desired configmap already exists
+	desiredKubeletConfigMapName := fmt.Sprintf("kubelet-config-%d.%d", version.Major, version.Minor)
+	_, err := u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Get(desiredKubeletConfigMapName, metav1.GetOptions{})
+	if err == nil {
+		u.log.Info("kubelet configmap already exists", "configMapName", desiredKubeletConfigMapName)
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error determining if configmap %s exists", desiredKubeletConfigMapName)
+	}
+
+	// If we get here, we have to make the configmap
+	previousMinorVersionKubeletConfigMapName := fmt.Sprintf("kubelet-config-%d.%d", version.Major, version.Minor-1)
+	cm, err := u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Get(previousMinorVersionKubeletConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return errors.Errorf("unable to find current kubelet configmap %s", previousMinorVersionKubeletConfigMapName)
+	}
+	cm.Name = desiredKubeletConfigMapName
+	cm.ResourceVersion = ""
+
+	_, err = u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Create(cm)
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "error creating configmap %s", desiredKubeletConfigMapName)
+	}
+
+	return nil
+}
+
+func (u *base) updateKubeletRbacIfNeeded(version semver.Version) error {
+	majorMinor := fmt.Sprintf("%d.%d", version.Major, version.Minor)
+	roleName := fmt.Sprintf("kubeadm:kubelet-config-%s", majorMinor)
+
+	_, err := u.targetKubernetesClient.RbacV1().Roles("kube-system").Get(roleName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		newRole := &rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "kube-system",
+				Name:      roleName,
+			},
+			Rules: []rbacv1.PolicyRule{
+				{
+					Verbs:         []string{"get"},
+					APIGroups:     []string{""},
+					Resources:     []string{"configmaps"},
+					ResourceNames: []string{fmt.Sprintf("kubelet-config-%s", majorMinor)},
+				},
+			},
+		}
+
+		_, err := u.targetKubernetesClient.RbacV1().Roles("kube-system").Create(newRole)
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			return errors.Wrapf(err, "error creating role %s", roleName)
+		}
+	} else if err != nil {
+		return errors.Wrapf(err, "error determining if role %s exists", roleName)
+	}
+
+	_, err = u.targetKubernetesClient.RbacV1().RoleBindings("kube-system").Get(roleName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		newRoleBinding := &rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "kube-system",
+				Name:      roleName,
+			},
+			Subjects: []rbacv1.Subject{
+				{
+					APIGroup: "rbac.authorization.k8s.io",
+					Kind:     "Group",
+					Name:     "system:nodes",
+				},
+				{
+					APIGroup: "rbac.authorization.k8s.io",
+					Kind:     "Group",
+					Name:     "system:bootstrappers:kubeadm:default-node-token",
+				},
+			},
+			RoleRef: rbacv1.RoleRef{
+				APIGroup: "rbac.authorization.k8s.io",
+				Kind:     "Role",
+				Name:     roleName,
+			},
+		}
+
+		_, err = u.targetKubernetesClient.RbacV1().RoleBindings("kube-system").Create(newRoleBinding)
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			return errors.Wrapf(err, "error creating rolebinding %s", roleName)
+		}
+	} else if err != nil {
+		return errors.Wrapf(err, "error determining if rolebinding %s exists", roleName)
+	}
+
+	return nil
+}
+
+// cleanupPreviousKubeletConfigIfNeeded deletes the kubelet configmap, role and rolebinding of the minor version
+// before the desired one, once no node runs a kubelet of that version anymore.
+func (u *base) cleanupPreviousKubeletConfigIfNeeded() error {
+	if !u.cleanupKubeletConfig || u.desiredVersion.Minor == 0 {
+		return nil
+	}
+
+	previous := semver.Version{Major: u.desiredVersion.Major, Minor: u.desiredVersion.Minor - 1}
+	majorMinor := fmt.Sprintf("%d.%d", previous.Major, previous.Minor)
+
+	nodes, err := u.targetKubernetesClient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "error listing nodes")
+	}
+
+	if names := nodesRunningMinorVersion(nodes.Items, previous); len(names) > 0 {
+		u.log.Info("Not cleaning up kubelet config, nodes still run the previous version", "version", majorMinor, "nodes", names)
+		return nil
+	}
+
+	configMapName := fmt.Sprintf("kubelet-config-%s", majorMinor)
+	roleName := fmt.Sprintf("kubeadm:kubelet-config-%s", majorMinor)
+
+	u.log.Info("Deleting kubelet config of the previous version", "configMapName", configMapName, "roleName", roleName)
+
+	err = u.targetKubernetesClient.CoreV1().ConfigMaps("kube-system").Delete(configMapName, &metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error deleting configmap %s", configMapName)
+	}
+
+	err = u.targetKubernetesClient.RbacV1().RoleBindings("kube-system").Delete(roleName, &metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error deleting rolebinding %s", roleName)
+	}
+
+	err = u.targetKubernetesClient.RbacV1().Roles("kube-system").Delete(roleName, &metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error deleting role %s", roleName)
+	}
+
+	return nil
+}
+
+// nodesRunningMinorVersion returns the names of the nodes whose kubelet runs the major and minor version of version.
+// Nodes with a kubelet version that can't be parsed are included, to be on the safe side.
+func nodesRunningMinorVersion(nodes []v1.Node, version semver.Version) []string {
+	var names []string
+	for _, node := range nodes {
+		kubeletVersion, err := semver.ParseTolerant(node.Status.NodeInfo.KubeletVersion)
+		if err != nil || (kubeletVersion.Major == version.Major && kubeletVersion.Minor == version.Minor) {
+			names = append(names, node.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func node(name, kubeletVersion string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			NodeInfo: v1.NodeSystemInfo{KubeletVersion: kubeletVersion},
+		},
+	}
+}
+
+func TestNodesRunningMinorVersion(t *testing.T) {
+	nodes := []v1.Node{
+		*node("old", "v1.14.3"),
+		*node("new", "v1.15.0"),
+		*node("unknown", "garbage"),
+	}
+
+	assert.Equal(t, []string{"old", "unknown"}, nodesRunningMinorVersion(nodes, semver.MustParse("1.14.0")))
+}
+
+func TestCleanupPreviousKubeletConfigIfNeeded(t *testing.T) {
+	previousObjects := func() []runtime.Object {
+		return []runtime.Object{
+			&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "kubelet-config-1.14"}},
+			&rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "kubeadm:kubelet-config-1.14"}},
+			&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "kubeadm:kubelet-config-1.14"}},
+		}
+	}
+
+	testcases := []struct {
+		name          string
+		nodes         []runtime.Object
+		expectDeleted bool
+	}{
+		{
+			name:          "all nodes upgraded",
+			nodes:         []runtime.Object{node("a", "v1.15.0"), node("b", "v1.15.0")},
+			expectDeleted: true,
+		},
+		{
+			name:          "a node still runs the previous version",
+			nodes:         []runtime.Object{node("a", "v1.15.0"), node("b", "v1.14.3")},
+			expectDeleted: false,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := kubefake.NewSimpleClientset(append(previousObjects(), tc.nodes...)...)
+			u := &base{
+				log:                    testLogger(),
+				desiredVersion:         semver.MustParse("1.15.0"),
+				targetKubernetesClient: client,
+				cleanupKubeletConfig:   true,
+			}
+
+			require.NoError(t, u.cleanupPreviousKubeletConfigIfNeeded())
+
+			configMaps, err := client.CoreV1().ConfigMaps("kube-system").List(metav1.ListOptions{})
+			require.NoError(t, err)
+			roles, err := client.RbacV1().Roles("kube-system").List(metav1.ListOptions{})
+			require.NoError(t, err)
+			roleBindings, err := client.RbacV1().RoleBindings("kube-system").List(metav1.ListOptions{})
+			require.NoError(t, err)
+
+			if tc.expectDeleted {
+				assert.Empty(t, configMaps.Items)
+				assert.Empty(t, roles.Items)
+				assert.Empty(t, roleBindings.Items)
+			} else {
+				assert.Len(t, configMaps.Items, 1)
+				assert.Len(t, roles.Items, 1)
+				assert.Len(t, roleBindings.Items, 1)
+			}
+		})
+	}
+}
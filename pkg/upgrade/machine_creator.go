@@ -18,10 +18,13 @@ import (
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
 	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
-	"sigs.k8s.io/cluster-api/controllers/noderefutil"
+	"sigs.k8s.io/cluster-api/controllers/external"
 	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// ControlPlaneComponents are the static pods that have to be ready on a new control plane node.
+var ControlPlaneComponents = []string{"etcd", "kube-apiserver", "kube-scheduler", "kube-controller-manager"}
+
 type podGetter interface {
 	Get(string, metav1.GetOptions) (*v1.Pod, error)
 }
@@ -55,6 +58,7 @@ type MachineOptions struct {
 	ImageID        string
 	ImageField     string
 	DesiredVersion semver.Version
+	FieldUpdates   []FieldUpdate
 }
 
 // MachineCreator is responsible for creating a new machine.
@@ -64,6 +68,7 @@ type MachineCreator struct {
 	shouldWaitForMatchingNode bool
 	shouldWaitForNodeReady    bool
 	MachineOptions            MachineOptions
+	components                []string
 	ctrlclient                ctrlclient.Client
 
 	providerIDTimeout   time.Duration
@@ -86,6 +91,7 @@ func NewMachineCreator(options ...MachineCreatorOption) *MachineCreator {
 		shouldWaitForMatchingNode: true,
 		shouldWaitForProviderID:   true,
 		shouldWaitForNodeReady:    true,
+		components:                ControlPlaneComponents,
 	}
 	for _, fn := range options {
 		fn(creator)
@@ -115,23 +121,37 @@ func (n *MachineCreator) NewMachine(name string, source *clusterapiv1alpha2.Mach
 		}
 	}
 
+	if hasFieldUpdates(n.MachineOptions.FieldUpdates, FieldUpdateTargetMachine) {
+		if err := updateMachineSpec(&newMachine.Spec, n.MachineOptions.FieldUpdates); err != nil {
+			return nil, nil, err
+		}
+	}
+
 	desiredVersion := n.MachineOptions.DesiredVersion.String()
 	newMachine.Spec.Version = &desiredVersion
 
 	n.log.Info("Creating new machine", "name", newMachine.Name)
 
 	err := n.ctrlclient.Create(context.TODO(), newMachine)
+	if apierrors.IsAlreadyExists(err) {
+		newMachine, err = n.existingReplacement(newMachine)
+	}
 	if err != nil {
 		return nil, nil, errors.Wrapf(err, "Error creating machine: %s", newMachine.Name)
 	}
 
+	provider := providerForKind(newMachine.Spec.InfrastructureRef.Kind)
+
 	if n.shouldWaitForProviderID {
 		providerID, err := n.waitForProviderID(newMachine.Namespace, newMachine.Name, n.providerIDTimeout)
 		if err != nil {
 			return nil, nil, err
 		}
+		if err := n.waitForInfrastructureReady(provider, &newMachine.Spec.InfrastructureRef, n.providerIDTimeout); err != nil {
+			return nil, nil, err
+		}
 		if n.shouldWaitForMatchingNode {
-			node, err := n.waitForMatchingNode(providerID, n.matchingNodeTimeout)
+			node, err := n.waitForMatchingNode(provider, providerID, n.matchingNodeTimeout)
 			if err != nil {
 				return nil, nil, err
 			}
@@ -152,6 +172,23 @@ func (n *MachineCreator) NewMachine(name string, source *clusterapiv1alpha2.Mach
 	return newMachine, nil, nil
 }
 
+// existingReplacement returns the machine called like desired if the same upgrade created it to replace the same
+// machine, so a rerun waits for it instead of failing.
+func (n *MachineCreator) existingReplacement(desired *clusterapiv1alpha2.Machine) (*clusterapiv1alpha2.Machine, error) {
+	existing := &clusterapiv1alpha2.Machine{}
+	key := ctrlclient.ObjectKey{Namespace: desired.Namespace, Name: desired.Name}
+	if err := n.ctrlclient.Get(context.TODO(), key, existing); err != nil {
+		return desired, err
+	}
+
+	if !createdFor(existing, desired.Labels[UpgradeIDLabelKey], desired.Annotations[ReplacesAnnotationKey]) {
+		return desired, errors.New("a machine with the same name already exists")
+	}
+
+	n.log.Info("Machine already exists, waiting for it", "name", existing.Name)
+	return existing, nil
+}
+
 func (n *MachineCreator) waitForProviderID(ns, name string, timeout time.Duration) (string, error) {
 	n.log.Info("waitForMachineProviderID start", "namespace", ns, "name", name)
 	var providerID string
@@ -179,10 +216,38 @@ func (n *MachineCreator) waitForProviderID(ns, name string, timeout time.Duratio
 	return providerID, nil
 }
 
-func (n *MachineCreator) waitForMatchingNode(rawProviderID string, timeout time.Duration) (*v1.Node, error) {
+// waitForInfrastructureReady waits for the provider to report the infrastructure machine ref refers to as ready.
+func (n *MachineCreator) waitForInfrastructureReady(provider Provider, ref *v1.ObjectReference, timeout time.Duration) error {
+	if ref.Name == "" {
+		return nil
+	}
+
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = n.namespace
+	}
+
+	n.log.Info("Waiting for infrastructure to be ready", "kind", ref.Kind, "name", ref.Name)
+	err := wait.PollImmediate(5*time.Second, timeout, func() (bool, error) {
+		infraMachine, err := external.Get(n.ctrlclient, ref, namespace)
+		if err != nil {
+			n.log.Error(err, "Error getting infrastructure machine", "kind", ref.Kind, "name", ref.Name)
+			return false, nil
+		}
+		return provider.InfrastructureReady(infraMachine), nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "timed out waiting for %s %s to be ready", ref.Kind, ref.Name)
+	}
+	return nil
+}
+
+// waitForMatchingNode waits for a node with the same instance ID as rawProviderID. Nodes whose provider ID doesn't
+// belong to the provider are skipped.
+func (n *MachineCreator) waitForMatchingNode(provider Provider, rawProviderID string, timeout time.Duration) (*v1.Node, error) {
 	n.log.Info("Waiting for node", "provider-id", rawProviderID)
 	var matchingNode v1.Node
-	providerID, err := noderefutil.NewProviderID(rawProviderID)
+	instanceID, err := provider.InstanceID(rawProviderID)
 	if err != nil {
 		return nil, err
 	}
@@ -193,12 +258,11 @@ func (n *MachineCreator) waitForMatchingNode(rawProviderID string, timeout time.
 			return false, err
 		}
 		for _, node := range nodes.Items {
-			// TODO(chuckha) Update to use noderefutil.Equals when we use a more recent cluster-api
-			nodeID, err := noderefutil.NewProviderID(node.Spec.ProviderID)
+			nodeID, err := provider.InstanceID(node.Spec.ProviderID)
 			if err != nil {
-				return false, err
+				continue
 			}
-			if providerID.Equals(nodeID) {
+			if nodeID == instanceID {
 				n.log.Info("Found node", "name", node.Name)
 				matchingNode = node
 				return true, nil
@@ -214,6 +278,17 @@ func (n *MachineCreator) waitForMatchingNode(rawProviderID string, timeout time.
 }
 
 func (n *MachineCreator) waitForNodeReady(newNode *v1.Node, timeout time.Duration) error {
+	// without components to check, a node is ready when the kubelet says so
+	if len(n.components) == 0 {
+		err := wait.PollImmediate(15*time.Second, timeout, func() (bool, error) {
+			return n.isNodeReady(newNode.Name), nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "node %s is not ready", newNode.Name)
+		}
+		return nil
+	}
+
 	// wait for NodeReady
 	nodeHostname := hostnameForNode(newNode)
 	if nodeHostname == "" {
@@ -233,10 +308,9 @@ func (n *MachineCreator) waitForNodeReady(newNode *v1.Node, timeout time.Duratio
 func (n *MachineCreator) isReady(nodeHostname string) bool {
 	n.log.Info("Component health check for node", "hostname", nodeHostname)
 
-	components := []string{"etcd", "kube-apiserver", "kube-scheduler", "kube-controller-manager"}
 	requiredConditions := sets.NewString("PodScheduled", "Initialized", "Ready", "ContainersReady")
 
-	for _, component := range components {
+	for _, component := range n.components {
 		foundConditions := sets.NewString()
 
 		podName := fmt.Sprintf("%s-%v", component, nodeHostname)
@@ -269,6 +343,32 @@ func (n *MachineCreator) isReady(nodeHostname string) bool {
 	return true
 }
 
+func (n *MachineCreator) isNodeReady(name string) bool {
+	n.log.Info("Node health check", "node", name)
+
+	nodes, err := n.nodeLister.List(metav1.ListOptions{})
+	if err != nil {
+		n.log.Error(err, "error listing nodes")
+		return false
+	}
+
+	for _, node := range nodes.Items {
+		if node.Name != name {
+			continue
+		}
+		for _, condition := range node.Status.Conditions {
+			if condition.Type == v1.NodeReady && condition.Status == v1.ConditionTrue {
+				return true
+			}
+		}
+		n.log.Info("Node is not ready yet", "node", name)
+		return false
+	}
+
+	n.log.Info("Node not found", "node", name)
+	return false
+}
+
 // MachineCreatorOptions are the functional options for the MachineCreator.
 type MachineCreatorOption func(*MachineCreator)
 
@@ -293,6 +393,14 @@ func ShouldWaitForNodeReady(should bool) MachineCreatorOption {
 	}
 }
 
+// WithComponents sets the static pods that have to be ready on the new node. If no components are given, the
+// MachineCreator waits for the node's Ready condition instead, which is what worker nodes need.
+func WithComponents(components ...string) MachineCreatorOption {
+	return func(n *MachineCreator) {
+		n.components = components
+	}
+}
+
 func WithPodGetter(pg podGetter) MachineCreatorOption {
 	return func(n *MachineCreator) {
 		n.podGetter = pg
@@ -154,3 +154,62 @@ func TestNewMachine(t *testing.T) {
 		t.Fatal("node is nil?")
 	}
 }
+
+func TestNewMachineWorkerNodeReady(t *testing.T) {
+	providerID := "localhost:////my-worker-identifier"
+
+	scheme := runtime.NewScheme()
+	scheme.AddKnownTypes(
+		clusterapiv1alpha2.GroupVersion,
+		&clusterapiv1alpha2.Machine{},
+	)
+	fake := fake.NewFakeClientWithScheme(scheme)
+
+	mc := upgrade.NewMachineCreator(
+		upgrade.WithMachineGetter(&GetMachineMock{ctrlclient: fake, providerID: providerID}),
+		upgrade.WithControllerRuntimeClient(fake),
+		upgrade.WithLogger(&log{}),
+		upgrade.WithNamespace("test"),
+		upgrade.WithComponents(),
+		upgrade.WithNodeLister(&client{
+			nodes: &v1.NodeList{
+				Items: []v1.Node{
+					{
+						ObjectMeta: metav1.ObjectMeta{
+							Name: "my-worker",
+						},
+						Spec: v1.NodeSpec{
+							ProviderID: "localhost:///my-local-zone/my-worker-identifier",
+						},
+						Status: v1.NodeStatus{
+							Conditions: []v1.NodeCondition{
+								{
+									Type:   v1.NodeReady,
+									Status: v1.ConditionTrue,
+								},
+							},
+						},
+					},
+				},
+			},
+		}),
+		upgrade.WithMatchingNodeTimeout(5*time.Second),
+		upgrade.WithNodeReadyTimeout(10*time.Second),
+		upgrade.WithProviderIDTimeout(5*time.Second),
+	)
+	machineToReplace := &clusterapiv1alpha2.Machine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "testworker-one-replace",
+		},
+	}
+	out, node, err := mc.NewMachine("testworker-one-two", machineToReplace)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if out == nil {
+		t.Fatal("out machine is nil?")
+	}
+	if node == nil || node.Name != "my-worker" {
+		t.Fatalf("expected node my-worker, got %v", node)
+	}
+}
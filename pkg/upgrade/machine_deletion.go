@@ -0,0 +1,70 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DefaultMachineDeletionTimeout is how long to wait for a replaced machine to be deleted if no timeout is configured.
+const DefaultMachineDeletionTimeout = 15 * time.Minute
+
+// waitForMachineDeletion polls the machine until it is gone. If it is still around after timeout, the returned error
+// names the finalizers that are blocking its deletion.
+func (u *base) waitForMachineDeletion(machine *clusterapiv1alpha2.Machine, timeout time.Duration) error {
+	log := u.log.WithValues("namespace", machine.Namespace, "name", machine.Name)
+	log.Info("Waiting for machine to be deleted", "timeout", timeout)
+
+	var finalizers []string
+	err := wait.PollImmediate(10*time.Second, timeout, func() (bool, error) {
+		current := &clusterapiv1alpha2.Machine{}
+		err := u.ctrlClient.Get(context.TODO(), ctrlclient.ObjectKey{Namespace: machine.Namespace, Name: machine.Name}, current)
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "error getting machine %s/%s", machine.Namespace, machine.Name)
+		}
+
+		finalizers = current.Finalizers
+		log.Info("Machine still exists", "finalizers", strings.Join(finalizers, ","))
+		return false, nil
+	})
+
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("timed out after %s waiting for machine %s/%s to be deleted, blocked by finalizers [%s]",
+			timeout, machine.Namespace, machine.Name, strings.Join(finalizers, ", "))
+	}
+	return err
+}
+
+// deleteStaleNode removes the node of a deleted machine from the target cluster, in case the infrastructure
+// provider left it behind.
+func (u *base) deleteStaleNode(node *v1.Node) error {
+	_, err := u.targetKubernetesClient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error getting node %s", node.Name)
+	}
+
+	u.log.Info("Deleting node left behind by deleted machine", "node", node.Name)
+	err = u.targetKubernetesClient.CoreV1().Nodes().Delete(node.Name, &metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error deleting node %s", node.Name)
+	}
+
+	return nil
+}
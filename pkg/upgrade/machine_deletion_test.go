@@ -0,0 +1,61 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestWaitForMachineDeletion(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clusterapiv1alpha2.AddToScheme(scheme))
+
+	stuck := &clusterapiv1alpha2.Machine{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:  "default",
+			Name:       "stuck",
+			Finalizers: []string{clusterapiv1alpha2.MachineFinalizer},
+		},
+	}
+
+	u := &base{
+		log:        testLogger(),
+		ctrlClient: fake.NewFakeClientWithScheme(scheme, stuck),
+	}
+
+	err := u.waitForMachineDeletion(&clusterapiv1alpha2.Machine{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "gone"}}, time.Second)
+	assert.NoError(t, err)
+
+	err = u.waitForMachineDeletion(stuck, time.Millisecond)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), clusterapiv1alpha2.MachineFinalizer)
+}
+
+func TestDeleteStaleNode(t *testing.T) {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "old-node"}}
+	client := kubefake.NewSimpleClientset(node)
+
+	u := &base{
+		log:                    testLogger(),
+		targetKubernetesClient: client,
+	}
+
+	require.NoError(t, u.deleteStaleNode(node))
+	nodes, err := client.CoreV1().Nodes().List(metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, nodes.Items)
+
+	// deleting a node that is already gone is fine
+	assert.NoError(t, u.deleteStaleNode(node))
+}
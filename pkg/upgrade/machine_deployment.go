@@ -5,9 +5,17 @@ package upgrade
 
 import (
 	"context"
+	"strings"
+	"sync"
 
+	"github.com/blang/semver"
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
 	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
 	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -28,6 +36,10 @@ func NewMachineDeploymentUpgrader(log logr.Logger, config Config) (*MachineDeplo
 }
 
 func (u *MachineDeploymentUpgrader) Upgrade() error {
+	return u.explainForbidden(u.upgrade())
+}
+
+func (u *MachineDeploymentUpgrader) upgrade() error {
 	machineDeployments, err := u.listMachineDeployments()
 	if err != nil {
 		return err
@@ -37,40 +49,226 @@ func (u *MachineDeploymentUpgrader) Upgrade() error {
 		return errors.New("Found 0 machine deployments")
 	}
 
-	return u.upgradeMachineDeployments(machineDeployments)
+	var refs []*v1.ObjectReference
+	for _, machineDeployment := range machineDeployments.Items {
+		refs = append(refs, templateRefs(machineDeployment.Spec.Template)...)
+	}
+	if err := u.rbacPreflight(MachineDeploymentScope, refs); err != nil {
+		return err
+	}
+
+	if err := u.checkWorkerVersionSkew(); err != nil {
+		return err
+	}
+
+	min, err := minMachineDeploymentVersion(machineDeployments)
+	if err != nil {
+		return errors.Wrap(err, "error determining current machine deployment versions")
+	}
+
+	if err := u.updateKubeletConfigIfNeeded(min); err != nil {
+		return err
+	}
+
+	if err := u.upgradeMachineDeployments(machineDeployments); err != nil {
+		return err
+	}
+
+	return u.cleanupPreviousKubeletConfigIfNeeded()
+}
+
+// minMachineDeploymentVersion returns the lowest version of all machine deployment templates.
+func minMachineDeploymentVersion(list *clusterapiv1alpha2.MachineDeploymentList) (semver.Version, error) {
+	var min semver.Version
+
+	for _, machineDeployment := range list.Items {
+		version := machineDeployment.Spec.Template.Spec.Version
+		if version == nil || *version == "" {
+			continue
+		}
+		v, err := semver.ParseTolerant(*version)
+		if err != nil {
+			return min, errors.Wrapf(err, "invalid version %q for machine deployment %s/%s", *version, machineDeployment.Namespace, machineDeployment.Name)
+		}
+		if min.EQ(unsetVersion) || v.LT(min) {
+			min = v
+		}
+	}
+
+	return min, nil
 }
 
 func (u *MachineDeploymentUpgrader) listMachineDeployments() (*clusterapiv1alpha2.MachineDeploymentList, error) {
-	u.log.Info("Listing machine deployments")
+	selector, err := machineDeploymentSelector(u.clusterName, u.machineDeploymentSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	u.log.Info("Listing machine deployments", "selector", selector.String(), "names", strings.Join(u.machineDeploymentNames, ","))
 
 	selectors := []ctrlclient.ListOption{
-		ctrlclient.MatchingLabels{
-			"cluster.k8s.io/cluster-name": u.clusterName,
-			"set":                         "node",
-		},
+		matchingSelector{selector},
 		ctrlclient.InNamespace(u.clusterNamespace),
 	}
 	list := &clusterapiv1alpha2.MachineDeploymentList{}
-	err := u.ctrlClient.List(context.TODO(), list, selectors...)
+	err = u.ctrlClient.List(context.TODO(), list, selectors...)
 	if err != nil {
 		return nil, errors.Wrap(err, "error listing machines")
 	}
 
+	if err := filterMachineDeploymentsByName(list, u.machineDeploymentNames); err != nil {
+		return nil, err
+	}
+
 	return list, nil
 }
 
-func (u *MachineDeploymentUpgrader) upgradeMachineDeployments(list *clusterapiv1alpha2.MachineDeploymentList) error {
+// machineDeploymentSelector returns a selector for the machine deployments of the cluster that also match
+// extraSelector, if it is set.
+func machineDeploymentSelector(clusterName, extraSelector string) (labels.Selector, error) {
+	selector, err := labels.Parse(extraSelector)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid machine deployment selector %q", extraSelector)
+	}
+
+	clusterRequirement, err := labels.NewRequirement(clusterapiv1alpha2.MachineClusterLabelName, selection.Equals, []string{clusterName})
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid cluster name %q", clusterName)
+	}
+
+	return selector.Add(*clusterRequirement), nil
+}
+
+// filterMachineDeploymentsByName keeps only the machine deployments named in names. It returns an error if any of
+// them wasn't found. An empty names keeps all of them.
+func filterMachineDeploymentsByName(list *clusterapiv1alpha2.MachineDeploymentList, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	wanted := sets.NewString(names...)
+	found := sets.NewString()
+	var items []clusterapiv1alpha2.MachineDeployment
 	for _, machineDeployment := range list.Items {
-		// Skip any machineDeployments that already have this upgrade annotation id
-		if val, ok := machineDeployment.Spec.Template.Annotations[UpgradeIDAnnotationKey]; ok && val == u.upgradeID {
-			continue
+		if wanted.Has(machineDeployment.Name) {
+			items = append(items, machineDeployment)
+			found.Insert(machineDeployment.Name)
+		}
+	}
+
+	if missing := wanted.Difference(found); missing.Len() > 0 {
+		return errors.Errorf("machine deployments not found in the cluster or not matching the selector: %s", strings.Join(missing.List(), ", "))
+	}
+
+	list.Items = items
+	return nil
+}
+
+// upgradeMachineDeployments upgrades the machine deployments in batches of at most maxConcurrentMachineDeployments.
+// Each batch has to finish rolling out before the next one starts.
+func (u *MachineDeploymentUpgrader) upgradeMachineDeployments(list *clusterapiv1alpha2.MachineDeploymentList) error {
+	machineDeployments := list.Items
+
+	if u.canary.MachineDeployment != "" {
+		var canary *clusterapiv1alpha2.MachineDeployment
+		var rest []clusterapiv1alpha2.MachineDeployment
+		for i := range machineDeployments {
+			if machineDeployments[i].Name == u.canary.MachineDeployment {
+				canary = &machineDeployments[i]
+				continue
+			}
+			rest = append(rest, machineDeployments[i])
+		}
+		if canary == nil {
+			return errors.Errorf("canary machine deployment %s not found among the machine deployments to upgrade", u.canary.MachineDeployment)
 		}
-		if err := u.updateMachineDeployment(&machineDeployment); err != nil {
+
+		if err := u.upgradeCanary(canary); err != nil {
+			return err
+		}
+		machineDeployments = rest
+	}
+
+	var summary [][]string
+	defer func() {
+		for i, names := range summary {
+			u.log.Info("MachineDeployment upgrade summary", "batch", i+1, "machine-deployments", strings.Join(names, ","))
+		}
+	}()
+
+	for i, batch := range machineDeploymentBatches(machineDeployments, u.maxConcurrentMachineDeployments) {
+		names := make([]string, len(batch))
+		for j, machineDeployment := range batch {
+			names[j] = machineDeployment.Name
+		}
+		u.log.Info("Upgrading batch of MachineDeployments", "batch", i+1, "machine-deployments", strings.Join(names, ","))
+
+		errs := make([]error, len(batch))
+		var wg sync.WaitGroup
+		for j, machineDeployment := range batch {
+			wg.Add(1)
+			go func(j int, machineDeployment *clusterapiv1alpha2.MachineDeployment) {
+				defer wg.Done()
+				errs[j] = u.upgradeMachineDeployment(machineDeployment)
+			}(j, machineDeployment)
+		}
+		wg.Wait()
+
+		if err := kerrors.NewAggregate(errs); err != nil {
+			return errors.Wrapf(err, "error upgrading batch %d of machine deployments", i+1)
+		}
+		summary = append(summary, names)
+	}
+
+	return u.garbageCollectTemplates()
+}
+
+// upgradeMachineDeployment updates machineDeployment and waits for it to roll out.
+func (u *MachineDeploymentUpgrader) upgradeMachineDeployment(machineDeployment *clusterapiv1alpha2.MachineDeployment) (err error) {
+	// Put back the strategy that was overridden for the upgrade, whether the rollout succeeded or not
+	defer func() {
+		if restoreErr := u.restoreMachineDeploymentStrategy(machineDeployment); restoreErr != nil {
+			if err == nil {
+				err = restoreErr
+				return
+			}
+			u.log.Error(restoreErr, "Failed to restore MachineDeployment strategy", "namespace", machineDeployment.Namespace, "name", machineDeployment.Name)
+		}
+	}()
+
+	// Skip updating any machineDeployments that already have this upgrade annotation id, but still wait for
+	// them in case a previous run stopped before they finished rolling out
+	if val, ok := machineDeployment.Spec.Template.Annotations[UpgradeIDAnnotationKey]; !ok || val != u.upgradeID {
+		if err := u.updateMachineDeployment(machineDeployment); err != nil {
 			u.log.Error(err, "Failed to create new MachineDeployment", "namespace", machineDeployment.Namespace, "name", machineDeployment.Name)
 			return err
 		}
 	}
-	return nil
+
+	if u.drain {
+		if err := u.drainMachineDeployment(machineDeployment, u.notUpgradedMachine); err != nil {
+			return err
+		}
+	}
+
+	return u.waitForRollout(machineDeployment, u.desiredVersion, u.machineDeploymentRolloutTimeout)
+}
+
+// machineDeploymentBatches splits machineDeployments into batches of at most size.
+func machineDeploymentBatches(machineDeployments []clusterapiv1alpha2.MachineDeployment, size int) [][]*clusterapiv1alpha2.MachineDeployment {
+	if size < 1 {
+		size = 1
+	}
+
+	var batches [][]*clusterapiv1alpha2.MachineDeployment
+	for i := 0; i < len(machineDeployments); i += size {
+		var batch []*clusterapiv1alpha2.MachineDeployment
+		for j := i; j < i+size && j < len(machineDeployments); j++ {
+			batch = append(batch, &machineDeployments[j])
+		}
+		batches = append(batches, batch)
+	}
+	return batches
 }
 
 func (u *MachineDeploymentUpgrader) updateMachineDeployment(machineDeployment *clusterapiv1alpha2.MachineDeployment) error {
@@ -80,16 +278,29 @@ func (u *MachineDeploymentUpgrader) updateMachineDeployment(machineDeployment *c
 	original := machineDeployment.DeepCopy()
 
 	// Make the modification(s)
-	desiredVersion := u.desiredVersion.String()
-	machineDeployment.Spec.Template.Spec.Version = &desiredVersion
-	// Add the upgrade ID to this template so all machines get it
-	if machineDeployment.Spec.Template.Annotations == nil {
-		machineDeployment.Spec.Template.Annotations = map[string]string{}
+	if err := u.updateMachineTemplate(&machineDeployment.Spec.Template); err != nil {
+		return err
 	}
-	machineDeployment.Spec.Template.Annotations[UpgradeIDAnnotationKey] = u.upgradeID
 
-	if u.imageField != "" && u.imageID != "" {
-		if err := updateMachineSpecImage(&machineDeployment.Spec.Template.Spec, u.imageField, u.imageID); err != nil {
+	if err := u.rotateInfrastructureTemplate(machineDeployment.Namespace, &machineDeployment.Spec.Template); err != nil {
+		return err
+	}
+
+	if err := u.rotateBootstrapTemplate(machineDeployment.Namespace, &machineDeployment.Spec.Template); err != nil {
+		return err
+	}
+
+	rollingUpdate := u.rollingUpdate
+	if u.drain {
+		// The machine deployment has to stay unpaused to create the new MachineSet. The drain strategy keeps it
+		// from removing an old machine before the first new one is available, and drainMachineDeployment pauses
+		// it before that
+		machineDeployment.Spec.Paused = false
+		rollingUpdate = drainRollingUpdate
+	}
+
+	if rollingUpdate != nil {
+		if err := overrideStrategy(machineDeployment, rollingUpdate); err != nil {
 			return err
 		}
 	}
@@ -104,3 +315,29 @@ func (u *MachineDeploymentUpgrader) updateMachineDeployment(machineDeployment *c
 
 	return nil
 }
+
+// updateMachineTemplate sets the desired version and image on template, and annotates it with the upgrade ID so all
+// machines created from it get it.
+func (u *base) updateMachineTemplate(template *clusterapiv1alpha2.MachineTemplateSpec) error {
+	desiredVersion := u.desiredVersion.String()
+	template.Spec.Version = &desiredVersion
+
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[UpgradeIDAnnotationKey] = u.upgradeID
+
+	if u.imageField != "" && u.imageID != "" {
+		if err := updateMachineSpecImage(&template.Spec, u.imageField, u.imageID); err != nil {
+			return err
+		}
+	}
+
+	if hasFieldUpdates(u.fieldUpdates, FieldUpdateTargetMachine) {
+		if err := updateMachineSpec(&template.Spec, u.fieldUpdates); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
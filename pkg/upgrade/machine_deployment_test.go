@@ -0,0 +1,107 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestMachineDeploymentBatches(t *testing.T) {
+	var machineDeployments []clusterapiv1alpha2.MachineDeployment
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		machineDeployments = append(machineDeployments, clusterapiv1alpha2.MachineDeployment{ObjectMeta: metav1.ObjectMeta{Name: name}})
+	}
+
+	names := func(batches [][]*clusterapiv1alpha2.MachineDeployment) [][]string {
+		var result [][]string
+		for _, batch := range batches {
+			var batchNames []string
+			for _, machineDeployment := range batch {
+				batchNames = append(batchNames, machineDeployment.Name)
+			}
+			result = append(result, batchNames)
+		}
+		return result
+	}
+
+	testcases := []struct {
+		name     string
+		size     int
+		expected [][]string
+	}{
+		{
+			name:     "sequential",
+			size:     1,
+			expected: [][]string{{"a"}, {"b"}, {"c"}, {"d"}, {"e"}},
+		},
+		{
+			name:     "batches of two",
+			size:     2,
+			expected: [][]string{{"a", "b"}, {"c", "d"}, {"e"}},
+		},
+		{
+			name:     "all at once",
+			size:     10,
+			expected: [][]string{{"a", "b", "c", "d", "e"}},
+		},
+		{
+			name:     "unset size is sequential",
+			size:     0,
+			expected: [][]string{{"a"}, {"b"}, {"c"}, {"d"}, {"e"}},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, names(machineDeploymentBatches(machineDeployments, tc.size)))
+		})
+	}
+}
+
+func TestMachineDeploymentSelector(t *testing.T) {
+	selector, err := machineDeploymentSelector("my-cluster", "")
+	require.NoError(t, err)
+	assert.True(t, selector.Matches(labels.Set{clusterapiv1alpha2.MachineClusterLabelName: "my-cluster"}))
+	assert.False(t, selector.Matches(labels.Set{clusterapiv1alpha2.MachineClusterLabelName: "other-cluster"}))
+	assert.False(t, selector.Matches(labels.Set{"cluster.k8s.io/cluster-name": "my-cluster"}))
+
+	selector, err = machineDeploymentSelector("my-cluster", "pool=gpu")
+	require.NoError(t, err)
+	assert.True(t, selector.Matches(labels.Set{clusterapiv1alpha2.MachineClusterLabelName: "my-cluster", "pool": "gpu"}))
+	assert.False(t, selector.Matches(labels.Set{clusterapiv1alpha2.MachineClusterLabelName: "my-cluster", "pool": "cpu"}))
+	assert.False(t, selector.Matches(labels.Set{clusterapiv1alpha2.MachineClusterLabelName: "other-cluster", "pool": "gpu"}))
+
+	_, err = machineDeploymentSelector("my-cluster", "pool in (")
+	assert.Error(t, err)
+}
+
+func TestFilterMachineDeploymentsByName(t *testing.T) {
+	newList := func() *clusterapiv1alpha2.MachineDeploymentList {
+		list := &clusterapiv1alpha2.MachineDeploymentList{}
+		for _, name := range []string{"a", "b", "c"} {
+			list.Items = append(list.Items, clusterapiv1alpha2.MachineDeployment{ObjectMeta: metav1.ObjectMeta{Name: name}})
+		}
+		return list
+	}
+
+	list := newList()
+	require.NoError(t, filterMachineDeploymentsByName(list, nil))
+	assert.Len(t, list.Items, 3)
+
+	list = newList()
+	require.NoError(t, filterMachineDeploymentsByName(list, []string{"c", "a"}))
+	require.Len(t, list.Items, 2)
+	assert.Equal(t, "a", list.Items[0].Name)
+	assert.Equal(t, "c", list.Items[1].Name)
+
+	err := filterMachineDeploymentsByName(newList(), []string{"a", "missing"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "missing")
+}
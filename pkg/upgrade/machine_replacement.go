@@ -0,0 +1,225 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	"sigs.k8s.io/cluster-api/controllers/external"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// newMachineCreator returns a MachineCreator that creates replacement machines at the desired version. options are
+// applied after the defaults.
+func (u *base) newMachineCreator(options ...MachineCreatorOption) *MachineCreator {
+	mo := MachineOptions{
+		ImageID:        u.imageID,
+		ImageField:     u.imageField,
+		DesiredVersion: u.desiredVersion,
+		FieldUpdates:   u.fieldUpdates,
+	}
+
+	defaults := []MachineCreatorOption{
+		WithControllerRuntimeClient(u.ctrlClient),
+		WithMachineGetter(u.machineGetter),
+		WithNamespace(u.clusterNamespace),
+		WithNodeLister(u.targetKubernetesClient.CoreV1().Nodes()),
+		WithPodGetter(u.targetKubernetesClient.CoreV1().Pods("kube-system")),
+		WithMachineOptions(mo),
+		WithLogger(u.log.WithName("machine-creator")),
+	}
+
+	return NewMachineCreator(append(defaults, options...)...)
+}
+
+// prepareReplacement turns machine into the source of its replacement called name: it records the original name
+// prefix, the machine it replaces and the upgrade ID, labels it with the upgrade ID and points it at clones of its infrastructure and
+// bootstrap objects.
+func (u *base) prepareReplacement(name string, machine *clusterapiv1alpha2.Machine) error {
+	// Remember the name this machine started out with so the next replacement doesn't grow the name
+	if machine.Annotations == nil {
+		machine.Annotations = map[string]string{}
+	}
+	machine.Annotations[NamePrefixAnnotationKey] = namePrefix(machine)
+	machine.Annotations[ReplacesAnnotationKey] = machine.Name
+
+	// Mark the replacement as upgraded as soon as it's created, so a rerun with the same upgrade ID doesn't replace
+	// it again and resumes with the machine it replaces instead
+	machine.Annotations[UpgradeIDAnnotationKey] = u.upgradeID
+
+	// Label everything created for this machine so it can be cleaned up if the upgrade fails
+	if machine.Labels == nil {
+		machine.Labels = map[string]string{}
+	}
+	machine.Labels[UpgradeIDLabelKey] = u.upgradeID
+
+	u.log.Info("Cloning infrastructure object for replacement machine", "machine", machine.Name, "replacement", name)
+	provider := providerForKind(machine.Spec.InfrastructureRef.Kind)
+	infraMachine, err := u.updateObjectReference(name, machine.Name, &machine.Spec.InfrastructureRef, clearInstanceFields(provider), u.updateInfrastructureMachine)
+	if err != nil {
+		return err
+	}
+	machine.Spec.InfrastructureRef = *infraMachine
+
+	u.log.Info("Cloning bootstrap object for replacement machine", "machine", machine.Name, "replacement", name)
+	bootstrap, err := u.updateObjectReference(name, machine.Name, machine.Spec.Bootstrap.ConfigRef)
+	if err != nil {
+		return err
+	}
+	machine.Spec.Bootstrap.ConfigRef = bootstrap
+
+	return nil
+}
+
+// cleanupAfterFailure deletes the objects a failed upgrade created, if the upgrader is configured to do so.
+func (u *base) cleanupAfterFailure() {
+	if !u.cleanupOnFailure {
+		return
+	}
+
+	u.log.Info("Upgrade failed, cleaning up the objects it created", "upgrade-id", u.upgradeID)
+	if err := u.cleaner().Cleanup(); err != nil {
+		u.log.Error(err, "Failed to clean up after the failed upgrade, run the cleanup command to retry", "upgrade-id", u.upgradeID)
+	}
+}
+
+// updateObjectReference creates a copy of the object ref refers to under name, applying mutators to it, and points
+// ref at the copy. A copy this upgrade already created for the machine called machineName is reused.
+func (u *base) updateObjectReference(name, machineName string, ref *v1.ObjectReference, mutators ...func(*unstructured.Unstructured) error) (*v1.ObjectReference, error) {
+	if ref.Namespace == "" {
+		ref.Namespace = "default"
+	}
+
+	existing, err := u.getObject(ref, name)
+	if err != nil {
+		return &v1.ObjectReference{}, err
+	}
+	if existing != nil {
+		if !createdFor(existing, u.upgradeID, machineName) {
+			return &v1.ObjectReference{}, errors.Errorf("%s %s/%s already exists", ref.Kind, ref.Namespace, name)
+		}
+		u.log.Info("Reusing object created by a previous run of this upgrade", "kind", ref.Kind, "namespace", ref.Namespace, "name", name)
+		ref.ResourceVersion = ""
+		ref.Name = name
+		return ref, nil
+	}
+
+	object, err := external.Get(u.ctrlClient, ref, ref.Namespace)
+	if err != nil {
+		return &v1.ObjectReference{}, err
+	}
+
+	object.SetResourceVersion("")
+	object.SetName(name)
+
+	labels := object.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[UpgradeIDLabelKey] = u.upgradeID
+	object.SetLabels(labels)
+
+	annotations := object.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[ReplacesAnnotationKey] = machineName
+	object.SetAnnotations(annotations)
+
+	for _, mutate := range mutators {
+		if err := mutate(object); err != nil {
+			return &v1.ObjectReference{}, err
+		}
+	}
+
+	ref.ResourceVersion = ""
+	ref.Name = name
+
+	return ref, u.ctrlClient.Create(context.TODO(), object)
+}
+
+// replacementNames generates the name of the replacement for each machine and makes sure, before anything is
+// created, that none of them collide with each other or with existing machines, infrastructure or bootstrap objects.
+// Objects that a previous run of this upgrade created for the same machine don't collide, they are picked up again.
+func (u *base) replacementNames(machines []clusterapiv1alpha2.Machine) (map[string]string, error) {
+	names := make(map[string]string, len(machines))
+	existing := sets.NewString()
+
+	for i := range machines {
+		machine := &machines[i]
+
+		name, err := u.machineNamer.Name(machine)
+		if err != nil {
+			return nil, err
+		}
+		names[machine.Name] = name
+
+		for _, ref := range []*v1.ObjectReference{&machine.Spec.InfrastructureRef, machine.Spec.Bootstrap.ConfigRef} {
+			if ref == nil {
+				continue
+			}
+			object, err := u.getObject(ref, name)
+			if err != nil {
+				return nil, err
+			}
+			if object != nil && !createdFor(object, u.upgradeID, machine.Name) {
+				existing.Insert(name)
+			}
+		}
+	}
+
+	replaced := make(map[string]string, len(names))
+	for original, name := range names {
+		replaced[name] = original
+	}
+
+	allMachines := &clusterapiv1alpha2.MachineList{}
+	if err := u.ctrlClient.List(context.TODO(), allMachines, ctrlclient.InNamespace(u.clusterNamespace)); err != nil {
+		return nil, errors.Wrap(err, "error listing machines")
+	}
+	for i := range allMachines.Items {
+		machine := &allMachines.Items[i]
+		if original, ok := replaced[machine.Name]; ok && createdFor(machine, u.upgradeID, original) {
+			u.log.Info("Resuming replacement created by a previous run of this upgrade", "namespace", machine.Namespace, "name", machine.Name, "replaces", original)
+			continue
+		}
+		existing.Insert(machine.Name)
+	}
+
+	return names, checkNameCollisions(names, existing)
+}
+
+// getObject returns the object of the same kind as ref with the given name, or nil if there's none.
+func (u *base) getObject(ref *v1.ObjectReference, name string) (*unstructured.Unstructured, error) {
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	lookup := ref.DeepCopy()
+	lookup.Name = name
+
+	object, err := external.Get(u.ctrlClient, lookup, namespace)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error checking if %s %s/%s exists", ref.Kind, namespace, name)
+	}
+	return object, nil
+}
+
+func (u *base) deleteMachine(machine *clusterapiv1alpha2.Machine) error {
+	u.log.Info("Deleting existing machine", "namespace", machine.Namespace, "name", machine.Name)
+
+	err := u.ctrlClient.Delete(context.TODO(), machine, ctrlclient.PropagationPolicy(metav1.DeletePropagationForeground))
+	return errors.WithStack(err)
+}
@@ -0,0 +1,159 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestReplacementNamesResume(t *testing.T) {
+	infraGVK := schema.GroupVersionKind{Group: "infrastructure.cluster.x-k8s.io", Version: "v1alpha2", Kind: "DockerMachine"}
+
+	scheme := runtime.NewScheme()
+	require.NoError(t, clusterapiv1alpha2.AddToScheme(scheme))
+
+	namer, err := NewMachineNamer("{{.Name}}-new", "42")
+	require.NoError(t, err)
+
+	old := clusterapiv1alpha2.Machine{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "worker"},
+		Spec: clusterapiv1alpha2.MachineSpec{
+			InfrastructureRef: v1.ObjectReference{APIVersion: infraGVK.GroupVersion().String(), Kind: infraGVK.Kind, Name: "worker"},
+		},
+	}
+	leftover := func(upgradeID, replaces string) (*clusterapiv1alpha2.Machine, *unstructured.Unstructured) {
+		labels := map[string]string{UpgradeIDLabelKey: upgradeID}
+		annotations := map[string]string{ReplacesAnnotationKey: replaces}
+
+		machine := &clusterapiv1alpha2.Machine{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "worker-new", Labels: labels, Annotations: annotations},
+		}
+		infra := &unstructured.Unstructured{}
+		infra.SetGroupVersionKind(infraGVK)
+		infra.SetNamespace("default")
+		infra.SetName("worker-new")
+		infra.SetLabels(labels)
+		infra.SetAnnotations(annotations)
+		return machine, infra
+	}
+
+	testcases := []struct {
+		name        string
+		upgradeID   string
+		replaces    string
+		expectError bool
+	}{
+		{
+			name:      "left over by a previous run of the same upgrade",
+			upgradeID: "42",
+			replaces:  "worker",
+		},
+		{
+			name:        "created by another upgrade",
+			upgradeID:   "41",
+			replaces:    "worker",
+			expectError: true,
+		},
+		{
+			name:        "created by the same upgrade for another machine",
+			upgradeID:   "42",
+			replaces:    "other",
+			expectError: true,
+		},
+		{
+			name:        "not created by an upgrade",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			machine, infra := leftover(tc.upgradeID, tc.replaces)
+			u := &base{
+				log:              testLogger(),
+				upgradeID:        "42",
+				clusterNamespace: "default",
+				machineNamer:     namer,
+				ctrlClient:       fake.NewFakeClientWithScheme(scheme, old.DeepCopy(), machine, infra),
+			}
+
+			names, err := u.replacementNames([]clusterapiv1alpha2.Machine{old})
+			if tc.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{"worker": "worker-new"}, names)
+		})
+	}
+}
+
+func TestPrepareReplacementResume(t *testing.T) {
+	infraGVK := schema.GroupVersionKind{Group: "infrastructure.cluster.x-k8s.io", Version: "v1alpha2", Kind: "DockerMachine"}
+	bootstrapGVK := schema.GroupVersionKind{Group: "bootstrap.cluster.x-k8s.io", Version: "v1alpha2", Kind: "KubeadmConfig"}
+
+	scheme := runtime.NewScheme()
+	require.NoError(t, clusterapiv1alpha2.AddToScheme(scheme))
+
+	namer, err := NewMachineNamer("{{.Name}}-new", "42")
+	require.NoError(t, err)
+
+	old := &clusterapiv1alpha2.Machine{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "worker"},
+		Spec: clusterapiv1alpha2.MachineSpec{
+			InfrastructureRef: v1.ObjectReference{APIVersion: infraGVK.GroupVersion().String(), Kind: infraGVK.Kind, Namespace: "default", Name: "worker"},
+			Bootstrap: clusterapiv1alpha2.Bootstrap{
+				ConfigRef: &v1.ObjectReference{APIVersion: bootstrapGVK.GroupVersion().String(), Kind: bootstrapGVK.Kind, Namespace: "default", Name: "worker"},
+			},
+		},
+	}
+	object := func(gvk schema.GroupVersionKind) *unstructured.Unstructured {
+		u := &unstructured.Unstructured{}
+		u.SetGroupVersionKind(gvk)
+		u.SetNamespace("default")
+		u.SetName("worker")
+		return u
+	}
+
+	u := &base{
+		log:              testLogger(),
+		upgradeID:        "42",
+		clusterNamespace: "default",
+		machineNamer:     namer,
+		ctrlClient:       fake.NewFakeClientWithScheme(scheme, old.DeepCopy(), object(infraGVK), object(bootstrapGVK)),
+	}
+
+	// The first run creates the replacement and then fails before the old machine is deleted
+	replacement := old.DeepCopy()
+	require.NoError(t, u.prepareReplacement("worker-new", replacement))
+	replacement.Name = "worker-new"
+	replacement.ResourceVersion = ""
+	require.NoError(t, u.ctrlClient.Create(context.TODO(), replacement))
+
+	machines := &clusterapiv1alpha2.MachineList{}
+	require.NoError(t, u.ctrlClient.List(context.TODO(), machines))
+	plan := planWorkerMachineUpgrade(machines.Items, nil, "42")
+	require.Len(t, plan.machines, 1)
+	assert.Equal(t, "worker", plan.machines[0].Name)
+
+	names, err := u.replacementNames(plan.machines)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"worker": "worker-new"}, names)
+
+	machine := plan.machines[0]
+	require.NoError(t, u.prepareReplacement(names[machine.Name], &machine))
+	assert.Equal(t, "worker-new", machine.Spec.InfrastructureRef.Name)
+	assert.Equal(t, "worker-new", machine.Spec.Bootstrap.ConfigRef.Name)
+}
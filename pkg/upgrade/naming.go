@@ -0,0 +1,158 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+const (
+	// DefaultMachineNameTemplate keeps the full name the machine started out with and appends a short hash of the
+	// upgrade ID and the name of the machine being replaced.
+	DefaultMachineNameTemplate = "{{.Prefix}}-{{.Hash}}"
+
+	// NamePrefixAnnotationKey records the name a replaced object started out with, so repeated upgrades don't keep
+	// growing the name.
+	NamePrefixAnnotationKey = "cluster-api-upgrade-tool/name-prefix"
+
+	// ReplacesAnnotationKey records the name of the machine an object was created to replace, or of the template a
+	// template was cloned from, so a rerun of the same upgrade can pick up the objects it created before.
+	ReplacesAnnotationKey = "cluster-api-upgrade-tool/replaces"
+)
+
+// MachineNamer generates the name of the machine, and its infrastructure and bootstrap objects, that replaces an
+// existing machine.
+type MachineNamer interface {
+	Name(machine *clusterapiv1alpha2.Machine) (string, error)
+}
+
+// MachineNameData is the data available to a machine name template.
+type MachineNameData struct {
+	// Prefix is the name of the machine before the tool replaced it for the first time.
+	Prefix string
+	// Name is the name of the machine being replaced.
+	Name string
+	// UpgradeID is the ID of the current upgrade.
+	UpgradeID string
+	// Hash is a short hash of the upgrade ID and the name of the machine being replaced.
+	Hash string
+}
+
+type templateMachineNamer struct {
+	template  *template.Template
+	upgradeID string
+}
+
+// NewMachineNamer returns a MachineNamer that renders nameTemplate with MachineNameData. If nameTemplate is empty,
+// DefaultMachineNameTemplate is used.
+func NewMachineNamer(nameTemplate, upgradeID string) (MachineNamer, error) {
+	if nameTemplate == "" {
+		nameTemplate = DefaultMachineNameTemplate
+	}
+
+	t, err := template.New("machine-name").Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing machine name template %q", nameTemplate)
+	}
+
+	return &templateMachineNamer{
+		template:  t,
+		upgradeID: upgradeID,
+	}, nil
+}
+
+func (n *templateMachineNamer) Name(machine *clusterapiv1alpha2.Machine) (string, error) {
+	data := MachineNameData{
+		Prefix:    namePrefix(machine),
+		Name:      machine.Name,
+		UpgradeID: n.upgradeID,
+		Hash:      shortHash(n.upgradeID, machine.Name),
+	}
+
+	var b bytes.Buffer
+	if err := n.template.Execute(&b, data); err != nil {
+		return "", errors.Wrapf(err, "error rendering name for machine %s", machine.Name)
+	}
+
+	name := b.String()
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return "", errors.Errorf("generated name %q for machine %s is invalid: %s", name, machine.Name, strings.Join(errs, ", "))
+	}
+
+	return name, nil
+}
+
+// namePrefix returns the name the object started out with before the tool replaced it.
+func namePrefix(obj metav1.Object) string {
+	if prefix := obj.GetAnnotations()[NamePrefixAnnotationKey]; prefix != "" {
+		return prefix
+	}
+	return obj.GetName()
+}
+
+// createdFor returns true if obj was created by the upgrade upgradeID to replace the object called name.
+func createdFor(obj metav1.Object, upgradeID, name string) bool {
+	return upgradeID != "" && obj.GetLabels()[UpgradeIDLabelKey] == upgradeID &&
+		obj.GetAnnotations()[ReplacesAnnotationKey] == name
+}
+
+// templateCloneName returns the name of the clone of the template source for the upgrade upgradeID: the name the
+// source started out with and a short hash. The name is truncated to stay a valid DNS-1123 subdomain.
+func templateCloneName(source metav1.Object, upgradeID string) (string, error) {
+	prefix := namePrefix(source)
+	hash := shortHash(upgradeID, source.GetName())
+	if max := validation.DNS1123SubdomainMaxLength - len(hash) - 1; len(prefix) > max {
+		prefix = strings.TrimRight(prefix[:max], "-.")
+	}
+
+	name := prefix + "-" + hash
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return "", errors.Errorf("generated name %q for the clone of %s is invalid: %s", name, source.GetName(), strings.Join(errs, ", "))
+	}
+	return name, nil
+}
+
+// shortHash returns a short, name-safe hash of parts.
+func shortHash(parts ...string) string {
+	hasher := fnv.New32a()
+	hasher.Write([]byte(strings.Join(parts, "/")))
+	return rand.SafeEncodeString(fmt.Sprint(hasher.Sum32()))
+}
+
+// checkNameCollisions returns an error if two machines are replaced by machines with the same name, or if a
+// replacement name is already taken.
+func checkNameCollisions(replacements map[string]string, existing sets.String) error {
+	seen := make(map[string]string, len(replacements))
+	var collisions []string
+
+	for _, original := range sets.StringKeySet(replacements).List() {
+		name := replacements[original]
+		if other, ok := seen[name]; ok {
+			collisions = append(collisions, fmt.Sprintf("%s (replacing both %s and %s)", name, other, original))
+			continue
+		}
+		seen[name] = original
+
+		if existing.Has(name) {
+			collisions = append(collisions, fmt.Sprintf("%s (replacing %s) already exists", name, original))
+		}
+	}
+
+	if len(collisions) > 0 {
+		return errors.Errorf("replacement machine names collide: %s", strings.Join(collisions, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestMachineNamer(t *testing.T) {
+	namer, err := NewMachineNamer("", "upgrade-1")
+	require.NoError(t, err)
+
+	first := &clusterapiv1alpha2.Machine{ObjectMeta: metav1.ObjectMeta{Name: "my-cluster-controlplane-0"}}
+	second := &clusterapiv1alpha2.Machine{ObjectMeta: metav1.ObjectMeta{Name: "my-cluster-controlplane-1"}}
+
+	firstName, err := namer.Name(first)
+	require.NoError(t, err)
+	secondName, err := namer.Name(second)
+	require.NoError(t, err)
+
+	assert.Equal(t, "my-cluster-controlplane-0-"+shortHash("upgrade-1", "my-cluster-controlplane-0"), firstName)
+	assert.NotEqual(t, firstName, secondName)
+
+	again, err := namer.Name(first)
+	require.NoError(t, err)
+	assert.Equal(t, firstName, again, "names should be deterministic")
+
+	replaced := &clusterapiv1alpha2.Machine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        firstName,
+			Annotations: map[string]string{NamePrefixAnnotationKey: "my-cluster-controlplane-0"},
+		},
+	}
+	namer, err = NewMachineNamer("", "upgrade-2")
+	require.NoError(t, err)
+	replacedName, err := namer.Name(replaced)
+	require.NoError(t, err)
+	assert.Equal(t, "my-cluster-controlplane-0-"+shortHash("upgrade-2", firstName), replacedName)
+}
+
+func TestMachineNamerTemplate(t *testing.T) {
+	namer, err := NewMachineNamer("{{.Prefix}}-{{.UpgradeID}}", "42")
+	require.NoError(t, err)
+
+	name, err := namer.Name(&clusterapiv1alpha2.Machine{ObjectMeta: metav1.ObjectMeta{Name: "cp-0"}})
+	require.NoError(t, err)
+	assert.Equal(t, "cp-0-42", name)
+
+	_, err = NewMachineNamer("{{.Prefix", "42")
+	assert.Error(t, err)
+
+	namer, err = NewMachineNamer("{{.Unknown}}", "42")
+	require.NoError(t, err)
+	_, err = namer.Name(&clusterapiv1alpha2.Machine{ObjectMeta: metav1.ObjectMeta{Name: "cp-0"}})
+	assert.Error(t, err)
+
+	namer, err = NewMachineNamer("{{.Prefix}}_{{.Hash}}", "42")
+	require.NoError(t, err)
+	_, err = namer.Name(&clusterapiv1alpha2.Machine{ObjectMeta: metav1.ObjectMeta{Name: "cp-0"}})
+	assert.Error(t, err, "names that are not DNS subdomains should be rejected")
+}
+
+func TestTemplateCloneName(t *testing.T) {
+	name, err := templateCloneName(&metav1.ObjectMeta{Name: "workers"}, "42")
+	require.NoError(t, err)
+	assert.Equal(t, "workers-"+shortHash("42", "workers"), name)
+
+	rotated := &metav1.ObjectMeta{Name: name, Annotations: map[string]string{NamePrefixAnnotationKey: "workers"}}
+	name, err = templateCloneName(rotated, "43")
+	require.NoError(t, err)
+	assert.Equal(t, "workers-"+shortHash("43", rotated.Name), name)
+
+	long := strings.Repeat("a", 250) + "-" + strings.Repeat("b", 2)
+	name, err = templateCloneName(&metav1.ObjectMeta{Name: long}, "42")
+	require.NoError(t, err)
+	assert.Len(t, name, validation.DNS1123SubdomainMaxLength)
+	assert.Empty(t, validation.IsDNS1123Subdomain(name))
+
+	// The prefix isn't cut off right before a dash
+	dashed := strings.Repeat("a", 241) + "-" + strings.Repeat("b", 20)
+	name, err = templateCloneName(&metav1.ObjectMeta{Name: dashed}, "42")
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("a", 241)+"-"+shortHash("42", dashed), name)
+}
+
+func TestCheckNameCollisions(t *testing.T) {
+	testcases := []struct {
+		name         string
+		replacements map[string]string
+		existing     sets.String
+		expectError  bool
+	}{
+		{
+			name:         "unique names",
+			replacements: map[string]string{"a": "a-1", "b": "b-1"},
+			existing:     sets.NewString("a", "b"),
+		},
+		{
+			name:         "two machines get the same name",
+			replacements: map[string]string{"a": "same", "b": "same"},
+			existing:     sets.NewString("a", "b"),
+			expectError:  true,
+		},
+		{
+			name:         "name already exists",
+			replacements: map[string]string{"a": "b"},
+			existing:     sets.NewString("a", "b"),
+			expectError:  true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkNameCollisions(tc.replacements, tc.existing)
+			if tc.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
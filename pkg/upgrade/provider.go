@@ -0,0 +1,166 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/cluster-api/controllers/noderefutil"
+)
+
+// Provider describes what an upgrade needs to know about an infrastructure provider.
+type Provider interface {
+	// Name is the cloud provider prefix of the provider's provider IDs, for example "aws".
+	Name() string
+
+	// ImageField is the dotted path of the image field in the provider's infrastructure machines, or "" if the
+	// provider doesn't have one.
+	ImageField() string
+
+	// InstanceTypeField is the dotted path of the instance type field in the provider's infrastructure machines, or
+	// "" if the provider doesn't have one. A machine class is set in it.
+	InstanceTypeField() string
+
+	// ClearedFields are the dotted paths of the fields that describe the instance behind an infrastructure machine.
+	// A clone of an infrastructure machine starts out with everything else and without these, so the provider
+	// creates a new instance for it.
+	ClearedFields() []string
+
+	// InstanceID returns the part of a provider ID that identifies the instance, which is what machines and nodes
+	// are matched on.
+	InstanceID(providerID string) (string, error)
+
+	// InfrastructureReady returns true if the infrastructure machine has been provisioned.
+	InfrastructureReady(infraMachine *unstructured.Unstructured) bool
+
+	// CAKeyPairField is the dotted path of the CA key pair in the provider's infrastructure clusters, or "" if the
+	// provider doesn't keep one there. The key pair has base64 encoded cert and key fields.
+	CAKeyPairField() string
+}
+
+// providerForKind returns the provider of an infrastructure cluster, machine or machine template kind. Unknown kinds
+// get a generic provider that follows the Cluster API contract for infrastructure machines.
+func providerForKind(kind string) Provider {
+	switch strings.TrimSuffix(kind, "Template") {
+	case "AWSMachine", "AWSCluster":
+		return awsProvider{}
+	case "DockerMachine", "DockerCluster":
+		return dockerProvider{}
+	default:
+		return genericProvider{}
+	}
+}
+
+// genericProvider only relies on what every v1alpha2 infrastructure machine has: spec.providerID and status.ready.
+type genericProvider struct{}
+
+func (genericProvider) Name() string {
+	return ""
+}
+
+func (genericProvider) ImageField() string {
+	return ""
+}
+
+func (genericProvider) InstanceTypeField() string {
+	return ""
+}
+
+func (genericProvider) ClearedFields() []string {
+	return []string{"spec.providerID", "status"}
+}
+
+func (genericProvider) InstanceID(providerID string) (string, error) {
+	id, err := noderefutil.NewProviderID(providerID)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid provider id %q", providerID)
+	}
+	return id.ID(), nil
+}
+
+func (genericProvider) InfrastructureReady(infraMachine *unstructured.Unstructured) bool {
+	ready, _, _ := unstructured.NestedBool(infraMachine.Object, "status", "ready")
+	return ready
+}
+
+func (genericProvider) CAKeyPairField() string {
+	return ""
+}
+
+// awsProvider is the AWS provider (CAPA). Its provider IDs look like aws:///us-east-1a/i-0123456789abcdef0.
+type awsProvider struct {
+	genericProvider
+}
+
+func (awsProvider) Name() string {
+	return "aws"
+}
+
+func (awsProvider) ImageField() string {
+	return "spec.ami.id"
+}
+
+func (awsProvider) InstanceTypeField() string {
+	return "spec.instanceType"
+}
+
+func (awsProvider) ClearedFields() []string {
+	return []string{"spec.providerID", "spec.instanceID", "status"}
+}
+
+func (p awsProvider) InstanceID(providerID string) (string, error) {
+	return instanceIDForProvider(p.Name(), providerID)
+}
+
+func (p awsProvider) InfrastructureReady(infraMachine *unstructured.Unstructured) bool {
+	state, _, _ := unstructured.NestedString(infraMachine.Object, "status", "instanceState")
+	return p.genericProvider.InfrastructureReady(infraMachine) && (state == "" || state == "running")
+}
+
+// CAKeyPairField is where clusters created before CAPA moved the CA to the <cluster>-ca secret keep it.
+func (awsProvider) CAKeyPairField() string {
+	return "spec.caKeyPair"
+}
+
+// dockerProvider is the Docker provider (CAPD). Its provider IDs look like docker:////my-cluster-worker-abcde.
+type dockerProvider struct {
+	genericProvider
+}
+
+func (dockerProvider) Name() string {
+	return "docker"
+}
+
+func (dockerProvider) ImageField() string {
+	return "spec.customImage"
+}
+
+func (p dockerProvider) InstanceID(providerID string) (string, error) {
+	return instanceIDForProvider(p.Name(), providerID)
+}
+
+// instanceIDForProvider parses providerID and checks that it belongs to the named cloud provider.
+func instanceIDForProvider(name, providerID string) (string, error) {
+	id, err := noderefutil.NewProviderID(providerID)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid provider id %q", providerID)
+	}
+	if id.CloudProvider() != name {
+		return "", errors.Errorf("provider id %q is not a %s provider id", providerID, name)
+	}
+	return id.ID(), nil
+}
+
+// clearInstanceFields returns a mutator that removes the provider's instance fields from a cloned infrastructure
+// machine.
+func clearInstanceFields(provider Provider) func(*unstructured.Unstructured) error {
+	return func(object *unstructured.Unstructured) error {
+		for _, field := range provider.ClearedFields() {
+			unstructured.RemoveNestedField(object.Object, strings.Split(field, ".")...)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestProviderForKind(t *testing.T) {
+	assert.Equal(t, awsProvider{}, providerForKind("AWSMachine"))
+	assert.Equal(t, awsProvider{}, providerForKind("AWSMachineTemplate"))
+	assert.Equal(t, dockerProvider{}, providerForKind("DockerMachine"))
+	assert.Equal(t, dockerProvider{}, providerForKind("DockerMachineTemplate"))
+	assert.Equal(t, genericProvider{}, providerForKind("VSphereMachine"))
+	assert.Equal(t, genericProvider{}, providerForKind(""))
+}
+
+func TestProviderInstanceID(t *testing.T) {
+	testcases := []struct {
+		name          string
+		provider      Provider
+		providerID    string
+		expected      string
+		expectedError bool
+	}{
+		{
+			name:       "aws",
+			provider:   awsProvider{},
+			providerID: "aws:///us-east-1a/i-0123456789abcdef0",
+			expected:   "i-0123456789abcdef0",
+		},
+		{
+			name:          "aws with a docker provider id",
+			provider:      awsProvider{},
+			providerID:    "docker:////my-cluster-worker-abcde",
+			expectedError: true,
+		},
+		{
+			name:       "docker",
+			provider:   dockerProvider{},
+			providerID: "docker:////my-cluster-worker-abcde",
+			expected:   "my-cluster-worker-abcde",
+		},
+		{
+			name:       "generic",
+			provider:   genericProvider{},
+			providerID: "vsphere://4216d5ef-2ad0-4d3b-ae56-0f1e0f6a7c42",
+			expected:   "4216d5ef-2ad0-4d3b-ae56-0f1e0f6a7c42",
+		},
+		{
+			name:          "empty",
+			provider:      genericProvider{},
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			id, err := tc.provider.InstanceID(tc.providerID)
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, id)
+		})
+	}
+}
+
+func TestClearInstanceFields(t *testing.T) {
+	awsMachine := &unstructured.Unstructured{Object: map[string]interface{}{
+		"kind": "AWSMachine",
+		"spec": map[string]interface{}{
+			"providerID":   "aws:///us-east-1a/i-0123456789abcdef0",
+			"instanceID":   "i-0123456789abcdef0",
+			"instanceType": "m5.large",
+		},
+		"status": map[string]interface{}{"ready": true},
+	}}
+
+	require.NoError(t, clearInstanceFields(awsProvider{})(awsMachine))
+	assert.Equal(t, map[string]interface{}{
+		"kind": "AWSMachine",
+		"spec": map[string]interface{}{"instanceType": "m5.large"},
+	}, awsMachine.Object)
+}
+
+func TestInfrastructureReady(t *testing.T) {
+	machine := func(status map[string]interface{}) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{"status": status}}
+	}
+
+	assert.False(t, genericProvider{}.InfrastructureReady(machine(nil)))
+	assert.True(t, genericProvider{}.InfrastructureReady(machine(map[string]interface{}{"ready": true})))
+	assert.True(t, dockerProvider{}.InfrastructureReady(machine(map[string]interface{}{"ready": true})))
+	assert.True(t, awsProvider{}.InfrastructureReady(machine(map[string]interface{}{"ready": true, "instanceState": "running"})))
+	assert.False(t, awsProvider{}.InfrastructureReady(machine(map[string]interface{}{"ready": true, "instanceState": "stopping"})))
+}
@@ -0,0 +1,270 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/restmapper"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+const (
+	managementCluster = "management"
+	targetCluster     = "target"
+)
+
+// permission is a verb on a resource that an upgrade needs in the management or the target cluster. An empty
+// namespace stands for all namespaces or a cluster-scoped resource.
+type permission struct {
+	cluster     string
+	namespace   string
+	verb        string
+	group       string
+	resource    string
+	subresource string
+}
+
+func (p permission) String() string {
+	resource := p.resource
+	if p.group != "" {
+		resource += "." + p.group
+	}
+	if p.subresource != "" {
+		resource += "/" + p.subresource
+	}
+	return resource
+}
+
+// permissionSet collects permissions without duplicates.
+type permissionSet map[permission]bool
+
+func (s permissionSet) add(cluster, namespace, group, resource string, verbs ...string) {
+	resource, subresource := splitSubresource(resource)
+	for _, verb := range verbs {
+		s[permission{cluster: cluster, namespace: namespace, verb: verb, group: group, resource: resource, subresource: subresource}] = true
+	}
+}
+
+// addResources adds verbs on resources in the management cluster.
+func (s permissionSet) addResources(namespace string, resources []schema.GroupResource, verbs ...string) {
+	for _, resource := range resources {
+		s.add(managementCluster, namespace, resource.Group, resource.Resource, verbs...)
+	}
+}
+
+// sorted returns the permissions by cluster, namespace, resource and verb.
+func (s permissionSet) sorted() []permission {
+	var permissions []permission
+	for p := range s {
+		permissions = append(permissions, p)
+	}
+	sort.Slice(permissions, func(i, j int) bool {
+		a, b := permissions[i], permissions[j]
+		if a.cluster != b.cluster {
+			return a.cluster < b.cluster
+		}
+		if a.namespace != b.namespace {
+			return a.namespace < b.namespace
+		}
+		if a.String() != b.String() {
+			return a.String() < b.String()
+		}
+		return a.verb < b.verb
+	})
+	return permissions
+}
+
+func splitSubresource(resource string) (string, string) {
+	parts := strings.SplitN(resource, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// requiredPermissions returns what an upgrade of scope needs in both clusters. refs are the management cluster
+// resources of the infrastructure and bootstrap objects or templates of the machines it replaces, which it reads and
+// clones.
+func (u *base) requiredPermissions(scope string, refs []schema.GroupResource) permissionSet {
+	const group = "cluster.x-k8s.io"
+	ns := u.clusterNamespace
+	permissions := permissionSet{}
+
+	permissions.add(managementCluster, ns, group, "clusters", "get")
+	permissions.add(managementCluster, ns, group, "machines", "list")
+	permissions.add(targetCluster, "", "", "nodes", "get", "list")
+
+	// The kubelet config of a new minor version and, optionally, the one of the previous version
+	permissions.add(targetCluster, metav1.NamespaceSystem, "", "configmaps", "get", "create")
+	permissions.add(targetCluster, metav1.NamespaceSystem, "rbac.authorization.k8s.io", "roles", "get", "create")
+	permissions.add(targetCluster, metav1.NamespaceSystem, "rbac.authorization.k8s.io", "rolebindings", "get", "create")
+	if u.cleanupKubeletConfig {
+		permissions.add(targetCluster, metav1.NamespaceSystem, "", "configmaps", "delete")
+		permissions.add(targetCluster, metav1.NamespaceSystem, "rbac.authorization.k8s.io", "roles", "delete")
+		permissions.add(targetCluster, metav1.NamespaceSystem, "rbac.authorization.k8s.io", "rolebindings", "delete")
+	}
+
+	switch scope {
+	case ControlPlaneScope, WorkerMachineScope:
+		permissions.add(managementCluster, ns, group, "machines", "get", "create", "patch", "delete")
+		permissions.addResources(ns, refs, "get", "create")
+		// Worker machine upgrades also garbage collect the templates of the machine sets they update
+		if u.cleanupOnFailure || scope == WorkerMachineScope {
+			permissions.addResources(ns, refs, "list", "delete")
+		}
+		// Cleaning up keeps the templates machine deployments and machine sets refer to
+		if u.cleanupOnFailure {
+			permissions.add(managementCluster, ns, group, "machinedeployments", "list")
+			permissions.add(managementCluster, ns, group, "machinesets", "list")
+		}
+		permissions.add(targetCluster, "", "", "nodes", "delete")
+		permissions.add(targetCluster, metav1.NamespaceSystem, "", "pods", "get")
+
+		if scope == ControlPlaneScope {
+			permissions.add(targetCluster, metav1.NamespaceSystem, "", "pods", "list")
+			permissions.add(targetCluster, metav1.NamespaceSystem, "", "pods/exec", "create")
+			permissions.add(targetCluster, metav1.NamespaceSystem, "", "configmaps", "update")
+		} else {
+			permissions.add(managementCluster, ns, group, "machinesets", "get", "list", "patch")
+			permissions.add(managementCluster, ns, group, "machinedeployments", "list")
+		}
+
+	case MachineDeploymentScope:
+		permissions.add(managementCluster, ns, group, "machinedeployments", "get", "list", "patch")
+		permissions.add(managementCluster, ns, group, "machinesets", "list")
+		permissions.addResources(ns, refs, "get", "create", "list", "delete")
+		if u.drain {
+			permissions.add(managementCluster, ns, group, "machines", "get", "patch")
+			permissions.add(targetCluster, "", "", "nodes", "update")
+			permissions.add(targetCluster, "", "", "pods", "get", "list")
+			permissions.add(targetCluster, "", "", "pods/eviction", "create")
+		}
+		if u.canary.MachineDeployment != "" {
+			// The pods on the canary nodes are checked for restarts
+			permissions.add(targetCluster, "", "", "pods", "list")
+		}
+		if u.canary.WorkloadSelector != "" {
+			permissions.add(targetCluster, "", "apps", "deployments", "list")
+		}
+	}
+
+	return permissions
+}
+
+// machineRefs returns the infrastructure and bootstrap references of machines.
+func machineRefs(machines []clusterapiv1alpha2.Machine) []*v1.ObjectReference {
+	var refs []*v1.ObjectReference
+	for i := range machines {
+		refs = append(refs, templateRefs(clusterapiv1alpha2.MachineTemplateSpec{Spec: machines[i].Spec})...)
+	}
+	return refs
+}
+
+// refResources returns the resources the management cluster serves the kinds of refs as.
+func (u *base) refResources(refs []*v1.ObjectReference) ([]schema.GroupResource, error) {
+	if len(refs) == 0 {
+		return nil, nil
+	}
+
+	groupResources, err := restmapper.GetAPIGroupResources(u.managementKubernetesClient.Discovery())
+	if err != nil {
+		return nil, errors.Wrap(err, "error discovering the resources of the management cluster")
+	}
+	return kindResources(restmapper.NewDiscoveryRESTMapper(groupResources), refs)
+}
+
+// kindResources maps the kinds of refs to their resources with mapper.
+func kindResources(mapper meta.RESTMapper, refs []*v1.ObjectReference) ([]schema.GroupResource, error) {
+	var resources []schema.GroupResource
+	for _, ref := range refs {
+		gvk := ref.GroupVersionKind()
+		mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error finding the resource of %s", gvk.Kind)
+		}
+		resources = append(resources, mapping.Resource.GroupResource())
+	}
+	return resources, nil
+}
+
+// rbacPreflight checks every permission the upgrade of scope needs with SelfSubjectAccessReviews, before anything
+// is changed. It fails with a table of all the missing permissions.
+func (u *base) rbacPreflight(scope string, refs []*v1.ObjectReference) error {
+	if u.skipRBACPreflight {
+		return nil
+	}
+
+	u.log.Info("Checking permissions in the management and target clusters")
+	resources, err := u.refResources(refs)
+	if err != nil {
+		return err
+	}
+	clients := map[string]kubernetes.Interface{
+		managementCluster: u.managementKubernetesClient,
+		targetCluster:     u.targetKubernetesClient,
+	}
+	missing, err := missingPermissions(clients, u.requiredPermissions(scope, resources).sorted())
+	if err != nil {
+		return err
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	return errors.Errorf("missing permissions for the %s upgrade, grant them or rerun with --skip-rbac-preflight:\n%s",
+		scope, permissionTable(missing))
+}
+
+// missingPermissions returns the permissions that the SelfSubjectAccessReviews in their clusters don't allow.
+func missingPermissions(clients map[string]kubernetes.Interface, permissions []permission) ([]permission, error) {
+	var missing []permission
+	for _, p := range permissions {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace:   p.namespace,
+					Verb:        p.verb,
+					Group:       p.group,
+					Resource:    p.resource,
+					Subresource: p.subresource,
+				},
+			},
+		}
+		result, err := clients[p.cluster].AuthorizationV1().SelfSubjectAccessReviews().Create(review)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error checking permission to %s %s in the %s cluster", p.verb, p, p.cluster)
+		}
+		if !result.Status.Allowed {
+			missing = append(missing, p)
+		}
+	}
+	return missing, nil
+}
+
+func permissionTable(permissions []permission) string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CLUSTER\tNAMESPACE\tVERB\tRESOURCE")
+	for _, p := range permissions {
+		namespace := p.namespace
+		if namespace == "" {
+			namespace = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.cluster, namespace, p.verb, p)
+	}
+	w.Flush()
+	return buf.String()
+}
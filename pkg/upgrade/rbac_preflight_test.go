@@ -0,0 +1,150 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// accessReviewer returns a fake client whose SelfSubjectAccessReviews allow everything except the denied resources.
+func accessReviewer(denied ...string) *kubefake.Clientset {
+	client := kubefake.NewSimpleClientset()
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		review := action.(clienttesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attributes := review.Spec.ResourceAttributes
+		resource := attributes.Resource
+		if attributes.Subresource != "" {
+			resource += "/" + attributes.Subresource
+		}
+		review.Status.Allowed = true
+		for _, d := range denied {
+			if d == attributes.Verb+" "+resource {
+				review.Status.Allowed = false
+			}
+		}
+		return true, review, nil
+	})
+	return client
+}
+
+func TestRequiredPermissions(t *testing.T) {
+	refs := []schema.GroupResource{
+		{Group: "infrastructure.cluster.x-k8s.io", Resource: "awsmachinetemplates"},
+		{Group: "bootstrap.cluster.x-k8s.io", Resource: "kubeadmconfigtemplates"},
+	}
+
+	u := &base{clusterNamespace: "default"}
+	permissions := u.requiredPermissions(MachineDeploymentScope, refs)
+	assert.True(t, permissions[permission{cluster: managementCluster, namespace: "default", verb: "patch", group: "cluster.x-k8s.io", resource: "machinedeployments"}])
+	assert.True(t, permissions[permission{cluster: managementCluster, namespace: "default", verb: "create", group: "infrastructure.cluster.x-k8s.io", resource: "awsmachinetemplates"}])
+	assert.True(t, permissions[permission{cluster: managementCluster, namespace: "default", verb: "delete", group: "bootstrap.cluster.x-k8s.io", resource: "kubeadmconfigtemplates"}])
+	assert.True(t, permissions[permission{cluster: targetCluster, namespace: "kube-system", verb: "create", group: "rbac.authorization.k8s.io", resource: "roles"}])
+	assert.False(t, permissions[permission{cluster: targetCluster, verb: "create", resource: "pods", subresource: "eviction"}])
+
+	u.drain = true
+	permissions = u.requiredPermissions(MachineDeploymentScope, refs)
+	assert.True(t, permissions[permission{cluster: targetCluster, verb: "create", resource: "pods", subresource: "eviction"}])
+
+	u.drain = false
+	u.canary = CanaryConfig{MachineDeployment: "canary"}
+	permissions = u.requiredPermissions(MachineDeploymentScope, refs)
+	assert.True(t, permissions[permission{cluster: targetCluster, verb: "list", resource: "pods"}])
+	assert.False(t, permissions[permission{cluster: targetCluster, verb: "list", group: "apps", resource: "deployments"}])
+
+	u.canary.WorkloadSelector = "app=web"
+	permissions = u.requiredPermissions(MachineDeploymentScope, refs)
+	assert.True(t, permissions[permission{cluster: targetCluster, verb: "list", group: "apps", resource: "deployments"}])
+
+	permissions = u.requiredPermissions(ControlPlaneScope, nil)
+	assert.True(t, permissions[permission{cluster: targetCluster, namespace: "kube-system", verb: "create", resource: "pods", subresource: "exec"}])
+	assert.True(t, permissions[permission{cluster: targetCluster, namespace: "kube-system", verb: "update", resource: "configmaps"}])
+
+	// Worker machine upgrades garbage collect templates
+	permissions = u.requiredPermissions(WorkerMachineScope, refs)
+	assert.True(t, permissions[permission{cluster: managementCluster, namespace: "default", verb: "delete", group: "infrastructure.cluster.x-k8s.io", resource: "awsmachinetemplates"}])
+	permissions = u.requiredPermissions(ControlPlaneScope, refs)
+	assert.False(t, permissions[permission{cluster: managementCluster, namespace: "default", verb: "delete", group: "infrastructure.cluster.x-k8s.io", resource: "awsmachinetemplates"}])
+}
+
+func TestRefResources(t *testing.T) {
+	management := kubefake.NewSimpleClientset()
+	management.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "infrastructure.cluster.x-k8s.io/v1alpha2",
+			APIResources: []metav1.APIResource{
+				{Name: "examplemachineclasses", Kind: "ExampleMachineClass", Namespaced: true},
+			},
+		},
+		{
+			GroupVersion: "bootstrap.cluster.x-k8s.io/v1alpha2",
+			APIResources: []metav1.APIResource{
+				{Name: "kubeadmconfigtemplates", Kind: "KubeadmConfigTemplate", Namespaced: true},
+			},
+		},
+	}
+	u := &base{managementKubernetesClient: management}
+
+	// The plural of a kind isn't always its name with an s
+	resources, err := u.refResources([]*v1.ObjectReference{
+		{APIVersion: "infrastructure.cluster.x-k8s.io/v1alpha2", Kind: "ExampleMachineClass"},
+		{APIVersion: "bootstrap.cluster.x-k8s.io/v1alpha2", Kind: "KubeadmConfigTemplate"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []schema.GroupResource{
+		{Group: "infrastructure.cluster.x-k8s.io", Resource: "examplemachineclasses"},
+		{Group: "bootstrap.cluster.x-k8s.io", Resource: "kubeadmconfigtemplates"},
+	}, resources)
+
+	_, err = u.refResources([]*v1.ObjectReference{{APIVersion: "infrastructure.cluster.x-k8s.io/v1alpha2", Kind: "AWSMachine"}})
+	assert.Error(t, err, "kinds the management cluster doesn't serve should be rejected")
+}
+
+func TestMissingPermissions(t *testing.T) {
+	clients := map[string]kubernetes.Interface{
+		managementCluster: accessReviewer("create awsmachines"),
+		targetCluster:     accessReviewer("create pods/exec", "update configmaps"),
+	}
+
+	u := &base{clusterNamespace: "default"}
+	refs := []schema.GroupResource{{Group: "infrastructure.cluster.x-k8s.io", Resource: "awsmachines"}}
+	missing, err := missingPermissions(clients, u.requiredPermissions(ControlPlaneScope, refs).sorted())
+	require.NoError(t, err)
+
+	assert.Equal(t, []permission{
+		{cluster: managementCluster, namespace: "default", verb: "create", group: "infrastructure.cluster.x-k8s.io", resource: "awsmachines"},
+		{cluster: targetCluster, namespace: "kube-system", verb: "update", resource: "configmaps"},
+		{cluster: targetCluster, namespace: "kube-system", verb: "create", resource: "pods", subresource: "exec"},
+	}, missing)
+
+	assert.Equal(t, `CLUSTER     NAMESPACE    VERB    RESOURCE
+management  default      create  awsmachines.infrastructure.cluster.x-k8s.io
+target      kube-system  update  configmaps
+target      kube-system  create  pods/exec
+`, permissionTable(missing))
+}
+
+func TestRBACPreflightCanaryWithoutWorkloadSelector(t *testing.T) {
+	u := &base{
+		log:                        testLogger(),
+		clusterNamespace:           "default",
+		canary:                     CanaryConfig{MachineDeployment: "canary"},
+		managementKubernetesClient: accessReviewer(),
+		targetKubernetesClient:     accessReviewer("list pods"),
+	}
+
+	err := u.rbacPreflight(MachineDeploymentScope, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "target   *          list  pods")
+}
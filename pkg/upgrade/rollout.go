@@ -0,0 +1,166 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DefaultMachineDeploymentRolloutTimeout is how long to wait for a machine deployment to roll out if no timeout is
+// configured.
+const DefaultMachineDeploymentRolloutTimeout = 30 * time.Minute
+
+// rolloutProgress is a snapshot of how far a machine deployment has rolled out.
+type rolloutProgress struct {
+	Generation         int64
+	ObservedGeneration int64
+	Desired            int32
+	Replicas           int32
+	Updated            int32
+	Ready              int32
+	// OutdatedNodes are the nodes of the machine deployment that don't run the desired kubelet version yet.
+	OutdatedNodes []string
+}
+
+// Done returns true once the machine deployment controller has seen the latest spec, all replicas are updated and
+// ready, the old ones are gone and every node runs the desired kubelet version.
+func (p rolloutProgress) Done() bool {
+	return p.ObservedGeneration >= p.Generation &&
+		p.Replicas == p.Desired &&
+		p.Updated == p.Desired &&
+		p.Ready == p.Desired &&
+		len(p.OutdatedNodes) == 0
+}
+
+func (p rolloutProgress) String() string {
+	return fmt.Sprintf("observed generation %d/%d, %d/%d updated, %d/%d ready, %d replicas, %d outdated nodes",
+		p.ObservedGeneration, p.Generation, p.Updated, p.Desired, p.Ready, p.Desired, p.Replicas, len(p.OutdatedNodes))
+}
+
+// newRolloutProgress computes the rollout progress of machineDeployment from its status and the nodes of its
+// machines.
+func newRolloutProgress(machineDeployment *clusterapiv1alpha2.MachineDeployment, nodes []v1.Node, desiredVersion semver.Version) rolloutProgress {
+	desired := int32(1)
+	if machineDeployment.Spec.Replicas != nil {
+		desired = *machineDeployment.Spec.Replicas
+	}
+
+	return rolloutProgress{
+		Generation:         machineDeployment.Generation,
+		ObservedGeneration: machineDeployment.Status.ObservedGeneration,
+		Desired:            desired,
+		Replicas:           machineDeployment.Status.Replicas,
+		Updated:            machineDeployment.Status.UpdatedReplicas,
+		Ready:              machineDeployment.Status.ReadyReplicas,
+		OutdatedNodes:      outdatedNodes(nodes, desiredVersion),
+	}
+}
+
+// outdatedNodes returns the names of the nodes whose kubelet doesn't run desiredVersion. Only the major, minor and
+// patch versions are compared, since distributions add pre-release suffixes such as -eks-abc to the kubelet version.
+func outdatedNodes(nodes []v1.Node, desiredVersion semver.Version) []string {
+	var outdated []string
+	for _, node := range nodes {
+		v, err := semver.ParseTolerant(node.Status.NodeInfo.KubeletVersion)
+		if err != nil || v.Major != desiredVersion.Major || v.Minor != desiredVersion.Minor || v.Patch != desiredVersion.Patch {
+			outdated = append(outdated, node.Name)
+		}
+	}
+	return outdated
+}
+
+// waitForRollout polls machineDeployment until it has fully rolled out to version, logging its progress along the
+// way.
+func (u *MachineDeploymentUpgrader) waitForRollout(machineDeployment *clusterapiv1alpha2.MachineDeployment, version semver.Version, timeout time.Duration) error {
+	log := u.log.WithValues("namespace", machineDeployment.Namespace, "name", machineDeployment.Name)
+	log.Info("Waiting for MachineDeployment to roll out", "timeout", timeout)
+
+	var progress rolloutProgress
+	err := wait.PollImmediate(10*time.Second, timeout, func() (bool, error) {
+		current := &clusterapiv1alpha2.MachineDeployment{}
+		key := ctrlclient.ObjectKey{Namespace: machineDeployment.Namespace, Name: machineDeployment.Name}
+		if err := u.ctrlClient.Get(context.TODO(), key, current); err != nil {
+			return false, errors.Wrapf(err, "error getting machinedeployment %s", machineDeployment.Name)
+		}
+
+		nodes, err := u.machineDeploymentNodes(current)
+		if err != nil {
+			return false, err
+		}
+
+		progress = newRolloutProgress(current, nodes, version)
+		if progress.Done() {
+			return true, nil
+		}
+
+		log.Info("MachineDeployment rollout in progress", "progress", progress.String())
+		return false, nil
+	})
+
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("timed out after %s waiting for machinedeployment %s/%s to roll out: %s",
+			timeout, machineDeployment.Namespace, machineDeployment.Name, progress)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Info("MachineDeployment rolled out", "replicas", progress.Desired)
+	return nil
+}
+
+// machineDeploymentNodes returns the nodes of the machines selected by machineDeployment.
+func (u *MachineDeploymentUpgrader) machineDeploymentNodes(machineDeployment *clusterapiv1alpha2.MachineDeployment) ([]v1.Node, error) {
+	selector, err := metav1.LabelSelectorAsSelector(&machineDeployment.Spec.Selector)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid selector for machinedeployment %s", machineDeployment.Name)
+	}
+
+	machines := &clusterapiv1alpha2.MachineList{}
+	err = u.ctrlClient.List(context.TODO(), machines,
+		ctrlclient.InNamespace(machineDeployment.Namespace),
+		matchingSelector{selector},
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing machines of machinedeployment %s", machineDeployment.Name)
+	}
+
+	var nodes []v1.Node
+	for _, machine := range machines.Items {
+		if machine.Status.NodeRef == nil {
+			continue
+		}
+		node, err := u.targetKubernetesClient.CoreV1().Nodes().Get(machine.Status.NodeRef.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "error getting node %s", machine.Status.NodeRef.Name)
+		}
+		nodes = append(nodes, *node)
+	}
+
+	return nodes, nil
+}
+
+// matchingSelector filters a list by a label selector.
+type matchingSelector struct {
+	labels.Selector
+}
+
+func (m matchingSelector) ApplyToList(opts *ctrlclient.ListOptions) {
+	opts.LabelSelector = m.Selector
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func machineDeployment(replicas int32, status clusterapiv1alpha2.MachineDeploymentStatus) *clusterapiv1alpha2.MachineDeployment {
+	return &clusterapiv1alpha2.MachineDeployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "md", Generation: 2},
+		Spec: clusterapiv1alpha2.MachineDeploymentSpec{
+			Replicas: &replicas,
+			Selector: metav1.LabelSelector{MatchLabels: map[string]string{"pool": "md"}},
+		},
+		Status: status,
+	}
+}
+
+func TestRolloutProgress(t *testing.T) {
+	desired := semver.MustParse("1.15.3")
+	rolledOut := clusterapiv1alpha2.MachineDeploymentStatus{ObservedGeneration: 2, Replicas: 2, UpdatedReplicas: 2, ReadyReplicas: 2}
+
+	testcases := []struct {
+		name     string
+		status   clusterapiv1alpha2.MachineDeploymentStatus
+		nodes    []v1.Node
+		expected bool
+	}{
+		{
+			name:     "rolled out",
+			status:   rolledOut,
+			nodes:    []v1.Node{*node("a", "v1.15.3"), *node("b", "v1.15.3")},
+			expected: true,
+		},
+		{
+			name:     "kubelet versions with a pre-release suffix",
+			status:   rolledOut,
+			nodes:    []v1.Node{*node("a", "v1.15.3-eks-abc"), *node("b", "v1.15.3+build.1")},
+			expected: true,
+		},
+		{
+			name:     "spec change not observed yet",
+			status:   clusterapiv1alpha2.MachineDeploymentStatus{ObservedGeneration: 1, Replicas: 2, UpdatedReplicas: 2, ReadyReplicas: 2},
+			expected: false,
+		},
+		{
+			name:     "old replicas still around",
+			status:   clusterapiv1alpha2.MachineDeploymentStatus{ObservedGeneration: 2, Replicas: 3, UpdatedReplicas: 2, ReadyReplicas: 3},
+			expected: false,
+		},
+		{
+			name:     "updated replicas not ready",
+			status:   clusterapiv1alpha2.MachineDeploymentStatus{ObservedGeneration: 2, Replicas: 2, UpdatedReplicas: 2, ReadyReplicas: 1},
+			expected: false,
+		},
+		{
+			name:     "node still runs the old kubelet",
+			status:   rolledOut,
+			nodes:    []v1.Node{*node("a", "v1.15.3"), *node("b", "v1.14.6")},
+			expected: false,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			progress := newRolloutProgress(machineDeployment(2, tc.status), tc.nodes, desired)
+			assert.Equal(t, tc.expected, progress.Done(), progress.String())
+		})
+	}
+}
+
+func TestWaitForRollout(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clusterapiv1alpha2.AddToScheme(scheme))
+
+	done := machineDeployment(1, clusterapiv1alpha2.MachineDeploymentStatus{ObservedGeneration: 2, Replicas: 1, UpdatedReplicas: 1, ReadyReplicas: 1})
+	machine := &clusterapiv1alpha2.Machine{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "md-machine", Labels: map[string]string{"pool": "md"}},
+		Status:     clusterapiv1alpha2.MachineStatus{NodeRef: &v1.ObjectReference{Name: "md-node"}},
+	}
+
+	newUpgrader := func(kubeletVersion string) *MachineDeploymentUpgrader {
+		return &MachineDeploymentUpgrader{
+			base: &base{
+				log:                    testLogger(),
+				desiredVersion:         semver.MustParse("1.15.3"),
+				ctrlClient:             fake.NewFakeClientWithScheme(scheme, done.DeepCopy(), machine.DeepCopy()),
+				targetKubernetesClient: kubefake.NewSimpleClientset(node("md-node", kubeletVersion)),
+			},
+		}
+	}
+
+	assert.NoError(t, newUpgrader("v1.15.3").waitForRollout(done, semver.MustParse("1.15.3"), time.Second))
+
+	err := newUpgrader("v1.14.6").waitForRollout(done, semver.MustParse("1.15.3"), time.Millisecond)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "default/md")
+}
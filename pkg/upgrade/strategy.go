@@ -0,0 +1,121 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// OriginalStrategyAnnotationKey stores the strategy a machine deployment had before the upgrade overrode it, so it
+// can be restored even if the upgrade is resumed by another run.
+const OriginalStrategyAnnotationKey = "cluster-api-upgrade-tool/original-strategy"
+
+// parseRollingUpdate returns the rolling update strategy to use during the upgrade, or nil if neither maxSurge nor
+// maxUnavailable is set.
+func parseRollingUpdate(maxSurge, maxUnavailable string) (*clusterapiv1alpha2.MachineRollingUpdateDeployment, error) {
+	if maxSurge == "" && maxUnavailable == "" {
+		return nil, nil
+	}
+
+	rollingUpdate := &clusterapiv1alpha2.MachineRollingUpdateDeployment{}
+	zero := true
+	for _, f := range []struct {
+		name  string
+		value string
+		dest  **intstr.IntOrString
+	}{
+		{"max surge", maxSurge, &rollingUpdate.MaxSurge},
+		{"max unavailable", maxUnavailable, &rollingUpdate.MaxUnavailable},
+	} {
+		if f.value == "" {
+			zero = false
+			continue
+		}
+		v := intstr.Parse(f.value)
+		scaled, err := intstr.GetValueFromIntOrPercent(&v, 100, true)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s %q", f.name, f.value)
+		}
+		if scaled < 0 {
+			return nil, errors.Errorf("%s must not be negative, got %q", f.name, f.value)
+		}
+		if scaled > 0 {
+			zero = false
+		}
+		*f.dest = &v
+	}
+
+	if zero {
+		return nil, errors.New("max surge and max unavailable must not both be 0")
+	}
+
+	return rollingUpdate, nil
+}
+
+// overrideStrategy sets the rolling update strategy of machineDeployment to rollingUpdate. The original strategy is
+// saved in an annotation, unless a previous run already saved it.
+func overrideStrategy(machineDeployment *clusterapiv1alpha2.MachineDeployment, rollingUpdate *clusterapiv1alpha2.MachineRollingUpdateDeployment) error {
+	if _, ok := machineDeployment.Annotations[OriginalStrategyAnnotationKey]; !ok {
+		original, err := json.Marshal(machineDeployment.Spec.Strategy)
+		if err != nil {
+			return errors.Wrapf(err, "error saving strategy of machinedeployment %s", machineDeployment.Name)
+		}
+		if machineDeployment.Annotations == nil {
+			machineDeployment.Annotations = map[string]string{}
+		}
+		machineDeployment.Annotations[OriginalStrategyAnnotationKey] = string(original)
+	}
+
+	machineDeployment.Spec.Strategy = &clusterapiv1alpha2.MachineDeploymentStrategy{
+		Type:          clusterapiv1alpha2.RollingUpdateMachineDeploymentStrategyType,
+		RollingUpdate: rollingUpdate.DeepCopy(),
+	}
+	return nil
+}
+
+// restoreStrategy puts back the strategy saved by overrideStrategy and removes the annotation. It returns false if
+// there was nothing to restore.
+func restoreStrategy(machineDeployment *clusterapiv1alpha2.MachineDeployment) (bool, error) {
+	original, ok := machineDeployment.Annotations[OriginalStrategyAnnotationKey]
+	if !ok {
+		return false, nil
+	}
+
+	var strategy *clusterapiv1alpha2.MachineDeploymentStrategy
+	if err := json.Unmarshal([]byte(original), &strategy); err != nil {
+		return false, errors.Wrapf(err, "error reading original strategy of machinedeployment %s", machineDeployment.Name)
+	}
+
+	machineDeployment.Spec.Strategy = strategy
+	delete(machineDeployment.Annotations, OriginalStrategyAnnotationKey)
+	return true, nil
+}
+
+// restoreMachineDeploymentStrategy patches the machine deployment back to the strategy it had before the upgrade.
+func (u *MachineDeploymentUpgrader) restoreMachineDeploymentStrategy(machineDeployment *clusterapiv1alpha2.MachineDeployment) error {
+	current := &clusterapiv1alpha2.MachineDeployment{}
+	key := ctrlclient.ObjectKey{Namespace: machineDeployment.Namespace, Name: machineDeployment.Name}
+	if err := u.ctrlClient.Get(context.TODO(), key, current); err != nil {
+		return errors.Wrapf(err, "error getting machinedeployment %s", machineDeployment.Name)
+	}
+
+	original := current.DeepCopy()
+	restored, err := restoreStrategy(current)
+	if err != nil || !restored {
+		return err
+	}
+
+	u.log.Info("Restoring MachineDeployment strategy", "namespace", machineDeployment.Namespace, "name", machineDeployment.Name)
+	if err := u.ctrlClient.Patch(context.TODO(), current, ctrlclient.MergeFrom(original)); err != nil {
+		return errors.Wrapf(err, "error restoring strategy of machinedeployment %s", machineDeployment.Name)
+	}
+
+	return nil
+}
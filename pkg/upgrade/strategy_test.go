@@ -0,0 +1,109 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestParseRollingUpdate(t *testing.T) {
+	testcases := []struct {
+		name           string
+		maxSurge       string
+		maxUnavailable string
+		expected       *clusterapiv1alpha2.MachineRollingUpdateDeployment
+		expectErr      bool
+	}{
+		{
+			name: "not set",
+		},
+		{
+			name:           "numbers",
+			maxSurge:       "3",
+			maxUnavailable: "0",
+			expected: &clusterapiv1alpha2.MachineRollingUpdateDeployment{
+				MaxSurge:       intOrStringPtr(intstr.FromInt(3)),
+				MaxUnavailable: intOrStringPtr(intstr.FromInt(0)),
+			},
+		},
+		{
+			name:     "percentage",
+			maxSurge: "50%",
+			expected: &clusterapiv1alpha2.MachineRollingUpdateDeployment{
+				MaxSurge: intOrStringPtr(intstr.FromString("50%")),
+			},
+		},
+		{
+			name:           "both zero",
+			maxSurge:       "0",
+			maxUnavailable: "0%",
+			expectErr:      true,
+		},
+		{
+			name:      "negative",
+			maxSurge:  "-1",
+			expectErr: true,
+		},
+		{
+			name:      "garbage",
+			maxSurge:  "lots",
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := parseRollingUpdate(tc.maxSurge, tc.maxUnavailable)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestOverrideAndRestoreStrategy(t *testing.T) {
+	originalStrategy := &clusterapiv1alpha2.MachineDeploymentStrategy{
+		Type: clusterapiv1alpha2.RollingUpdateMachineDeploymentStrategyType,
+		RollingUpdate: &clusterapiv1alpha2.MachineRollingUpdateDeployment{
+			MaxSurge:       intOrStringPtr(intstr.FromInt(1)),
+			MaxUnavailable: intOrStringPtr(intstr.FromInt(1)),
+		},
+	}
+	override := &clusterapiv1alpha2.MachineRollingUpdateDeployment{
+		MaxSurge:       intOrStringPtr(intstr.FromInt(5)),
+		MaxUnavailable: intOrStringPtr(intstr.FromInt(0)),
+	}
+
+	for _, strategy := range []*clusterapiv1alpha2.MachineDeploymentStrategy{originalStrategy, nil} {
+		machineDeployment := &clusterapiv1alpha2.MachineDeployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "md"},
+			Spec:       clusterapiv1alpha2.MachineDeploymentSpec{Strategy: strategy.DeepCopy()},
+		}
+
+		require.NoError(t, overrideStrategy(machineDeployment, override))
+		assert.Equal(t, override, machineDeployment.Spec.Strategy.RollingUpdate)
+
+		// a resumed upgrade must not overwrite the saved strategy with the override
+		require.NoError(t, overrideStrategy(machineDeployment, override))
+
+		restored, err := restoreStrategy(machineDeployment)
+		require.NoError(t, err)
+		assert.True(t, restored)
+		assert.Equal(t, strategy, machineDeployment.Spec.Strategy)
+		assert.NotContains(t, machineDeployment.Annotations, OriginalStrategyAnnotationKey)
+
+		restored, err = restoreStrategy(machineDeployment)
+		require.NoError(t, err)
+		assert.False(t, restored)
+	}
+}
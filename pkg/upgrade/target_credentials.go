@@ -0,0 +1,140 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/rest"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	"sigs.k8s.io/cluster-api/controllers/external"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// newTargetRestConfig builds the rest config of the target cluster from the configured credential source. Without
+// one, it uses the first source found by discoverRestConfig.
+func newTargetRestConfig(log logr.Logger, c ctrlclient.Client, secretClient secrets, cluster *clusterapiv1alpha2.Cluster, keyPair KeyPairConfig, identity ClientCertificate) (*rest.Config, error) {
+	// keyPair should have been validated, but if not this is defining an order for us
+	if keyPair.KubeconfigSecretRef != "" {
+		log.Info("Using target cluster credentials", "source", "kubeconfig secret", "secret", keyPair.KubeconfigSecretRef)
+		return NewRestConfigFromKubeconfigSecretRef(secretClient, keyPair.KubeconfigSecretRef)
+	}
+	if keyPair.Kubeconfig != "" {
+		log.Info("Using target cluster credentials", "source", "kubeconfig file", "file", keyPair.Kubeconfig)
+		return NewRestConfigFromKubeconfigFile(keyPair.Kubeconfig)
+	}
+	if keyPair.SecretRef == "" && keyPair.ClusterField == "" && keyPair.CACertFile == "" {
+		return discoverRestConfig(log, c, secretClient, cluster, keyPair.APIEndpoint, identity)
+	}
+
+	apiEndpoint, err := discoverAPIEndpoint(c, cluster, keyPair.APIEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case keyPair.SecretRef != "":
+		log.Info("Using target cluster credentials", "source", "CA secret", "secret", keyPair.SecretRef, "endpoint", apiEndpoint,
+			"user", identity.User, "groups", identity.Groups, "ttl", identity.TTL)
+		return NewRestConfigFromCASecretRef(secretClient, keyPair.SecretRef, apiEndpoint, identity)
+	case keyPair.CACertFile != "":
+		log.Info("Using target cluster credentials", "source", "CA files", "cert", keyPair.CACertFile, "key", keyPair.CAKeyFile,
+			"endpoint", apiEndpoint, "user", identity.User, "groups", identity.Groups, "ttl", identity.TTL)
+		return NewRestConfigFromCAFiles(keyPair.CACertFile, keyPair.CAKeyFile, apiEndpoint, identity)
+	default:
+		log.Info("Using target cluster credentials", "source", "cluster field", "field", keyPair.ClusterField, "endpoint", apiEndpoint,
+			"user", identity.User, "groups", identity.Groups, "ttl", identity.TTL)
+		return NewRestConfigFromCAClusterField(cluster, keyPair.ClusterField, apiEndpoint, identity)
+	}
+}
+
+// discoverRestConfig follows the Cluster API conventions for target cluster credentials. It tries the kubeconfig in
+// the <cluster>-kubeconfig secret, then the CA key pair in the <cluster>-ca secret, then the CA key pair in the
+// provider's field of the infrastructure cluster.
+func discoverRestConfig(log logr.Logger, c ctrlclient.Client, secretClient secrets, cluster *clusterapiv1alpha2.Cluster, apiEndpointOverride string, identity ClientCertificate) (*rest.Config, error) {
+	kubeconfigSecret := cluster.GetName() + "-kubeconfig"
+	found, err := secretExists(secretClient, kubeconfigSecret)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		log.Info("Using target cluster credentials", "source", "kubeconfig secret", "secret", kubeconfigSecret)
+		return NewRestConfigFromKubeconfigSecretRef(secretClient, kubeconfigSecret)
+	}
+
+	caSecret := cluster.GetName() + "-ca"
+	found, err = secretExists(secretClient, caSecret)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		apiEndpoint, err := discoverAPIEndpoint(c, cluster, apiEndpointOverride)
+		if err != nil {
+			return nil, err
+		}
+		log.Info("Using target cluster credentials", "source", "CA secret", "secret", caSecret, "endpoint", apiEndpoint,
+			"user", identity.User, "groups", identity.Groups, "ttl", identity.TTL)
+		return NewRestConfigFromCATLSSecret(secretClient, caSecret, apiEndpoint, identity)
+	}
+
+	infraCluster, field, err := infrastructureCAKeyPair(c, cluster)
+	if err != nil {
+		return nil, err
+	}
+	if infraCluster != nil {
+		apiEndpoint, err := discoverAPIEndpoint(c, cluster, apiEndpointOverride)
+		if err != nil {
+			return nil, err
+		}
+		log.Info("Using target cluster credentials", "source", "infrastructure cluster field",
+			"kind", infraCluster.GetKind(), "name", infraCluster.GetName(), "field", field, "endpoint", apiEndpoint,
+			"user", identity.User, "groups", identity.Groups, "ttl", identity.TTL)
+		return restConfigFromCAField(infraCluster.Object, field, apiEndpoint, identity)
+	}
+
+	return nil, errors.Errorf("no credentials found for cluster %s/%s in secret %s, secret %s or its infrastructure cluster, set one of [--ca-secret, --ca-field, --kubeconfig-secret, --target-kubeconfig, or --ca-cert-file and --ca-key-file]",
+		cluster.GetNamespace(), cluster.GetName(), kubeconfigSecret, caSecret)
+}
+
+func secretExists(secretClient secrets, name string) (bool, error) {
+	_, err := secretClient.Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "error retrieving secret %q", name)
+	}
+	return true, nil
+}
+
+// infrastructureCAKeyPair returns the cluster's infrastructure cluster and the provider's CA key pair field in it. It
+// returns a nil infrastructure cluster if there's none or if it doesn't have the field.
+func infrastructureCAKeyPair(c ctrlclient.Client, cluster *clusterapiv1alpha2.Cluster) (*unstructured.Unstructured, string, error) {
+	ref := cluster.Spec.InfrastructureRef
+	if ref == nil {
+		return nil, "", nil
+	}
+	field := providerForKind(ref.Kind).CAKeyPairField()
+	if field == "" {
+		return nil, "", nil
+	}
+
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = cluster.GetNamespace()
+	}
+	infraCluster, err := external.Get(c, ref, namespace)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "error getting infrastructure cluster of cluster %s/%s", cluster.GetNamespace(), cluster.GetName())
+	}
+
+	if _, found, _ := unstructured.NestedFieldNoCopy(infraCluster.Object, strings.Split(field, ".")...); !found {
+		return nil, "", nil
+	}
+	return infraCluster, field, nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	"sigs.k8s.io/cluster-api/util/certs"
+)
+
+// secretMap is a secrets client backed by a map of secret names to their data.
+type secretMap map[string]map[string][]byte
+
+func (s secretMap) Get(name string, _ metav1.GetOptions) (*v1.Secret, error) {
+	data, ok := s[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, name)
+	}
+	return &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name}, Data: data}, nil
+}
+
+func TestDiscoverRestConfig(t *testing.T) {
+	kubeconfigYaml := []byte(`
+apiVersion: v1
+kind: Config
+clusters:
+- name: my-cluster
+  cluster:
+    server: https://kubeconfig:6443
+    insecure-skip-tls-verify: true
+users:
+- name: admin
+  user:
+    token: token
+contexts:
+- name: admin@my-cluster
+  context:
+    cluster: my-cluster
+    user: admin
+current-context: admin@my-cluster
+`)
+	ca, caPrivateKey := testCA(t, 24*time.Hour)
+	caCert, caKey := certs.EncodeCertPEM(ca), certs.EncodePrivateKeyPEM(caPrivateKey)
+
+	cluster := &clusterapiv1alpha2.Cluster{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "my-cluster"},
+		Status: clusterapiv1alpha2.ClusterStatus{
+			APIEndpoints: []clusterapiv1alpha2.APIEndpoint{{Host: "10.0.0.1", Port: 6443}},
+		},
+	}
+
+	testcases := []struct {
+		name          string
+		secrets       secretMap
+		expectedHost  string
+		expectedError bool
+	}{
+		{
+			name: "kubeconfig secret first",
+			secrets: secretMap{
+				"my-cluster-kubeconfig": {kubeconfigSecretKey: kubeconfigYaml},
+				"my-cluster-ca":         {v1.TLSCertKey: caCert},
+			},
+			expectedHost: "https://kubeconfig:6443",
+		},
+		{
+			name: "ca secret with the endpoint from the cluster status",
+			secrets: secretMap{
+				"my-cluster-ca": {v1.TLSCertKey: caCert, v1.TLSPrivateKeyKey: caKey},
+			},
+			expectedHost: "https://10.0.0.1:6443",
+		},
+		{
+			name: "ca secret without a key",
+			secrets: secretMap{
+				"my-cluster-ca": {v1.TLSCertKey: caCert},
+			},
+			expectedError: true,
+		},
+		{
+			name:          "nothing found",
+			secrets:       secretMap{},
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := discoverRestConfig(testLogger(), nil, tc.secrets, cluster, "", ClientCertificate{User: "cluster-api-upgrade-tool:1234", TTL: time.Hour})
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedHost, config.Host)
+		})
+	}
+}
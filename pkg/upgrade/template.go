@@ -0,0 +1,406 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	"sigs.k8s.io/cluster-api/controllers/external"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// updateInfrastructureMachine sets the image and machine class of a cloned infrastructure machine and applies the
+// infrastructure field updates to it.
+func (u *base) updateInfrastructureMachine(object *unstructured.Unstructured) error {
+	return u.updateInfrastructureObject(object, "")
+}
+
+// updateInfrastructureTemplate does the same for a cloned infrastructure machine template, whose machine spec is
+// nested under spec.template.
+func (u *base) updateInfrastructureTemplate(object *unstructured.Unstructured) error {
+	return u.updateInfrastructureObject(object, "spec.template")
+}
+
+func (u *base) updateInfrastructureObject(object *unstructured.Unstructured, prefix string) error {
+	imageField, err := u.infrastructureImageFieldFor(object.GetKind())
+	if err != nil {
+		return err
+	}
+	if err := setNestedString(object, prefix, imageField, u.imageID); err != nil {
+		return err
+	}
+
+	machineClassField, err := u.machineClassFieldFor(object.GetKind())
+	if err != nil {
+		return err
+	}
+	if err := setNestedString(object, prefix, machineClassField, u.machineClass); err != nil {
+		return err
+	}
+
+	var path []string
+	if prefix != "" {
+		path = strings.Split(prefix, ".")
+	}
+	updated, err := applyFieldUpdates(object.Object, u.fieldUpdates, FieldUpdateTargetInfrastructure, path...)
+	if err != nil {
+		return errors.Wrapf(err, "error updating %s %s", object.GetKind(), object.GetName())
+	}
+	object.Object = updated
+	return nil
+}
+
+// setNestedString sets the dotted field under prefix to value, unless field is empty.
+func setNestedString(object *unstructured.Unstructured, prefix, field, value string) error {
+	if field == "" {
+		return nil
+	}
+	if prefix != "" {
+		field = prefix + "." + field
+	}
+
+	if err := unstructured.SetNestedField(object.Object, value, strings.Split(field, ".")...); err != nil {
+		return errors.Wrapf(err, "error setting %s field %q to %q", object.GetKind(), field, value)
+	}
+	return nil
+}
+
+// machineClassFieldFor returns the instance type field of the provider of kind, or "" if no machine class is set.
+func (u *base) machineClassFieldFor(kind string) (string, error) {
+	if u.machineClass == "" {
+		return "", nil
+	}
+	if field := providerForKind(kind).InstanceTypeField(); field != "" {
+		return field, nil
+	}
+	return "", errors.Errorf("the instance type field of %s is unknown, set it with an infrastructure field update instead of a machine class", kind)
+}
+
+// infrastructureImageFieldFor returns the image field of infrastructure machines of kind. That is the configured
+// one or, unless the image only goes into the machine spec, the one of the kind's provider. It returns "" if the
+// infrastructure machines don't get an image.
+func (u *base) infrastructureImageFieldFor(kind string) (string, error) {
+	if u.imageID == "" {
+		return "", nil
+	}
+	if u.infrastructureImageField != "" {
+		return u.infrastructureImageField, nil
+	}
+	if u.imageField != "" {
+		return "", nil
+	}
+	if field := providerForKind(kind).ImageField(); field != "" {
+		return field, nil
+	}
+	return "", errors.Errorf("the image field of %s is unknown, set the infrastructure image field", kind)
+}
+
+// rotateInfrastructureTemplate clones the infrastructure template template refers to, sets the image and machine class
+// on the clone and points template at it. Templates are never modified in place because the machines of older MachineSets still
+// refer to them.
+func (u *base) rotateInfrastructureTemplate(namespace string, template *clusterapiv1alpha2.MachineTemplateSpec) error {
+	ref := &template.Spec.InfrastructureRef
+	imageField, err := u.infrastructureImageFieldFor(ref.Kind)
+	if err != nil {
+		return err
+	}
+	if imageField == "" && u.machineClass == "" && !hasFieldUpdates(u.fieldUpdates, FieldUpdateTargetInfrastructure) {
+		return nil
+	}
+
+	if ref.Namespace != "" {
+		namespace = ref.Namespace
+	}
+
+	source, err := external.Get(u.ctrlClient, ref, namespace)
+	if err != nil {
+		return errors.Wrapf(err, "error getting %s %s/%s", ref.Kind, namespace, ref.Name)
+	}
+
+	name, err := templateCloneName(source, u.upgradeID)
+	if err != nil {
+		return err
+	}
+	clone := cloneObject(source, name, u.upgradeID)
+	if err := u.updateInfrastructureTemplate(clone); err != nil {
+		return err
+	}
+
+	u.log.Info("Creating infrastructure template", "kind", ref.Kind, "namespace", namespace, "name", name, "source", source.GetName())
+	if err := u.createTemplateClone(source, clone, u.updateInfrastructureTemplate); err != nil {
+		return err
+	}
+
+	ref.Name = name
+	ref.ResourceVersion = ""
+	ref.UID = ""
+	return nil
+}
+
+// rotateBootstrapTemplate clones the bootstrap config template template refers to, such as a KubeadmConfigTemplate,
+// applies the bootstrap config patch to the clone and points template at it.
+func (u *base) rotateBootstrapTemplate(namespace string, template *clusterapiv1alpha2.MachineTemplateSpec) error {
+	if len(u.bootstrapConfigPatch) == 0 {
+		return nil
+	}
+
+	ref := template.Spec.Bootstrap.ConfigRef
+	if ref == nil {
+		return errors.New("cannot apply the bootstrap config patch to a machine template without a bootstrap config reference")
+	}
+	if ref.Namespace != "" {
+		namespace = ref.Namespace
+	}
+
+	source, err := external.Get(u.ctrlClient, ref, namespace)
+	if err != nil {
+		return errors.Wrapf(err, "error getting %s %s/%s", ref.Kind, namespace, ref.Name)
+	}
+
+	patched, err := mergePatchObject(source, u.bootstrapConfigPatch)
+	if err != nil {
+		return errors.Wrapf(err, "error patching %s %s/%s", ref.Kind, namespace, ref.Name)
+	}
+
+	name, err := templateCloneName(source, u.upgradeID)
+	if err != nil {
+		return err
+	}
+	clone := cloneObject(patched, name, u.upgradeID)
+
+	u.log.Info("Creating bootstrap config template", "kind", ref.Kind, "namespace", namespace, "name", name, "source", source.GetName())
+	if err := u.createTemplateClone(source, clone, u.patchBootstrapTemplate); err != nil {
+		return err
+	}
+
+	ref.Name = name
+	ref.ResourceVersion = ""
+	ref.UID = ""
+	return nil
+}
+
+// createTemplateClone creates clone of source. If a previous run of the same upgrade already created it, the existing
+// clone is used as long as it was cloned from source and update, which makes the changes of the upgrade, doesn't
+// change it anymore. Anything else that has the clone's name is an error.
+func (u *base) createTemplateClone(source, clone *unstructured.Unstructured, update func(*unstructured.Unstructured) error) error {
+	err := u.ctrlClient.Create(context.TODO(), clone)
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "error creating %s %s/%s", clone.GetKind(), clone.GetNamespace(), clone.GetName())
+	}
+
+	existing := &unstructured.Unstructured{}
+	existing.SetGroupVersionKind(clone.GroupVersionKind())
+	key := ctrlclient.ObjectKey{Namespace: clone.GetNamespace(), Name: clone.GetName()}
+	if err := u.ctrlClient.Get(context.TODO(), key, existing); err != nil {
+		return errors.Wrapf(err, "error getting %s %s/%s", clone.GetKind(), clone.GetNamespace(), clone.GetName())
+	}
+
+	if !createdFor(existing, u.upgradeID, source.GetName()) {
+		return errors.Errorf("%s %s/%s already exists and wasn't cloned from %s for upgrade %s",
+			clone.GetKind(), clone.GetNamespace(), clone.GetName(), source.GetName(), u.upgradeID)
+	}
+
+	updated := existing.DeepCopy()
+	if err := update(updated); err != nil {
+		return err
+	}
+	if !equality.Semantic.DeepEqual(existing.Object["spec"], updated.Object["spec"]) {
+		return errors.Errorf("%s %s/%s already exists without the changes of upgrade %s",
+			clone.GetKind(), clone.GetNamespace(), clone.GetName(), u.upgradeID)
+	}
+
+	u.log.Info("Using template created by a previous run", "kind", clone.GetKind(), "namespace", clone.GetNamespace(), "name", clone.GetName())
+	return nil
+}
+
+// patchBootstrapTemplate applies the bootstrap config patch to object.
+func (u *base) patchBootstrapTemplate(object *unstructured.Unstructured) error {
+	patched, err := mergePatchObject(object, u.bootstrapConfigPatch)
+	if err != nil {
+		return errors.Wrapf(err, "error patching %s %s/%s", object.GetKind(), object.GetNamespace(), object.GetName())
+	}
+	object.Object = patched.Object
+	return nil
+}
+
+// loadBootstrapConfigPatch reads a JSON merge patch, in YAML or JSON, from path.
+func loadBootstrapConfigPatch(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading bootstrap config patch")
+	}
+
+	patch, err := yaml.YAMLToJSON(raw)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing bootstrap config patch %s", path)
+	}
+
+	var object map[string]interface{}
+	if err := json.Unmarshal(patch, &object); err != nil {
+		return nil, errors.Errorf("bootstrap config patch %s must be an object", path)
+	}
+
+	return patch, nil
+}
+
+// mergePatchObject returns a copy of object with the JSON merge patch applied.
+func mergePatchObject(object *unstructured.Unstructured, patch []byte) (*unstructured.Unstructured, error) {
+	original, err := json.Marshal(object.Object)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	patched, err := jsonpatch.MergePatch(original, patch)
+	if err != nil {
+		return nil, errors.Wrap(err, "error applying merge patch")
+	}
+
+	result := &unstructured.Unstructured{}
+	if err := json.Unmarshal(patched, &result.Object); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return result, nil
+}
+
+// cloneObject returns a copy of source that can be created under name. The copy is labelled with the upgrade ID and
+// remembers the source and the name the source started out with.
+func cloneObject(source *unstructured.Unstructured, name, upgradeID string) *unstructured.Unstructured {
+	clone := source.DeepCopy()
+	clone.SetName(name)
+	clone.SetResourceVersion("")
+	clone.SetUID("")
+	clone.SetCreationTimestamp(metav1.Time{})
+	clone.SetOwnerReferences(nil)
+	unstructured.RemoveNestedField(clone.Object, "status")
+
+	labels := clone.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[UpgradeIDLabelKey] = upgradeID
+	clone.SetLabels(labels)
+
+	annotations := clone.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[NamePrefixAnnotationKey] = namePrefix(source)
+	annotations[ReplacesAnnotationKey] = source.GetName()
+	clone.SetAnnotations(annotations)
+
+	return clone
+}
+
+// garbageCollectTemplates deletes the infrastructure and bootstrap config templates created by this tool, in any
+// upgrade, that no MachineDeployment and no MachineSet refers to anymore. The kinds of templates are taken from both,
+// since worker machine upgrades rotate the templates of MachineSets without a MachineDeployment.
+func (u *base) garbageCollectTemplates() error {
+	machineDeployments := &clusterapiv1alpha2.MachineDeploymentList{}
+	if err := u.ctrlClient.List(context.TODO(), machineDeployments, ctrlclient.InNamespace(u.clusterNamespace)); err != nil {
+		return errors.Wrap(err, "error listing machine deployments")
+	}
+	machineSets := &clusterapiv1alpha2.MachineSetList{}
+	if err := u.ctrlClient.List(context.TODO(), machineSets, ctrlclient.InNamespace(u.clusterNamespace)); err != nil {
+		return errors.Wrap(err, "error listing machine sets")
+	}
+
+	kinds := make(map[schema.GroupVersionKind]bool)
+	for _, machineDeployment := range machineDeployments.Items {
+		for _, ref := range templateRefs(machineDeployment.Spec.Template) {
+			kinds[ref.GroupVersionKind()] = true
+		}
+	}
+	for _, machineSet := range machineSets.Items {
+		for _, ref := range templateRefs(machineSet.Spec.Template) {
+			kinds[ref.GroupVersionKind()] = true
+		}
+	}
+
+	createdByTool, err := labels.NewRequirement(UpgradeIDLabelKey, selection.Exists, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var templates []unstructured.Unstructured
+	for gvk := range kinds {
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+		err := u.ctrlClient.List(context.TODO(), list,
+			ctrlclient.InNamespace(u.clusterNamespace),
+			matchingSelector{labels.NewSelector().Add(*createdByTool)},
+		)
+		if err != nil {
+			return errors.Wrapf(err, "error listing %s objects", gvk.Kind)
+		}
+		templates = append(templates, list.Items...)
+	}
+
+	for _, template := range unreferencedTemplates(templates, machineDeployments.Items, machineSets.Items) {
+		u.log.Info("Deleting unused template", "kind", template.GetKind(), "namespace", template.GetNamespace(), "name", template.GetName())
+		if err := u.ctrlClient.Delete(context.TODO(), template); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "error deleting %s %s/%s", template.GetKind(), template.GetNamespace(), template.GetName())
+		}
+	}
+
+	return nil
+}
+
+// unreferencedTemplates returns the templates that no machine deployment and no machine set refers to. Machine sets
+// scaled down to 0 keep their templates, they are what a machine deployment is rolled back to.
+func unreferencedTemplates(templates []unstructured.Unstructured, machineDeployments []clusterapiv1alpha2.MachineDeployment, machineSets []clusterapiv1alpha2.MachineSet) []*unstructured.Unstructured {
+	inUse := sets.NewString()
+	use := func(template clusterapiv1alpha2.MachineTemplateSpec) {
+		for _, ref := range templateRefs(template) {
+			inUse.Insert(objectKey(ref.Kind, ref.Name))
+		}
+	}
+
+	for _, machineDeployment := range machineDeployments {
+		use(machineDeployment.Spec.Template)
+	}
+	for _, machineSet := range machineSets {
+		use(machineSet.Spec.Template)
+	}
+
+	var unreferenced []*unstructured.Unstructured
+	for i := range templates {
+		template := &templates[i]
+		if !inUse.Has(objectKey(template.GetKind(), template.GetName())) {
+			unreferenced = append(unreferenced, template)
+		}
+	}
+	return unreferenced
+}
+
+// templateRefs returns the infrastructure and bootstrap config references of a machine template.
+func templateRefs(template clusterapiv1alpha2.MachineTemplateSpec) []*v1.ObjectReference {
+	refs := []*v1.ObjectReference{&template.Spec.InfrastructureRef}
+	if template.Spec.Bootstrap.ConfigRef != nil {
+		refs = append(refs, template.Spec.Bootstrap.ConfigRef)
+	}
+	return refs
+}
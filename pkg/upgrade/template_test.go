@@ -0,0 +1,452 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func awsMachineTemplate(name string, labels map[string]string) unstructured.Unstructured {
+	template := unstructured.Unstructured{}
+	template.SetAPIVersion("infrastructure.cluster.x-k8s.io/v1alpha2")
+	template.SetKind("AWSMachineTemplate")
+	template.SetNamespace("default")
+	template.SetName(name)
+	template.SetLabels(labels)
+	return template
+}
+
+func TestCloneInfrastructureTemplate(t *testing.T) {
+	source := awsMachineTemplate("workers", map[string]string{"pool": "workers"})
+	source.SetResourceVersion("42")
+	source.SetUID("1234")
+	source.SetOwnerReferences([]metav1.OwnerReference{{Kind: "Cluster", Name: "my-cluster"}})
+	require.NoError(t, unstructured.SetNestedField(source.Object, "ami-old", "spec", "template", "spec", "ami", "id"))
+	require.NoError(t, unstructured.SetNestedField(source.Object, "m5.large", "spec", "template", "spec", "instanceType"))
+	require.NoError(t, unstructured.SetNestedField(source.Object, true, "status", "ready"))
+
+	u := &base{imageID: "ami-new", infrastructureImageField: "spec.ami.id"}
+
+	clone := cloneObject(&source, "workers-abc", "upgrade")
+	require.NoError(t, u.updateInfrastructureTemplate(clone))
+
+	assert.Equal(t, "workers-abc", clone.GetName())
+	assert.Empty(t, clone.GetResourceVersion())
+	assert.Empty(t, clone.GetUID())
+	assert.Empty(t, clone.GetOwnerReferences())
+	assert.Equal(t, map[string]string{"pool": "workers", UpgradeIDLabelKey: "upgrade"}, clone.GetLabels())
+	assert.Equal(t, "workers", clone.GetAnnotations()[NamePrefixAnnotationKey])
+	assert.Equal(t, "workers", clone.GetAnnotations()[ReplacesAnnotationKey])
+
+	ami, _, _ := unstructured.NestedString(clone.Object, "spec", "template", "spec", "ami", "id")
+	assert.Equal(t, "ami-new", ami)
+	instanceType, _, _ := unstructured.NestedString(clone.Object, "spec", "template", "spec", "instanceType")
+	assert.Equal(t, "m5.large", instanceType)
+	_, found, _ := unstructured.NestedFieldNoCopy(clone.Object, "status")
+	assert.False(t, found)
+
+	// the source is untouched
+	ami, _, _ = unstructured.NestedString(source.Object, "spec", "template", "spec", "ami", "id")
+	assert.Equal(t, "ami-old", ami)
+}
+
+func TestRotateInfrastructureTemplateResume(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clusterapiv1alpha2.AddToScheme(scheme))
+
+	source := awsMachineTemplate("workers", nil)
+	require.NoError(t, unstructured.SetNestedField(source.Object, "ami-old", "spec", "template", "spec", "ami", "id"))
+	name, err := templateCloneName(&source, "42")
+	require.NoError(t, err)
+
+	existing := func(upgradeID, clonedFrom, ami string) *unstructured.Unstructured {
+		clone := cloneObject(&source, name, upgradeID)
+		annotations := clone.GetAnnotations()
+		annotations[ReplacesAnnotationKey] = clonedFrom
+		clone.SetAnnotations(annotations)
+		require.NoError(t, unstructured.SetNestedField(clone.Object, ami, "spec", "template", "spec", "ami", "id"))
+		return clone
+	}
+
+	testcases := []struct {
+		name        string
+		existing    *unstructured.Unstructured
+		expectError bool
+	}{
+		{
+			name: "not created yet",
+		},
+		{
+			name:     "created by a previous run of the same upgrade",
+			existing: existing("42", "workers", "ami-new"),
+		},
+		{
+			name:        "created by another upgrade",
+			existing:    existing("41", "workers", "ami-new"),
+			expectError: true,
+		},
+		{
+			name:        "cloned from another template",
+			existing:    existing("42", "other", "ami-new"),
+			expectError: true,
+		},
+		{
+			name:        "without the new image",
+			existing:    existing("42", "workers", "ami-other"),
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			objects := []runtime.Object{source.DeepCopy()}
+			if tc.existing != nil {
+				objects = append(objects, tc.existing)
+			}
+			u := &base{
+				log:                      testLogger(),
+				upgradeID:                "42",
+				imageID:                  "ami-new",
+				infrastructureImageField: "spec.ami.id",
+				ctrlClient:               fake.NewFakeClientWithScheme(scheme, objects...),
+			}
+
+			template := clusterapiv1alpha2.MachineTemplateSpec{
+				Spec: clusterapiv1alpha2.MachineSpec{
+					InfrastructureRef: v1.ObjectReference{APIVersion: source.GetAPIVersion(), Kind: source.GetKind(), Name: source.GetName()},
+				},
+			}
+			err := u.rotateInfrastructureTemplate("default", &template)
+			if tc.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, name, template.Spec.InfrastructureRef.Name)
+
+			clone := &unstructured.Unstructured{}
+			clone.SetGroupVersionKind(source.GroupVersionKind())
+			require.NoError(t, u.ctrlClient.Get(context.TODO(), ctrlclient.ObjectKey{Namespace: "default", Name: name}, clone))
+			ami, _, _ := unstructured.NestedString(clone.Object, "spec", "template", "spec", "ami", "id")
+			assert.Equal(t, "ami-new", ami)
+		})
+	}
+}
+
+func TestRotateBootstrapTemplateResume(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clusterapiv1alpha2.AddToScheme(scheme))
+
+	source := unstructured.Unstructured{}
+	source.SetAPIVersion("bootstrap.cluster.x-k8s.io/v1alpha2")
+	source.SetKind("KubeadmConfigTemplate")
+	source.SetNamespace("default")
+	source.SetName("workers")
+	require.NoError(t, unstructured.SetNestedField(source.Object, "old", "spec", "template", "spec", "preKubeadmCommands"))
+	name, err := templateCloneName(&source, "42")
+	require.NoError(t, err)
+
+	existing := func(upgradeID, commands string) *unstructured.Unstructured {
+		clone := cloneObject(&source, name, upgradeID)
+		require.NoError(t, unstructured.SetNestedField(clone.Object, commands, "spec", "template", "spec", "preKubeadmCommands"))
+		return clone
+	}
+
+	testcases := []struct {
+		name        string
+		existing    *unstructured.Unstructured
+		expectError bool
+	}{
+		{
+			name:     "created by a previous run of the same upgrade",
+			existing: existing("42", "new"),
+		},
+		{
+			name:        "created by another upgrade",
+			existing:    existing("41", "new"),
+			expectError: true,
+		},
+		{
+			name:        "without the patch",
+			existing:    existing("42", "old"),
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			u := &base{
+				log:                  testLogger(),
+				upgradeID:            "42",
+				bootstrapConfigPatch: []byte(`{"spec":{"template":{"spec":{"preKubeadmCommands":"new"}}}}`),
+				ctrlClient:           fake.NewFakeClientWithScheme(scheme, source.DeepCopy(), tc.existing),
+			}
+
+			template := clusterapiv1alpha2.MachineTemplateSpec{
+				Spec: clusterapiv1alpha2.MachineSpec{
+					Bootstrap: clusterapiv1alpha2.Bootstrap{
+						ConfigRef: &v1.ObjectReference{APIVersion: source.GetAPIVersion(), Kind: source.GetKind(), Name: source.GetName()},
+					},
+				},
+			}
+			err := u.rotateBootstrapTemplate("default", &template)
+			if tc.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, name, template.Spec.Bootstrap.ConfigRef.Name)
+		})
+	}
+}
+
+func TestUnreferencedTemplates(t *testing.T) {
+	labelled := map[string]string{UpgradeIDLabelKey: "upgrade"}
+	bootstrapTemplate := func(name string) unstructured.Unstructured {
+		template := awsMachineTemplate(name, labelled)
+		template.SetKind("KubeadmConfigTemplate")
+		return template
+	}
+	templates := []unstructured.Unstructured{
+		awsMachineTemplate("current", labelled),
+		awsMachineTemplate("still-scaling-down", labelled),
+		awsMachineTemplate("scaled-down", labelled),
+		awsMachineTemplate("unreferenced", labelled),
+		bootstrapTemplate("current"),
+		bootstrapTemplate("unreferenced"),
+	}
+
+	infraRef := func(name string) clusterapiv1alpha2.MachineTemplateSpec {
+		return clusterapiv1alpha2.MachineTemplateSpec{
+			Spec: clusterapiv1alpha2.MachineSpec{
+				InfrastructureRef: v1.ObjectReference{Kind: "AWSMachineTemplate", Name: name},
+				Bootstrap: clusterapiv1alpha2.Bootstrap{
+					ConfigRef: &v1.ObjectReference{Kind: "KubeadmConfigTemplate", Name: name},
+				},
+			},
+		}
+	}
+	zero := int32(0)
+
+	machineDeployments := []clusterapiv1alpha2.MachineDeployment{
+		{Spec: clusterapiv1alpha2.MachineDeploymentSpec{Template: infraRef("current")}},
+	}
+	// Machine sets scaled down to 0 are the rollback history of their machine deployment
+	machineSets := []clusterapiv1alpha2.MachineSet{
+		{
+			Spec:   clusterapiv1alpha2.MachineSetSpec{Replicas: &zero, Template: infraRef("still-scaling-down")},
+			Status: clusterapiv1alpha2.MachineSetStatus{Replicas: 1},
+		},
+		{
+			Spec: clusterapiv1alpha2.MachineSetSpec{Replicas: &zero, Template: infraRef("scaled-down")},
+		},
+	}
+
+	unreferenced := unreferencedTemplates(templates, machineDeployments, machineSets)
+	require.Len(t, unreferenced, 2)
+	assert.Equal(t, "AWSMachineTemplate/unreferenced", objectKey(unreferenced[0].GetKind(), unreferenced[0].GetName()))
+	assert.Equal(t, "KubeadmConfigTemplate/unreferenced", objectKey(unreferenced[1].GetKind(), unreferenced[1].GetName()))
+}
+
+// templateClient serves templates from a fixed list, which the fake client can't list as unstructured objects, and
+// records the objects deleted.
+type templateClient struct {
+	ctrlclient.Client
+	templates []unstructured.Unstructured
+	deleted   []string
+}
+
+func (c *templateClient) List(ctx context.Context, list runtime.Object, opts ...ctrlclient.ListOption) error {
+	if list, ok := list.(*unstructured.UnstructuredList); ok {
+		list.Items = c.templates
+		return nil
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+func (c *templateClient) Delete(_ context.Context, obj runtime.Object, _ ...ctrlclient.DeleteOption) error {
+	object := obj.(*unstructured.Unstructured)
+	c.deleted = append(c.deleted, objectKey(object.GetKind(), object.GetName()))
+	return nil
+}
+
+func TestGarbageCollectTemplatesWithImageID(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clusterapiv1alpha2.AddToScheme(scheme))
+
+	labelled := map[string]string{UpgradeIDLabelKey: "upgrade"}
+	current := awsMachineTemplate("current", labelled)
+	machineDeployment := &clusterapiv1alpha2.MachineDeployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "md"},
+		Spec: clusterapiv1alpha2.MachineDeploymentSpec{
+			Template: clusterapiv1alpha2.MachineTemplateSpec{
+				Spec: clusterapiv1alpha2.MachineSpec{
+					InfrastructureRef: v1.ObjectReference{APIVersion: current.GetAPIVersion(), Kind: current.GetKind(), Name: current.GetName()},
+				},
+			},
+		},
+	}
+
+	client := &templateClient{
+		Client:    fake.NewFakeClientWithScheme(scheme, machineDeployment),
+		templates: []unstructured.Unstructured{current, awsMachineTemplate("previous", labelled)},
+	}
+	// Only the image ID is set, without an infrastructure image field or a bootstrap config patch
+	u := &base{
+		log:              testLogger(),
+		clusterNamespace: "default",
+		imageID:          "ami-new",
+		ctrlClient:       client,
+	}
+
+	require.NoError(t, u.garbageCollectTemplates())
+	assert.Equal(t, []string{"AWSMachineTemplate/previous"}, client.deleted)
+}
+
+func TestLoadBootstrapConfigPatchAndMergePatchObject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bootstrap-config-patch")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "patch.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`
+spec:
+  template:
+    spec:
+      joinConfiguration:
+        nodeRegistration:
+          kubeletExtraArgs:
+            cloud-provider: aws
+            feature-gates: null
+`), 0600))
+
+	patch, err := loadBootstrapConfigPatch(path)
+	require.NoError(t, err)
+
+	source := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "bootstrap.cluster.x-k8s.io/v1alpha2",
+		"kind":       "KubeadmConfigTemplate",
+		"metadata":   map[string]interface{}{"namespace": "default", "name": "workers"},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"joinConfiguration": map[string]interface{}{
+						"nodeRegistration": map[string]interface{}{
+							"kubeletExtraArgs": map[string]interface{}{
+								"feature-gates": "SomeGate=true",
+								"node-labels":   "pool=workers",
+							},
+						},
+					},
+				},
+			},
+		},
+	}}
+
+	patched, err := mergePatchObject(source, patch)
+	require.NoError(t, err)
+
+	args, _, err := unstructured.NestedStringMap(patched.Object, "spec", "template", "spec", "joinConfiguration", "nodeRegistration", "kubeletExtraArgs")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"cloud-provider": "aws", "node-labels": "pool=workers"}, args)
+	assert.Equal(t, "workers", patched.GetName())
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("- not an object\n"), 0600))
+	_, err = loadBootstrapConfigPatch(path)
+	assert.Error(t, err)
+}
+
+func TestInfrastructureImageFieldFor(t *testing.T) {
+	testcases := []struct {
+		name          string
+		u             *base
+		kind          string
+		expected      string
+		expectedError bool
+	}{
+		{name: "no image", u: &base{}, kind: "AWSMachine"},
+		{name: "configured field", u: &base{imageID: "ami-new", infrastructureImageField: "spec.image"}, kind: "AWSMachine", expected: "spec.image"},
+		{name: "provider field", u: &base{imageID: "ami-new"}, kind: "AWSMachineTemplate", expected: "spec.ami.id"},
+		{name: "machine spec field only", u: &base{imageID: "ami-new", imageField: "spec.providerSpec.value.ami.id"}, kind: "AWSMachine"},
+		{name: "unknown provider field", u: &base{imageID: "some-image"}, kind: "VSphereMachine", expectedError: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			field, err := tc.u.infrastructureImageFieldFor(tc.kind)
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, field)
+		})
+	}
+}
+
+func TestUpdateInfrastructureMachineClass(t *testing.T) {
+	template := awsMachineTemplate("workers", nil)
+	require.NoError(t, unstructured.SetNestedField(template.Object, "m5.large", "spec", "template", "spec", "instanceType"))
+
+	u := &base{machineClass: "m5.xlarge"}
+	require.NoError(t, u.updateInfrastructureTemplate(&template))
+	instanceType, _, _ := unstructured.NestedString(template.Object, "spec", "template", "spec", "instanceType")
+	assert.Equal(t, "m5.xlarge", instanceType)
+
+	machine := &unstructured.Unstructured{}
+	machine.SetKind("AWSMachine")
+	require.NoError(t, u.updateInfrastructureMachine(machine))
+	instanceType, _, _ = unstructured.NestedString(machine.Object, "spec", "instanceType")
+	assert.Equal(t, "m5.xlarge", instanceType)
+
+	dockerMachine := &unstructured.Unstructured{}
+	dockerMachine.SetKind("DockerMachine")
+	assert.Error(t, u.updateInfrastructureMachine(dockerMachine))
+}
+
+func TestGarbageCollectTemplatesOfMachineSets(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clusterapiv1alpha2.AddToScheme(scheme))
+
+	labelled := map[string]string{UpgradeIDLabelKey: "upgrade"}
+	current := awsMachineTemplate("current", labelled)
+	// A worker machine upgrade rotates the templates of machine sets that no machine deployment manages
+	machineSet := &clusterapiv1alpha2.MachineSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "ms"},
+		Spec: clusterapiv1alpha2.MachineSetSpec{
+			Template: clusterapiv1alpha2.MachineTemplateSpec{
+				Spec: clusterapiv1alpha2.MachineSpec{
+					InfrastructureRef: v1.ObjectReference{APIVersion: current.GetAPIVersion(), Kind: current.GetKind(), Name: current.GetName()},
+				},
+			},
+		},
+	}
+
+	client := &templateClient{
+		Client:    fake.NewFakeClientWithScheme(scheme, machineSet),
+		templates: []unstructured.Unstructured{current, awsMachineTemplate("previous", labelled)},
+	}
+	u := &base{
+		log:              testLogger(),
+		clusterNamespace: "default",
+		ctrlClient:       client,
+	}
+
+	require.NoError(t, u.garbageCollectTemplates())
+	assert.Equal(t, []string{"AWSMachineTemplate/previous"}, client.deleted)
+}
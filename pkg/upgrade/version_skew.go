@@ -0,0 +1,64 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"github.com/blang/semver"
+	"github.com/pkg/errors"
+)
+
+// maxKubeletMinorSkew is how many minor versions a kubelet may be older than kube-apiserver.
+const maxKubeletMinorSkew = 2
+
+// checkWorkerVersionSkew returns an error if workers at the desired version would break the supported skew between
+// kubelet and the control plane. The control plane versions are read from the control plane machines and from the
+// discovery API of the target cluster.
+func (u *base) checkWorkerVersionSkew() error {
+	machines, err := u.listControlPlaneMachines()
+	if err != nil {
+		return err
+	}
+
+	min, max, err := u.minMaxControlPlaneVersions(machines)
+	if err != nil {
+		return errors.Wrap(err, "error determining current control plane versions")
+	}
+
+	info, err := u.targetKubernetesClient.Discovery().ServerVersion()
+	if err != nil {
+		return errors.Wrap(err, "error getting the kube-apiserver version")
+	}
+	apiServerVersion, err := semver.ParseTolerant(info.GitVersion)
+	if err != nil {
+		return errors.Wrapf(err, "invalid kube-apiserver version %q", info.GitVersion)
+	}
+
+	err = checkKubeletVersionSkew(u.desiredVersion, []semver.Version{min, max, apiServerVersion})
+	if err != nil && u.ignoreVersionSkew {
+		u.log.Info("Ignoring unsupported version skew", "reason", err.Error())
+		return nil
+	}
+	return err
+}
+
+// checkKubeletVersionSkew returns an error if a kubelet at version would be newer than any of the control plane
+// versions, or more than maxKubeletMinorSkew minor versions older than any of them. Unset versions are ignored.
+func checkKubeletVersionSkew(version semver.Version, controlPlaneVersions []semver.Version) error {
+	for _, controlPlane := range controlPlaneVersions {
+		if controlPlane.EQ(unsetVersion) {
+			continue
+		}
+
+		if version.Major != controlPlane.Major {
+			return errors.Errorf("kubelet version %s and control plane version %s have different major versions", version, controlPlane)
+		}
+		if version.Minor > controlPlane.Minor {
+			return errors.Errorf("kubelet version %s must not be newer than control plane version %s, upgrade the control plane first", version, controlPlane)
+		}
+		if controlPlane.Minor-version.Minor > maxKubeletMinorSkew {
+			return errors.Errorf("kubelet version %s must not be more than %d minor versions older than control plane version %s", version, maxKubeletMinorSkew, controlPlane)
+		}
+	}
+	return nil
+}
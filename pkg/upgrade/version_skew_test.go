@@ -0,0 +1,75 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/blang/semver"
+)
+
+func TestCheckKubeletVersionSkew(t *testing.T) {
+	testcases := []struct {
+		name          string
+		version       string
+		controlPlane  []string
+		expectedError bool
+	}{
+		{
+			name:         "same version",
+			version:      "1.15.3",
+			controlPlane: []string{"1.15.3", "1.15.3"},
+		},
+		{
+			name:         "newer patch on the same minor",
+			version:      "1.15.4",
+			controlPlane: []string{"1.15.3"},
+		},
+		{
+			name:         "two minors older",
+			version:      "1.13.10",
+			controlPlane: []string{"1.15.0"},
+		},
+		{
+			name:          "three minors older",
+			version:       "1.12.10",
+			controlPlane:  []string{"1.15.0"},
+			expectedError: true,
+		},
+		{
+			name:          "newer than the apiserver",
+			version:       "1.16.0",
+			controlPlane:  []string{"1.16.0", "1.15.3"},
+			expectedError: true,
+		},
+		{
+			name:          "different major",
+			version:       "2.0.0",
+			controlPlane:  []string{"1.15.3"},
+			expectedError: true,
+		},
+		{
+			name:         "unset control plane versions are ignored",
+			version:      "1.15.3",
+			controlPlane: []string{"0.0.0", "1.15.0"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var controlPlane []semver.Version
+			for _, v := range tc.controlPlane {
+				controlPlane = append(controlPlane, semver.MustParse(v))
+			}
+
+			err := checkKubeletVersionSkew(semver.MustParse(tc.version), controlPlane)
+			if tc.expectedError && err == nil {
+				t.Fatal("Expected an error but didn't receive one")
+			}
+			if !tc.expectedError && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
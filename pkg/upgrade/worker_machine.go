@@ -0,0 +1,349 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"context"
+
+	"github.com/blang/semver"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// WorkerMachineUpgrader upgrades the worker machines that aren't managed by a MachineDeployment: machines created
+// directly and machines owned by a bare MachineSet.
+type WorkerMachineUpgrader struct {
+	*base
+}
+
+func NewWorkerMachineUpgrader(log logr.Logger, config Config) (*WorkerMachineUpgrader, error) {
+	b, err := newBase(log, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "error initializing upgrader")
+	}
+
+	return &WorkerMachineUpgrader{
+		base: b,
+	}, nil
+}
+
+// Upgrade updates the templates of bare MachineSets and then replaces their machines and the standalone worker
+// machines one at a time.
+func (u *WorkerMachineUpgrader) Upgrade() error {
+	return u.explainForbidden(u.upgrade())
+}
+
+func (u *WorkerMachineUpgrader) upgrade() error {
+	machines, err := u.listWorkerMachines()
+	if err != nil {
+		return err
+	}
+
+	machineSets := &clusterapiv1alpha2.MachineSetList{}
+	if err := u.ctrlClient.List(context.TODO(), machineSets, ctrlclient.InNamespace(u.clusterNamespace)); err != nil {
+		return errors.Wrap(err, "error listing machine sets")
+	}
+
+	plan := planWorkerMachineUpgrade(machines.Items, machineSets.Items, u.upgradeID)
+	if len(plan.candidates) == 0 {
+		return errors.New("Found 0 worker machines that are not managed by a machine deployment")
+	}
+
+	refs := machineRefs(plan.candidates)
+	for _, machineSet := range plan.machineSets {
+		refs = append(refs, templateRefs(machineSet.Spec.Template)...)
+	}
+	if err := u.rbacPreflight(WorkerMachineScope, refs); err != nil {
+		return err
+	}
+
+	if err := u.checkWorkerVersionSkew(); err != nil {
+		return err
+	}
+
+	min, err := minMachineVersion(plan.candidates)
+	if err != nil {
+		return errors.Wrap(err, "error determining current worker machine versions")
+	}
+
+	if err := u.updateKubeletConfigIfNeeded(min); err != nil {
+		return err
+	}
+
+	for i := range plan.machineSets {
+		if err := u.updateMachineSet(&plan.machineSets[i]); err != nil {
+			return err
+		}
+	}
+
+	if err := u.UpdateProviderIDsToNodes(); err != nil {
+		return err
+	}
+
+	if err := u.replaceWorkerMachines(plan.machines); err != nil {
+		u.cleanupAfterFailure()
+		return err
+	}
+
+	if err := u.garbageCollectTemplates(); err != nil {
+		return err
+	}
+
+	return u.cleanupPreviousKubeletConfigIfNeeded()
+}
+
+// workerMachineUpgradePlan lists what the worker machine scope has to upgrade.
+type workerMachineUpgradePlan struct {
+	// candidates are all the worker machines in scope, whether they were already upgraded or not.
+	candidates []clusterapiv1alpha2.Machine
+	// machines are the candidates that still have to be replaced.
+	machines []clusterapiv1alpha2.Machine
+	// machineSets are the bare MachineSets whose template still has to be updated.
+	machineSets []clusterapiv1alpha2.MachineSet
+}
+
+// planWorkerMachineUpgrade picks the worker machines that are either not owned by anything or owned by a MachineSet
+// that isn't managed by a MachineDeployment, and the MachineSets those belong to.
+func planWorkerMachineUpgrade(machines []clusterapiv1alpha2.Machine, machineSets []clusterapiv1alpha2.MachineSet, upgradeID string) workerMachineUpgradePlan {
+	var plan workerMachineUpgradePlan
+
+	bareMachineSets := make(map[string]clusterapiv1alpha2.MachineSet)
+	for _, machineSet := range machineSets {
+		if owner := metav1.GetControllerOf(&machineSet); owner != nil && owner.Kind == "MachineDeployment" {
+			continue
+		}
+		bareMachineSets[machineSet.Name] = machineSet
+	}
+
+	usedMachineSets := sets.NewString()
+	for _, machine := range machines {
+		if machine.Labels[clusterapiv1alpha2.MachineControlPlaneLabelName] == "true" {
+			continue
+		}
+
+		if owner := metav1.GetControllerOf(&machine); owner != nil {
+			if _, ok := bareMachineSets[owner.Name]; owner.Kind != "MachineSet" || !ok {
+				continue
+			}
+			usedMachineSets.Insert(owner.Name)
+		}
+
+		plan.candidates = append(plan.candidates, machine)
+		// Skip any machine that already has the annotation we're looking for
+		if machine.Annotations[UpgradeIDAnnotationKey] != upgradeID {
+			plan.machines = append(plan.machines, machine)
+		}
+	}
+
+	for _, name := range usedMachineSets.List() {
+		machineSet := bareMachineSets[name]
+		if machineSet.Spec.Template.Annotations[UpgradeIDAnnotationKey] != upgradeID {
+			plan.machineSets = append(plan.machineSets, machineSet)
+		}
+	}
+
+	return plan
+}
+
+// minMachineVersion returns the lowest version of machines.
+func minMachineVersion(machines []clusterapiv1alpha2.Machine) (semver.Version, error) {
+	var min semver.Version
+
+	for _, machine := range machines {
+		if machine.Spec.Version == nil || *machine.Spec.Version == "" {
+			continue
+		}
+		v, err := semver.ParseTolerant(*machine.Spec.Version)
+		if err != nil {
+			return min, errors.Wrapf(err, "invalid version %q for machine %s/%s", *machine.Spec.Version, machine.Namespace, machine.Name)
+		}
+		if min.EQ(unsetVersion) || v.LT(min) {
+			min = v
+		}
+	}
+
+	return min, nil
+}
+
+func (u *WorkerMachineUpgrader) listWorkerMachines() (*clusterapiv1alpha2.MachineList, error) {
+	labels := ctrlclient.MatchingLabels{
+		clusterapiv1alpha2.MachineClusterLabelName: u.clusterName,
+	}
+	machines := &clusterapiv1alpha2.MachineList{}
+
+	u.log.Info("Listing machines", "labelSelector", labels)
+	err := u.ctrlClient.List(context.TODO(), machines, labels, ctrlclient.InNamespace(u.clusterNamespace))
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing machines")
+	}
+
+	return machines, nil
+}
+
+// updateMachineSet updates the template of a bare MachineSet so the machines it creates from now on come up at the
+// desired version.
+func (u *WorkerMachineUpgrader) updateMachineSet(machineSet *clusterapiv1alpha2.MachineSet) error {
+	u.log.Info("Updating MachineSet", "namespace", machineSet.Namespace, "name", machineSet.Name)
+
+	original := machineSet.DeepCopy()
+
+	if err := u.updateMachineTemplate(&machineSet.Spec.Template); err != nil {
+		return err
+	}
+
+	if err := u.rotateInfrastructureTemplate(machineSet.Namespace, &machineSet.Spec.Template); err != nil {
+		return err
+	}
+
+	if err := u.rotateBootstrapTemplate(machineSet.Namespace, &machineSet.Spec.Template); err != nil {
+		return err
+	}
+
+	if err := u.ctrlClient.Patch(context.TODO(), machineSet.DeepCopy(), ctrlclient.MergeFrom(original)); err != nil {
+		return errors.Wrapf(err, "error patching machineset %s", machineSet.Name)
+	}
+
+	return nil
+}
+
+func (u *WorkerMachineUpgrader) replaceWorkerMachines(machines []clusterapiv1alpha2.Machine) error {
+	var toUpgrade []clusterapiv1alpha2.Machine
+	for _, machine := range machines {
+		if machine.Spec.ProviderID == nil {
+			u.log.Info("unable to upgrade machine as it has no spec.providerID", "name", machine.Name)
+			continue
+		}
+		toUpgrade = append(toUpgrade, machine)
+	}
+
+	names, err := u.replacementNames(toUpgrade)
+	if err != nil {
+		return err
+	}
+
+	// worker nodes don't run control plane components, so only wait for them to become ready
+	machineCreator := u.newMachineCreator(WithComponents())
+
+	for _, machine := range toUpgrade {
+		if err := u.replaceWorkerMachine(names[machine.Name], machine, machineCreator); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replaceWorkerMachine creates the replacement of machine and removes machine once the new node is ready. The
+// replacement of a machine owned by a MachineSet is created without its controller reference and selector labels, so
+// the MachineSet neither counts nor adopts it while it comes up. Once its node is ready, the old machine is marked for
+// deletion and the labels are restored: the MachineSet adopts the replacement and removes the marked machine to get
+// back to its replica count.
+func (u *WorkerMachineUpgrader) replaceWorkerMachine(name string, machine clusterapiv1alpha2.Machine, machineCreator *MachineCreator) error {
+	oldMachine := machine.DeepCopy()
+
+	oldNode, err := u.nodeForMachine(&machine)
+	if err != nil {
+		return err
+	}
+
+	if err := u.prepareReplacement(name, &machine); err != nil {
+		return err
+	}
+
+	var selectorLabels map[string]string
+	owner := metav1.GetControllerOf(oldMachine)
+	if owner != nil {
+		machineSet := &clusterapiv1alpha2.MachineSet{}
+		key := ctrlclient.ObjectKey{Namespace: oldMachine.Namespace, Name: owner.Name}
+		if err := u.ctrlClient.Get(context.TODO(), key, machineSet); err != nil {
+			return errors.Wrapf(err, "error getting machineset %s", owner.Name)
+		}
+		selectorLabels, err = detachFromMachineSet(&machine, machineSet)
+		if err != nil {
+			return err
+		}
+	}
+
+	newMachine, _, err := machineCreator.NewMachine(name, &machine)
+	if err != nil {
+		return err
+	}
+
+	if owner != nil {
+		if err := u.markMachineForDeletion(oldMachine); err != nil {
+			return err
+		}
+		if err := u.restoreLabels(newMachine, selectorLabels); err != nil {
+			return err
+		}
+	} else {
+		if err := u.deleteMachine(oldMachine); err != nil {
+			return err
+		}
+	}
+
+	if err := u.waitForMachineDeletion(oldMachine, u.machineDeletionTimeout); err != nil {
+		return err
+	}
+
+	return u.deleteStaleNode(oldNode)
+}
+
+// detachFromMachineSet removes the controller reference of machine and the labels machineSet selects its machines
+// by, and returns the removed labels. It fails if the MachineSet would still select the machine.
+func detachFromMachineSet(machine *clusterapiv1alpha2.Machine, machineSet *clusterapiv1alpha2.MachineSet) (map[string]string, error) {
+	var ownerReferences []metav1.OwnerReference
+	for _, ref := range machine.OwnerReferences {
+		if ref.Controller == nil || !*ref.Controller {
+			ownerReferences = append(ownerReferences, ref)
+		}
+	}
+	machine.OwnerReferences = ownerReferences
+
+	removed := make(map[string]string)
+	for key := range machineSet.Spec.Selector.MatchLabels {
+		if value, ok := machine.Labels[key]; ok {
+			removed[key] = value
+			delete(machine.Labels, key)
+		}
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(&machineSet.Spec.Selector)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid selector of machineset %s", machineSet.Name)
+	}
+	if !selector.Empty() && selector.Matches(labels.Set(machine.Labels)) {
+		return nil, errors.Errorf("machineset %s would adopt the replacement of machine %s before it is ready, its selector %q has to use matchLabels",
+			machineSet.Name, machine.Name, selector)
+	}
+
+	return removed, nil
+}
+
+// restoreLabels adds labels back to machine.
+func (u *base) restoreLabels(machine *clusterapiv1alpha2.Machine, restored map[string]string) error {
+	if len(restored) == 0 {
+		return nil
+	}
+	u.log.Info("Handing machine over to its MachineSet", "namespace", machine.Namespace, "name", machine.Name)
+
+	original := machine.DeepCopy()
+	if machine.Labels == nil {
+		machine.Labels = map[string]string{}
+	}
+	for key, value := range restored {
+		machine.Labels[key] = value
+	}
+
+	if err := u.ctrlClient.Patch(context.TODO(), machine.DeepCopy(), ctrlclient.MergeFrom(original)); err != nil {
+		return errors.Wrapf(err, "error restoring labels of machine %s", machine.Name)
+	}
+
+	return nil
+}
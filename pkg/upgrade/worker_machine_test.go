@@ -0,0 +1,92 @@
+// Copyright 2019 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterapiv1alpha2 "sigs.k8s.io/cluster-api/api/v1alpha2"
+)
+
+func TestPlanWorkerMachineUpgrade(t *testing.T) {
+	controller := true
+	ownedBy := func(kind, name string) []metav1.OwnerReference {
+		return []metav1.OwnerReference{{Kind: kind, Name: name, Controller: &controller}}
+	}
+
+	machineSets := []clusterapiv1alpha2.MachineSet{
+		{ObjectMeta: metav1.ObjectMeta{Name: "bare"}},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "bare-done"},
+			Spec: clusterapiv1alpha2.MachineSetSpec{
+				Template: clusterapiv1alpha2.MachineTemplateSpec{
+					ObjectMeta: clusterapiv1alpha2.ObjectMeta{Annotations: map[string]string{UpgradeIDAnnotationKey: "upgrade"}},
+				},
+			},
+		},
+		{ObjectMeta: metav1.ObjectMeta{Name: "deployed", OwnerReferences: ownedBy("MachineDeployment", "md")}},
+	}
+
+	machines := []clusterapiv1alpha2.Machine{
+		{ObjectMeta: metav1.ObjectMeta{Name: "standalone"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "standalone-done", Annotations: map[string]string{UpgradeIDAnnotationKey: "upgrade"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "control-plane", Labels: map[string]string{clusterapiv1alpha2.MachineControlPlaneLabelName: "true"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "from-bare", OwnerReferences: ownedBy("MachineSet", "bare")}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "from-bare-done", OwnerReferences: ownedBy("MachineSet", "bare-done")}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "from-deployment", OwnerReferences: ownedBy("MachineSet", "deployed")}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "from-unknown", OwnerReferences: ownedBy("MachineSet", "unknown")}},
+	}
+
+	plan := planWorkerMachineUpgrade(machines, machineSets, "upgrade")
+
+	machineNames := func(machines []clusterapiv1alpha2.Machine) []string {
+		var names []string
+		for _, machine := range machines {
+			names = append(names, machine.Name)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"standalone", "standalone-done", "from-bare", "from-bare-done"}, machineNames(plan.candidates))
+	assert.Equal(t, []string{"standalone", "from-bare", "from-bare-done"}, machineNames(plan.machines))
+	if assert.Len(t, plan.machineSets, 1) {
+		assert.Equal(t, "bare", plan.machineSets[0].Name)
+	}
+}
+
+func TestDetachFromMachineSet(t *testing.T) {
+	controller := true
+	machineSet := &clusterapiv1alpha2.MachineSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "bare"},
+		Spec: clusterapiv1alpha2.MachineSetSpec{
+			Selector: metav1.LabelSelector{MatchLabels: map[string]string{"pool": "workers"}},
+		},
+	}
+	machine := &clusterapiv1alpha2.Machine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "worker",
+			Labels: map[string]string{"pool": "workers", "zone": "a"},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: "MachineSet", Name: "bare", Controller: &controller},
+				{Kind: "ConfigMap", Name: "other"},
+			},
+		},
+	}
+
+	removed, err := detachFromMachineSet(machine, machineSet)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"pool": "workers"}, removed)
+	assert.Equal(t, map[string]string{"zone": "a"}, machine.Labels)
+	assert.Equal(t, []metav1.OwnerReference{{Kind: "ConfigMap", Name: "other"}}, machine.OwnerReferences)
+
+	machineSet.Spec.Selector.MatchExpressions = []metav1.LabelSelectorRequirement{
+		{Key: "zone", Operator: metav1.LabelSelectorOpExists},
+	}
+	machineSet.Spec.Selector.MatchLabels = nil
+	_, err = detachFromMachineSet(machine, machineSet)
+	assert.Error(t, err)
+}